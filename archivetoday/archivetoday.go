@@ -0,0 +1,246 @@
+// Package archivetoday implements common.Source for archive.today (archive.ph, archive.is) snapshots.
+//
+// Captures of a URL are listed with the Memento TimeMap of archive.today, which has no CDX server:
+// only exact URLs can be queried, filters, dates, collapses and limit are applied on the client,
+// and records have no MIME type, status, digest or WARC location.
+package archivetoday
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	common "github.com/karust/gogetcrawl/common"
+	"github.com/karust/gogetcrawl/memento"
+)
+
+const INDEX_SERVER = "https://archive.ph/timemap"
+const CRAWL_STORAGE = "https://archive.ph"
+
+type ArchiveToday struct {
+	MaxTimeout   int            // Request timeout
+	MaxRetries   int            // Max number of request retries if timeouted
+	client       *common.Client // HTTP client, common.DefaultClient if nil
+	indexServer  string         // TimeMap URL, INDEX_SERVER by default
+	crawlStorage string         // Snapshots URL, CRAWL_STORAGE by default
+}
+
+// Option ... Configures ArchiveToday source in New
+type Option func(*ArchiveToday)
+
+// WithClient ... Sets HTTP client, can be shared with other sources
+func WithClient(client *common.Client) Option {
+	return func(at *ArchiveToday) {
+		at.client = client
+	}
+}
+
+// WithIndexServer ... Sets TimeMap URL, timemaps are requested as <url>/<original>
+//
+//	url: like "https://archive.is/timemap"
+func WithIndexServer(url string) Option {
+	return func(at *ArchiveToday) {
+		at.indexServer = strings.TrimRight(url, "/")
+	}
+}
+
+// WithCrawlStorage ... Sets URL of snapshots, they are requested as <url>/<timestamp>/<original>
+//
+//	url: like "https://archive.is"
+func WithCrawlStorage(url string) Option {
+	return func(at *ArchiveToday) {
+		at.crawlStorage = strings.TrimRight(url, "/")
+	}
+}
+
+func New(timeout, retries int, opts ...Option) (*ArchiveToday, error) {
+	source := &ArchiveToday{
+		MaxTimeout:   timeout,
+		MaxRetries:   retries,
+		indexServer:  INDEX_SERVER,
+		crawlStorage: CRAWL_STORAGE,
+	}
+	for _, opt := range opts {
+		opt(source)
+	}
+	return source, nil
+}
+
+func (ArchiveToday) Name() string {
+	return "ArchiveToday"
+}
+
+// GetNumPages ... TimeMap is not paginated, so there is always one page
+func (at *ArchiveToday) GetNumPages(url string) (int, error) {
+	return at.GetNumPagesContext(context.Background(), url)
+}
+
+// GetNumPagesContext ... Same as GetNumPages
+func (at *ArchiveToday) GetNumPagesContext(ctx context.Context, url string) (int, error) {
+	return 1, nil
+}
+
+// ParseResponse ... Parses TimeMap in link format, every memento becomes a record of the original URL
+func (at *ArchiveToday) ParseResponse(resp []byte) ([]*common.CdxResponse, error) {
+	tm, err := memento.ParseTimeMap(resp)
+	if err != nil {
+		return nil, common.NewError(common.KindParse, "ParseResponse", "", err)
+	}
+
+	results := []*common.CdxResponse{}
+	for _, entry := range tm.Mementos {
+		results = append(results, &common.CdxResponse{
+			Urlkey:    common.SURT(tm.Original),
+			Timestamp: common.FormatTimestamp(entry.Datetime),
+			Original:  tm.Original,
+			Memento:   entry.URL,
+			Source:    at,
+		})
+	}
+	return results, nil
+}
+
+// fetchPage ... Requests TimeMap of config URL and applies config to its mementos
+func (at *ArchiveToday) fetchPage(ctx context.Context, config common.RequestConfig) ([]*common.CdxResponse, error) {
+	reqURL := fmt.Sprintf("%v/%v", at.indexServer, config.URL)
+	if strings.Contains(config.URL, "*") {
+		return nil, common.WrapError(fmt.Errorf("Wildcard queries are not supported, use an exact URL"), "FetchPage", at.Name(), reqURL, -1)
+	}
+
+	filter, err := common.NewConfigFilter(config)
+	if err != nil {
+		return nil, common.WrapError(err, "FetchPage", at.Name(), reqURL, -1)
+	}
+
+	response, err := at.client.Get(ctx, reqURL, at.MaxTimeout, at.MaxRetries)
+	// TimeMap of URL without snapshots is not found
+	if errors.Is(err, common.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, common.WrapError(err, "FetchPage", at.Name(), reqURL, -1)
+	}
+
+	results, err := at.ParseResponse(response)
+	if err != nil {
+		return nil, common.WrapError(err, "FetchPage", at.Name(), reqURL, -1)
+	}
+	if len(results) > 0 && results[0].Original == "" {
+		for _, res := range results {
+			res.Original, res.Urlkey = config.URL, common.SURT(config.URL)
+		}
+	}
+	return filter.Filter(results), nil
+}
+
+func (at *ArchiveToday) pager(config common.RequestConfig) common.PageFunc {
+	config.SinglePage = true
+	return common.NewPager(config, nil, func(ctx context.Context, page int) ([]*common.CdxResponse, error) {
+		return at.fetchPage(ctx, config)
+	})
+}
+
+// Iterate ... Returns iterator over snapshots of config URL
+func (at *ArchiveToday) Iterate(ctx context.Context, config common.RequestConfig) *common.Iterator {
+	return common.NewIterator(ctx, at.pager(config))
+}
+
+// GetPages ... Requests TimeMap to gather all snapshots of config URL
+func (at *ArchiveToday) GetPages(config common.RequestConfig) ([]*common.CdxResponse, error) {
+	return at.GetPagesContext(context.Background(), config)
+}
+
+// GetPagesContext ... Same as GetPages, but request is aborted when ctx is done
+func (at *ArchiveToday) GetPagesContext(ctx context.Context, config common.RequestConfig) ([]*common.CdxResponse, error) {
+	return common.Collect(at.Iterate(ctx, config))
+}
+
+// FetchPages ... Concurrent way to GetPages.
+//
+// Deprecated: use Iterate, channels are never closed and completion is not signaled.
+func (at *ArchiveToday) FetchPages(config common.RequestConfig, results chan []*common.CdxResponse, errors chan error) {
+	at.FetchPagesContext(context.Background(), config, results, errors)
+}
+
+// FetchPagesContext ... Same as FetchPages, but returns as soon as ctx is done.
+//
+// Deprecated: use Iterate.
+func (at *ArchiveToday) FetchPagesContext(ctx context.Context, config common.RequestConfig, results chan []*common.CdxResponse, errors chan error) {
+	common.FetchPages(ctx, at.pager(config), results, errors)
+}
+
+// snapshotURL ... Snapshot URL from TimeMap, otherwise archive.today redirects to the snapshot closest to timestamp
+func (at *ArchiveToday) snapshotURL(page *common.CdxResponse) string {
+	if page.Memento != "" {
+		return page.Memento
+	}
+	return fmt.Sprintf("%v/%v/%v", at.crawlStorage, page.Timestamp, page.Original)
+}
+
+// getSnapshot ... Downloads snapshot following redirects to its short URL, returns the final URL
+func (at *ArchiveToday) getSnapshot(ctx context.Context, page *common.CdxResponse) (*common.Response, string, error) {
+	resp, requestURI, err := memento.Follow(ctx, at.client, at.snapshotURL(page), at.MaxTimeout, at.MaxRetries)
+	if err != nil {
+		return nil, requestURI, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, requestURI, common.StatusError(resp.StatusCode, requestURI)
+	}
+	return resp, requestURI, nil
+}
+
+// GetFile ... Downloads snapshot page. Snapshots are rendered by archive.today, so they are not the original response.
+func (at *ArchiveToday) GetFile(page *common.CdxResponse) ([]byte, error) {
+	return at.GetFileContext(context.Background(), page)
+}
+
+// GetFileContext ... Same as GetFile, but download is aborted when ctx is done
+func (at *ArchiveToday) GetFileContext(ctx context.Context, page *common.CdxResponse) ([]byte, error) {
+	resp, requestURI, err := at.getSnapshot(ctx, page)
+	if err != nil {
+		return nil, common.WrapError(err, "GetFile", at.Name(), requestURI, -1)
+	}
+	return resp.Body, nil
+}
+
+// GetCapture ... Downloads snapshot page with headers of archive.today response, original headers are not archived
+func (at *ArchiveToday) GetCapture(page *common.CdxResponse) (*common.Capture, error) {
+	return at.GetCaptureContext(context.Background(), page)
+}
+
+// GetCaptureContext ... Same as GetCapture, but download is aborted when ctx is done
+func (at *ArchiveToday) GetCaptureContext(ctx context.Context, page *common.CdxResponse) (*common.Capture, error) {
+	resp, requestURI, err := at.getSnapshot(ctx, page)
+	if err != nil {
+		return nil, common.WrapError(err, "GetCapture", at.Name(), requestURI, -1)
+	}
+	return common.NewCapture(page, resp.StatusCode, resp.Header, resp.Body), nil
+}
+
+// OpenFile ... Opens snapshot stream. Stream must be closed.
+func (at *ArchiveToday) OpenFile(ctx context.Context, page *common.CdxResponse) (io.ReadCloser, error) {
+	payload, err := at.OpenPayload(ctx, page)
+	if err != nil {
+		return nil, common.WrapError(err, "OpenFile", at.Name(), "", -1)
+	}
+
+	body, err := payload.Decode()
+	if err != nil {
+		return nil, common.WrapError(err, "OpenFile", at.Name(), "", -1)
+	}
+	return body, nil
+}
+
+// OpenPayload ... Opens snapshot without decoding it. Snapshots are single pages, so they are buffered in memory.
+// Snapshots have no digest to verify.
+func (at *ArchiveToday) OpenPayload(ctx context.Context, page *common.CdxResponse) (*common.Payload, error) {
+	resp, requestURI, err := at.getSnapshot(ctx, page)
+	if err != nil {
+		return nil, common.WrapError(err, "OpenPayload", at.Name(), requestURI, -1)
+	}
+	return &common.Payload{ReadCloser: io.NopCloser(bytes.NewReader(resp.Body)), Encoding: resp.Header.Get("Content-Encoding")}, nil
+}
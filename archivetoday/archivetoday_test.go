@@ -0,0 +1,121 @@
+package archivetoday
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	common "github.com/karust/gogetcrawl/common"
+	"github.com/karust/gogetcrawl/testutil"
+)
+
+// Example request: https://archive.ph/timemap/http://example.com/
+const RESPONSE = `<http://example.com/>; rel="original",
+<https://archive.ph/timegate/http://example.com/>; rel="timegate",
+<https://archive.ph/timemap/http://example.com/>; rel="self"; type="application/link-format"; from="Sat, 13 Jul 2013 17:23:41 GMT"; until="Fri, 02 Jun 2023 10:18:04 GMT",
+<https://archive.ph/20130713172341/http://example.com/>; rel="first memento"; datetime="Sat, 13 Jul 2013 17:23:41 GMT",
+<https://archive.ph/nBDMv>; rel="memento"; datetime="Mon, 02 Dec 2019 09:30:12 GMT",
+<https://archive.ph/20230602101804/http://example.com/>; rel="last memento"; datetime="Fri, 02 Jun 2023 10:18:04 GMT"
+`
+
+// Test interface
+var attest common.Source = &ArchiveToday{}
+var at *ArchiveToday
+
+var server *testutil.CDXServer
+
+func TestMain(m *testing.M) {
+	server = testutil.NewCDXServer()
+	for _, c := range testutil.MementoCaptures() {
+		server.AddCapture(c)
+	}
+
+	at, _ = New(15, 2, WithIndexServer(server.TimeMapURL()), WithCrawlStorage(server.ArchiveTodayStorageURL()))
+
+	code := m.Run()
+	server.Close()
+	os.Exit(code)
+}
+
+func TestParseResponse(t *testing.T) {
+	results, err := at.ParseResponse([]byte(RESPONSE))
+	if err != nil {
+		t.Fatalf("Cannot parse response: %v", err)
+	}
+
+	if len(results) != 3 {
+		t.Fatalf("Incorrect number of mementos: %v, want=3", len(results))
+	}
+	if results[1].Timestamp != "20191202093012" || results[1].Original != "http://example.com/" || results[1].Urlkey != "com,example)/" {
+		t.Fatalf("Incorrect memento: %+v", results[1])
+	}
+
+	if _, err := at.ParseResponse([]byte(`<http://example.com/>; rel="original`)); !errors.Is(err, common.ErrParse) {
+		t.Fatalf("Incorrect error of broken response: %v", err)
+	}
+}
+
+func TestGetPages(t *testing.T) {
+	results, err := at.GetPages(common.RequestConfig{URL: "example.com"})
+	if err != nil {
+		t.Fatalf("Cannot get pages: %v", err)
+	}
+	if len(results) != 3 || results[0].Source.Name() != "ArchiveToday" {
+		t.Fatalf("Incorrect number of results: %v, want=3", len(results))
+	}
+
+	cases := []struct {
+		config common.RequestConfig
+		want   int
+	}{
+		{common.RequestConfig{URL: "example.com", FromDate: "2021"}, 1},
+		{common.RequestConfig{URL: "example.com", ToDate: "20200101"}, 2},
+		{common.RequestConfig{URL: "example.com", Limit: 1}, 1},
+		{common.RequestConfig{URL: "example.com", Collapse: []string{"timestamp:8"}}, 2},
+		{common.RequestConfig{URL: "example.com", Filters: []string{"!timestamp:2020.*"}}, 1},
+		{common.RequestConfig{URL: "example.com/missing"}, 0},
+	}
+	for _, c := range cases {
+		results, err := at.GetPages(c.config)
+		if err != nil {
+			t.Fatalf("Cannot get pages for %+v: %v", c.config, err)
+		}
+		if len(results) != c.want {
+			t.Fatalf("Incorrect number of results for %+v: %v, want=%v", c.config, len(results), c.want)
+		}
+	}
+
+	if _, err := at.GetPages(common.RequestConfig{URL: "example.com/*"}); err == nil {
+		t.Fatalf("Wildcard query is accepted")
+	}
+}
+
+func TestGetFile(t *testing.T) {
+	page := &common.CdxResponse{Original: "https://example.com/about", Timestamp: "20200101000000"}
+	want := testutil.HTMLCapture(page.Original, page.Timestamp, 300).Body
+
+	file, err := at.GetFile(page)
+	if err != nil {
+		t.Fatalf("Cannot get file: %v", err)
+	}
+	if !bytes.Equal(file, want) {
+		t.Fatalf("Incorrect snapshot: %q", file)
+	}
+
+	stream, err := at.OpenFile(context.Background(), page)
+	if err != nil {
+		t.Fatalf("Cannot open file: %v", err)
+	}
+	defer stream.Close()
+	if data, _ := io.ReadAll(stream); !bytes.Equal(data, want) {
+		t.Fatalf("Incorrect snapshot stream: %q", data)
+	}
+
+	page.Timestamp = "20190101000000"
+	if _, err := at.GetCapture(page); !errors.Is(err, common.ErrNotFound) {
+		t.Fatalf("Incorrect error of missing snapshot: %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+package blobstore
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	jsoniter "github.com/json-iterator/go"
+	common "github.com/karust/gogetcrawl/common"
+)
+
+const MANIFEST_FILE = "manifest.jsonl"
+const BLOBS_DIR = "blobs"
+
+// Entry ... Manifest line mapping a capture to its blob
+type Entry struct {
+	URL       string `json:"url"`
+	Timestamp string `json:"timestamp"`
+	Source    string `json:"source"`
+	Digest    string `json:"digest"`             // SHA-1 base32 of the payload, name of the blob
+	MimeType  string `json:"mime,omitempty"`     // MIME type from CDX record
+	Encoding  string `json:"encoding,omitempty"` // Content-Encoding of the payload, blob is stored as archived
+	Size      int64  `json:"size"`
+	Path      string `json:"path"` // Blob path relative to the store directory
+}
+
+// Store ... Content-addressed file store: every unique payload is saved once under its digest,
+// manifest.jsonl maps URL, timestamp and source of captures to blobs. Safe to use from multiple workers.
+//
+//	<dir>/manifest.jsonl
+//	<dir>/blobs/2J/2JQ2AQ3HQZIMXHB5CJGSADUGOHYBIRJJ
+type Store struct {
+	dir string
+
+	mu       sync.Mutex
+	manifest *os.File
+	captures map[string]bool  // Captures already in manifest
+	blobs    map[string]Entry // Saved blobs by digest
+}
+
+// Open ... Opens store in dir, creating it if needed. Captures listed in existing manifest are not saved again.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(dir, BLOBS_DIR), 0755); err != nil {
+		return nil, fmt.Errorf("[Open] Cannot create store dir: %v", err)
+	}
+
+	s := &Store{dir: dir, captures: map[string]bool{}, blobs: map[string]Entry{}}
+
+	path := filepath.Join(dir, MANIFEST_FILE)
+	if err := s.readManifest(path); err != nil {
+		return nil, err
+	}
+
+	manifest, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("[Open] Cannot open manifest: %v", err)
+	}
+	s.manifest = manifest
+	return s, nil
+}
+
+func (s *Store) readManifest(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("[Open] Cannot read manifest: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry Entry
+		if err := jsoniter.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// Last line may be cut if previous run crashed
+			continue
+		}
+		s.captures[captureKey(entry.URL, entry.Timestamp, entry.Source)] = true
+		if _, ok := s.blobs[entry.Digest]; !ok {
+			s.blobs[entry.Digest] = entry
+		}
+	}
+	return scanner.Err()
+}
+
+// BlobPath ... Returns path of blob with given digest
+func (s *Store) BlobPath(digest string) string {
+	return filepath.Join(s.dir, s.relPath(digest))
+}
+
+func (s *Store) relPath(digest string) string {
+	prefix := digest
+	if len(prefix) > 2 {
+		prefix = prefix[:2]
+	}
+	return filepath.Join(BLOBS_DIR, prefix, digest)
+}
+
+// Has ... Reports whether blob with given digest is saved
+func (s *Store) Has(digest string) bool {
+	digest = common.NormalizeDigest(digest)
+	if digest == "" {
+		return false
+	}
+
+	s.mu.Lock()
+	_, ok := s.blobs[digest]
+	s.mu.Unlock()
+	if ok {
+		return true
+	}
+
+	_, err := os.Stat(s.BlobPath(digest))
+	return err == nil
+}
+
+// Save ... Downloads payload of CDX record and saves it, unless capture or a blob with its digest is already saved.
+// Download is repeated if payload doesn't match the digest. Returns manifest entry of the capture.
+func (s *Store) Save(ctx context.Context, res *common.CdxResponse) (*Entry, error) {
+	if s.hasCapture(res) {
+		return nil, nil
+	}
+
+	// Identical payload was downloaded before, only the manifest is updated
+	if digest := common.NormalizeDigest(res.Digest); s.Has(digest) {
+		entry := s.blobEntry(digest)
+		entry.URL, entry.Timestamp, entry.Source, entry.MimeType = res.Original, res.Timestamp, res.Source.Name(), res.MimeType
+		return &entry, s.addEntry(entry)
+	}
+
+	var entry *Entry
+	err := common.RetryDigest(ctx, common.DIGEST_RETRIES, func() error {
+		payload, err := res.Source.OpenPayload(ctx, res)
+		if err != nil {
+			return err
+		}
+		defer payload.Close()
+
+		entry, err = s.Put(res, payload)
+		return err
+	})
+	return entry, err
+}
+
+// Put ... Saves payload of CDX record. Payload SHA-1 is verified against record digest.
+func (s *Store) Put(res *common.CdxResponse, payload *common.Payload) (*Entry, error) {
+	tmp, err := os.CreateTemp(filepath.Join(s.dir, BLOBS_DIR), "*.part")
+	if err != nil {
+		return nil, fmt.Errorf("[Put] Cannot create blob: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha1.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), payload)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if errors.Is(err, common.ErrDigestMismatch) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("[Put] Cannot save blob of %v: %v", res.Original, err)
+	}
+
+	digest := base32.StdEncoding.EncodeToString(hash.Sum(nil))
+	if want := common.NormalizeDigest(res.Digest); want != "" && want != digest {
+		return nil, common.DigestError(res, "Put", digest)
+	}
+
+	path := s.BlobPath(digest)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("[Put] Cannot create blob dir: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, fmt.Errorf("[Put] Cannot save blob: %v", err)
+	}
+
+	entry := Entry{
+		URL:       res.Original,
+		Timestamp: res.Timestamp,
+		Source:    res.Source.Name(),
+		Digest:    digest,
+		MimeType:  res.MimeType,
+		Encoding:  payload.Encoding,
+		Size:      size,
+		Path:      s.relPath(digest),
+	}
+	return &entry, s.addEntry(entry)
+}
+
+// Close ... Closes manifest file
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.manifest.Close()
+}
+
+func (s *Store) hasCapture(res *common.CdxResponse) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.captures[captureKey(res.Original, res.Timestamp, res.Source.Name())]
+}
+
+// Entry of saved blob, from manifest or file if manifest was lost
+func (s *Store) blobEntry(digest string) Entry {
+	s.mu.Lock()
+	entry, ok := s.blobs[digest]
+	s.mu.Unlock()
+	if ok {
+		return entry
+	}
+
+	entry = Entry{Digest: digest, Path: s.relPath(digest)}
+	if info, err := os.Stat(s.BlobPath(digest)); err == nil {
+		entry.Size = info.Size()
+	}
+	return entry
+}
+
+func (s *Store) addEntry(entry Entry) error {
+	line, err := jsoniter.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("[Save] Cannot encode manifest entry: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.manifest.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("[Save] Cannot write manifest: %v", err)
+	}
+	s.captures[captureKey(entry.URL, entry.Timestamp, entry.Source)] = true
+	if _, ok := s.blobs[entry.Digest]; !ok {
+		s.blobs[entry.Digest] = entry
+	}
+	return nil
+}
+
+func captureKey(url, timestamp, source string) string {
+	return source + " " + timestamp + " " + url
+}
@@ -0,0 +1,111 @@
+package blobstore
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+	common "github.com/karust/gogetcrawl/common"
+	"github.com/karust/gogetcrawl/testutil"
+	"github.com/karust/gogetcrawl/wayback"
+)
+
+func readManifest(t *testing.T, dir string) []Entry {
+	file, err := os.Open(filepath.Join(dir, MANIFEST_FILE))
+	if err != nil {
+		t.Fatalf("Cannot open manifest: %v", err)
+	}
+	defer file.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry Entry
+		if err := jsoniter.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("Cannot parse manifest line: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestSave(t *testing.T) {
+	server := testutil.NewCDXServer()
+	defer server.Close()
+
+	body := []byte("<html>unchanged</html>")
+	first := server.AddCapture(testutil.Capture{URL: "http://kamaloff.ru/", Timestamp: "20130522121421", Body: body})
+	second := server.AddCapture(testutil.Capture{URL: "http://kamaloff.ru/", Timestamp: "20140522121421", Body: body})
+	other := server.AddCapture(testutil.HTMLCapture("http://kamaloff.ru/about", "20140522121421", 3000))
+
+	wb, _ := wayback.New(15, 2, wayback.WithIndexServer(server.WaybackIndexURL()), wayback.WithCrawlStorage(server.WaybackStorageURL()))
+	first.Source, second.Source, other.Source = wb, wb, wb
+
+	dir := t.TempDir()
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Cannot open store: %v", err)
+	}
+
+	for _, res := range []*common.CdxResponse{&first, &second, &other} {
+		if _, err := store.Save(context.Background(), res); err != nil {
+			t.Fatalf("Cannot save %v: %v", res.Original, err)
+		}
+	}
+	requests := server.Requests()
+
+	// Same capture is not saved twice after reopening
+	store.Close()
+	store, _ = Open(dir)
+	if entry, err := store.Save(context.Background(), &first); err != nil || entry != nil {
+		t.Fatalf("Saved capture is saved again: %v, %v", entry, err)
+	}
+	store.Close()
+
+	if server.Requests() != requests {
+		t.Fatalf("Saved capture is downloaded again")
+	}
+
+	entries := readManifest(t, dir)
+	if len(entries) != 3 {
+		t.Fatalf("Incorrect number of manifest entries: %v, want=3", len(entries))
+	}
+	if entries[0].Path != entries[1].Path || entries[0].Path == entries[2].Path {
+		t.Fatalf("Identical payloads are not deduplicated: %v, %v, %v", entries[0].Path, entries[1].Path, entries[2].Path)
+	}
+
+	blobs, _ := filepath.Glob(filepath.Join(dir, BLOBS_DIR, "*", "*"))
+	if len(blobs) != 2 {
+		t.Fatalf("Incorrect number of blobs: %v, want=2", len(blobs))
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, entries[2].Path))
+	if err != nil || testutil.Digest(data) != other.Digest {
+		t.Fatalf("Incorrect blob content: %v", err)
+	}
+}
+
+func TestDigestMismatch(t *testing.T) {
+	server := testutil.NewCDXServer()
+	defer server.Close()
+
+	res := server.AddCapture(testutil.HTMLCapture("http://kamaloff.ru/", "20130522121421", 2000))
+	res.Digest = "FXOQP7LM7FWUC7S5MTDHZS2WMKNLCW2E"
+	res.Source, _ = wayback.New(15, 2, wayback.WithIndexServer(server.WaybackIndexURL()), wayback.WithCrawlStorage(server.WaybackStorageURL()))
+
+	dir := t.TempDir()
+	store, _ := Open(dir)
+	defer store.Close()
+
+	if _, err := store.Save(context.Background(), &res); err == nil {
+		t.Fatalf("Digest mismatch is not detected")
+	}
+
+	blobs, _ := filepath.Glob(filepath.Join(dir, BLOBS_DIR, "*"))
+	if len(blobs) != 0 {
+		t.Fatalf("Blob with wrong digest is kept: %v", blobs)
+	}
+}
@@ -0,0 +1,498 @@
+// Package cdx implements common.Source for any web archive with pywb, OutbackCDX or Wayback compatible CDX API,
+// like Arquivo.pt, UK Web Archive or a local pywb instance. Server is described by Config.
+package cdx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+	common "github.com/karust/gogetcrawl/common"
+)
+
+type CDX struct {
+	MaxTimeout   int            // Request timeout
+	MaxRetries   int            // Max number of request retries if timeouted
+	client       *common.Client // HTTP client, common.DefaultClient if nil
+	config       Config         // Server URLs, format and name
+	verifyDigest bool           // Check downloads against CDX digests
+}
+
+// Option ... Configures CDX source in New
+type Option func(*CDX)
+
+// WithClient ... Sets HTTP client, can be shared with other sources
+func WithClient(client *common.Client) Option {
+	return func(c *CDX) {
+		c.client = client
+	}
+}
+
+// WithVerifyDigest ... Sets check of downloaded payloads against CDX digests, enabled by default. Mismatching downloads
+// are repeated up to common.DIGEST_RETRIES times and fail with common.ErrDigestMismatch. Revisits and captures replayed
+// instead of the requested one are not checked, see common.IsReplayOf.
+func WithVerifyDigest(verify bool) Option {
+	return func(c *CDX) {
+		c.verifyDigest = verify
+	}
+}
+
+// New ... Creates source of CDX server described by config
+func New(config Config, timeout, retries int, opts ...Option) (*CDX, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("[New] %v", err)
+	}
+	config.IndexServer = strings.TrimRight(config.IndexServer, "/")
+
+	source := &CDX{
+		MaxTimeout:   timeout,
+		MaxRetries:   retries,
+		config:       config,
+		verifyDigest: true,
+	}
+	for _, opt := range opts {
+		opt(source)
+	}
+	return source, nil
+}
+
+func (c *CDX) Name() string {
+	return c.config.Name
+}
+
+// Config ... Returns config of the source
+func (c *CDX) Config() Config {
+	return c.config
+}
+
+// GetNumPages ... Returns number of pages for url, always 1 if server has no pagination
+func (c *CDX) GetNumPages(url string) (int, error) {
+	return c.GetNumPagesContext(context.Background(), url)
+}
+
+// GetNumPagesContext ... Same as GetNumPages, but request is aborted when ctx is done
+func (c *CDX) GetNumPagesContext(ctx context.Context, url string) (int, error) {
+	if !c.config.Pages {
+		return 1, nil
+	}
+
+	requestURI := fmt.Sprintf("%v?url=%v&showNumPages=true", c.config.IndexServer, url)
+	response, err := c.client.Get(ctx, requestURI, c.MaxTimeout, c.MaxRetries)
+	if err != nil {
+		return 0, common.WrapError(err, "GetNumPages", c.Name(), requestURI, -1)
+	}
+
+	// pywb responds with JSON object, Wayback with a number
+	response = bytes.TrimSpace(response)
+	var pages int
+	if bytes.HasPrefix(response, []byte("{")) {
+		var numPages struct {
+			Pages int `json:"pages"`
+		}
+		err = jsoniter.Unmarshal(response, &numPages)
+		pages = numPages.Pages
+	} else {
+		pages, err = strconv.Atoi(string(response))
+	}
+	if err != nil {
+		return 0, &common.Error{
+			Kind:   common.KindParse,
+			Op:     "GetNumPages",
+			Source: c.Name(),
+			URL:    requestURI,
+			Page:   -1,
+			Err:    fmt.Errorf("Cannot convert response value: %q", response),
+		}
+	}
+	return pages, nil
+}
+
+// ParseResponse ... Parses CDX server response in configured format
+func (c *CDX) ParseResponse(resp []byte) ([]*common.CdxResponse, error) {
+	resp = bytes.TrimSpace(resp)
+	if len(resp) == 0 {
+		return []*common.CdxResponse{}, nil
+	}
+
+	format := c.config.Format
+	if format == FormatAuto {
+		switch resp[0] {
+		case '[':
+			format = FormatJSON
+		case '{':
+			format = FormatNDJSON
+		default:
+			format = FormatCDX
+		}
+	}
+
+	var results []*common.CdxResponse
+	var err error
+	switch format {
+	case FormatJSON:
+		results, err = c.parseJSON(resp)
+	case FormatNDJSON:
+		results, err = c.parseNDJSON(resp)
+	default:
+		results, err = c.parseCDX(resp)
+	}
+	if err != nil {
+		return nil, common.NewError(common.KindParse, "ParseResponse", "", err)
+	}
+
+	for _, res := range results {
+		res.Source = c
+	}
+	return results, nil
+}
+
+// JSON array of rows, the first one is a header. With Fields configured columns are taken from them,
+// header row is skipped if server sends it.
+func (c *CDX) parseJSON(resp []byte) ([]*common.CdxResponse, error) {
+	var rows [][]string
+	if err := jsoniter.Unmarshal(resp, &rows); err != nil {
+		return nil, fmt.Errorf("Cannot decode JSON rows: %v", err)
+	}
+
+	fields := c.config.Fields
+	if len(rows) > 0 && (len(fields) == 0 || isHeader(fields, rows[0])) {
+		if len(fields) == 0 {
+			fields = rows[0]
+		}
+		rows = rows[1:]
+	}
+
+	results := []*common.CdxResponse{}
+	for _, row := range rows {
+		// Wayback separates resume key with an empty row
+		if len(row) == 0 {
+			break
+		}
+		res, err := newRecord(fields, row)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// Checks if row of values is a header of fields, i.e. values are the field names or their aliases
+func isHeader(fields, row []string) bool {
+	if len(row) != len(fields) {
+		return false
+	}
+	for i, name := range fields {
+		if column(row[i]) != column(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// Keeps numbers like offsets as they are, instead of float64
+var numberJSON = jsoniter.Config{UseNumber: true}.Froze()
+
+// JSON object per line
+func (c *CDX) parseNDJSON(resp []byte) ([]*common.CdxResponse, error) {
+	return parseLines(resp, nil)
+}
+
+// Space separated fields per line, columns are Fields or detected by their number
+func (c *CDX) parseCDX(resp []byte) ([]*common.CdxResponse, error) {
+	return parseLines(resp, c.config.Fields)
+}
+
+func parseLines(resp []byte, fields []string) ([]*common.CdxResponse, error) {
+	results := []*common.CdxResponse{}
+	for _, line := range bytes.Split(resp, []byte{'\n'}) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		res, err := ParseLine(line, fields)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// ParseLine ... Parses a line of CDX server output or index file: JSON object, CDXJ "urlkey timestamp {json}"
+// or space separated values of fields. Columns are detected by their number if fields are empty, see CDX11_FIELDS.
+func ParseLine(line []byte, fields []string) (*common.CdxResponse, error) {
+	line = bytes.TrimSpace(line)
+	if len(line) > 0 && line[0] == '{' {
+		return parseJSONLine(line)
+	}
+
+	if parts := bytes.SplitN(line, []byte{' '}, 3); len(parts) == 3 && bytes.HasPrefix(parts[2], []byte{'{'}) {
+		res, err := parseJSONLine(parts[2])
+		if err != nil {
+			return nil, err
+		}
+		res.Urlkey, res.Timestamp = string(parts[0]), string(parts[1])
+		return res, nil
+	}
+
+	values := strings.Fields(string(line))
+	if len(fields) == 0 {
+		switch len(values) {
+		case len(WAYBACK_FIELDS):
+			fields = WAYBACK_FIELDS
+		case len(CDX11_FIELDS):
+			fields = CDX11_FIELDS
+		default:
+			return nil, fmt.Errorf("Unknown columns of %v fields, set them in config: %q", len(values), line)
+		}
+	}
+	return newRecord(fields, values)
+}
+
+func parseJSONLine(line []byte) (*common.CdxResponse, error) {
+	var object map[string]interface{}
+	if err := numberJSON.Unmarshal(line, &object); err != nil {
+		return nil, fmt.Errorf("Cannot decode JSON line: %v. Response: %v", err, string(line))
+	}
+
+	res := &common.CdxResponse{}
+	for name, value := range object {
+		setField(res, name, fmt.Sprint(value))
+	}
+	return res, nil
+}
+
+func newRecord(fields, values []string) (*common.CdxResponse, error) {
+	if len(values) != len(fields) {
+		return nil, fmt.Errorf("Unexpected number of columns, want %v: %v", len(fields), values)
+	}
+
+	res := &common.CdxResponse{}
+	for i, name := range fields {
+		setField(res, name, values[i])
+	}
+	return res, nil
+}
+
+// Sets record field by column name of any CDX server, unknown columns are skipped
+func setField(res *common.CdxResponse, name, value string) {
+	switch column(name) {
+	case "urlkey":
+		res.Urlkey = value
+	case "timestamp":
+		res.Timestamp = value
+	case "original":
+		res.Original = value
+	case "mimetype":
+		res.MimeType = value
+	case "mimedetected":
+		res.MimeDetected = value
+	case "statuscode":
+		res.StatusCode = value
+	case "digest":
+		res.Digest = value
+	case "length":
+		res.Length = value
+	case "offset":
+		res.Offset = value
+	case "filename":
+		res.Filename = value
+	case "charset":
+		res.Charset = value
+	case "languages":
+		res.Languages = value
+	}
+}
+
+// Returns column name used by setField for name of any CDX server
+func column(name string) string {
+	switch name = strings.ToLower(name); name {
+	case "url":
+		return "original"
+	case "mime":
+		return "mimetype"
+	case "mime-detected":
+		return "mimedetected"
+	case "status":
+		return "statuscode"
+	}
+	return name
+}
+
+// fetchPage ... Makes request to CDX server to get a single page of results
+func (c *CDX) fetchPage(ctx context.Context, config common.RequestConfig, page int) ([]*common.CdxResponse, error) {
+	reqURL := config.GetUrl(c.config.IndexServer, page)
+	if c.config.Format == FormatCDX {
+		// Space separated output is the default one
+		reqURL = strings.Replace(reqURL, "&output=json", "", 1)
+	}
+
+	response, err := c.client.Get(ctx, reqURL, c.MaxTimeout, c.MaxRetries)
+	// pywb responds with 404 if there are no captures
+	if errors.Is(err, common.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, common.WrapError(err, "FetchPage", c.Name(), reqURL, page)
+	}
+
+	parsedResponse, err := c.ParseResponse(response)
+	if err != nil {
+		return nil, common.WrapError(err, "FetchPage", c.Name(), reqURL, page)
+	}
+	return parsedResponse, nil
+}
+
+func (c *CDX) pager(config common.RequestConfig) common.PageFunc {
+	if !c.config.Pages {
+		config.SinglePage = true
+	}
+	return common.NewPager(config,
+		func(ctx context.Context) (int, error) {
+			return c.GetNumPagesContext(ctx, config.URL)
+		},
+		func(ctx context.Context, page int) ([]*common.CdxResponse, error) {
+			return c.fetchPage(ctx, config, page)
+		},
+	)
+}
+
+// Iterate ... Returns iterator over all url observations in CDX server.
+// Pages are requested lazily while records are consumed.
+func (c *CDX) Iterate(ctx context.Context, config common.RequestConfig) *common.Iterator {
+	return common.NewIterator(ctx, c.pager(config))
+}
+
+// GetPages ... Makes request to CDX server to gather all url observations
+func (c *CDX) GetPages(config common.RequestConfig) ([]*common.CdxResponse, error) {
+	return c.GetPagesContext(context.Background(), config)
+}
+
+// GetPagesContext ... Same as GetPages, but stops fetching pages when ctx is done
+func (c *CDX) GetPagesContext(ctx context.Context, config common.RequestConfig) ([]*common.CdxResponse, error) {
+	return common.Collect(c.Iterate(ctx, config))
+}
+
+// FetchPages ... Concurrent way to GetPages.
+//
+// Deprecated: use Iterate, channels are never closed and completion is not signaled.
+func (c *CDX) FetchPages(config common.RequestConfig, results chan []*common.CdxResponse, errors chan error) {
+	c.FetchPagesContext(context.Background(), config, results, errors)
+}
+
+// FetchPagesContext ... Same as FetchPages, but returns as soon as ctx is done.
+//
+// Deprecated: use Iterate.
+func (c *CDX) FetchPagesContext(ctx context.Context, config common.RequestConfig, results chan []*common.CdxResponse, errors chan error) {
+	common.FetchPages(ctx, c.pager(config), results, errors)
+}
+
+// replayURL ... Raw capture URL from the replay template
+func (c *CDX) replayURL(page *common.CdxResponse) (string, error) {
+	if c.config.ReplayURL == "" {
+		return "", fmt.Errorf("Replay URL of '%v' is not set, captures cannot be downloaded", c.Name())
+	}
+	return strings.NewReplacer("{timestamp}", page.Timestamp, "{url}", page.Original).Replace(c.config.ReplayURL), nil
+}
+
+// GetFile ... Downloads capture from replay URL
+func (c *CDX) GetFile(page *common.CdxResponse) ([]byte, error) {
+	return c.GetFileContext(context.Background(), page)
+}
+
+// GetFileContext ... Same as GetFile, but download is aborted when ctx is done
+func (c *CDX) GetFileContext(ctx context.Context, page *common.CdxResponse) ([]byte, error) {
+	requestURI, err := c.replayURL(page)
+	if err != nil {
+		return nil, common.WrapError(err, "GetFile", c.Name(), "", -1)
+	}
+
+	var resp *common.Response
+	err = common.RetryDigest(ctx, common.DIGEST_RETRIES, func() (err error) {
+		if resp, err = c.client.GetResponse(ctx, requestURI, c.MaxTimeout, c.MaxRetries); err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return common.StatusError(resp.StatusCode, requestURI)
+		}
+		if !c.verifyDigest {
+			return nil
+		}
+		return common.VerifyReplayDigest(page, resp)
+	})
+	if err != nil {
+		return nil, common.WrapError(err, "GetFile", c.Name(), requestURI, -1)
+	}
+	return resp.Body, nil
+}
+
+// GetCapture ... Downloads capture from replay URL with status code and headers.
+// Headers prefixed with X-Archive-Orig- by Wayback compatible servers are returned without prefix.
+func (c *CDX) GetCapture(page *common.CdxResponse) (*common.Capture, error) {
+	return c.GetCaptureContext(context.Background(), page)
+}
+
+// GetCaptureContext ... Same as GetCapture, but download is aborted when ctx is done
+func (c *CDX) GetCaptureContext(ctx context.Context, page *common.CdxResponse) (*common.Capture, error) {
+	requestURI, err := c.replayURL(page)
+	if err != nil {
+		return nil, common.WrapError(err, "GetCapture", c.Name(), "", -1)
+	}
+
+	var resp *common.Response
+	err = common.RetryDigest(ctx, common.DIGEST_RETRIES, func() (err error) {
+		if resp, err = c.client.GetResponse(ctx, requestURI, c.MaxTimeout, c.MaxRetries); err != nil || !c.verifyDigest {
+			return err
+		}
+		return common.VerifyReplayDigest(page, resp)
+	})
+	if err != nil {
+		return nil, common.WrapError(err, "GetCapture", c.Name(), requestURI, -1)
+	}
+
+	capture, err := common.NewReplayCapture(page, resp, requestURI)
+	if err != nil {
+		return nil, common.WrapError(err, "GetCapture", c.Name(), requestURI, -1)
+	}
+	return capture, nil
+}
+
+// OpenFile ... Opens capture stream, the file is not buffered in memory. Stream must be closed.
+func (c *CDX) OpenFile(ctx context.Context, page *common.CdxResponse) (io.ReadCloser, error) {
+	payload, err := c.OpenPayload(ctx, page)
+	if err != nil {
+		return nil, common.WrapError(err, "OpenFile", c.Name(), "", -1)
+	}
+
+	body, err := payload.Decode()
+	if err != nil {
+		return nil, common.WrapError(err, "OpenFile", c.Name(), "", -1)
+	}
+	return body, nil
+}
+
+// OpenPayload ... Opens stream of capture payload without decoding it.
+// Reading fails with common.ErrDigestMismatch at the end if payload doesn't match the record digest.
+func (c *CDX) OpenPayload(ctx context.Context, page *common.CdxResponse) (*common.Payload, error) {
+	requestURI, err := c.replayURL(page)
+	if err != nil {
+		return nil, common.WrapError(err, "OpenPayload", c.Name(), "", -1)
+	}
+
+	resp, err := c.client.OpenStream(ctx, requestURI, c.MaxTimeout, c.MaxRetries, nil)
+	if err != nil {
+		return nil, common.WrapError(err, "OpenPayload", c.Name(), requestURI, -1)
+	}
+	stream := resp.Stream
+	if c.verifyDigest && common.IsReplayOf(page, resp.Header) {
+		stream = common.NewDigestReader(page, stream)
+	}
+	return &common.Payload{ReadCloser: stream, Encoding: resp.Header.Get("Content-Encoding")}, nil
+}
@@ -0,0 +1,170 @@
+package cdx
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	common "github.com/karust/gogetcrawl/common"
+	"github.com/karust/gogetcrawl/testutil"
+)
+
+// Test interface
+var cdxtest common.Source = &CDX{}
+
+var server *testutil.CDXServer
+
+func TestMain(m *testing.M) {
+	server = testutil.NewCDXServer()
+	server.PageSize = 4
+	for i := 0; i < 10; i++ {
+		server.AddCapture(testutil.HTMLCapture(fmt.Sprintf("https://archive.example.pt/page%v", i), "20200101000000", 400))
+	}
+
+	code := m.Run()
+	server.Close()
+	os.Exit(code)
+}
+
+func TestParseResponse(t *testing.T) {
+	source, _ := New(Config{Name: "test", IndexServer: "http://localhost/cdx"}, 15, 2)
+
+	responses := map[string]string{
+		"json":   `[["urlkey","timestamp","original","mimetype","statuscode","digest","length"],["pt,arquivo)/","20200101000000","https://arquivo.pt/","text/html","200","AAAA","1200"]]`,
+		"ndjson": `{"urlkey": "pt,arquivo)/", "timestamp": "20200101000000", "url": "https://arquivo.pt/", "mime": "text/html", "status": "200", "digest": "AAAA", "length": 1200, "offset": 102849414}`,
+		"cdx":    `pt,arquivo)/ 20200101000000 https://arquivo.pt/ text/html 200 AAAA - - 1200 102849414 arquivo.warc.gz`,
+	}
+	for format, resp := range responses {
+		results, err := source.ParseResponse([]byte(resp))
+		if err != nil {
+			t.Fatalf("Cannot parse %v response: %v", format, err)
+		}
+		if len(results) != 1 {
+			t.Fatalf("Incorrect number of %v results: %v, want=1", format, len(results))
+		}
+
+		res := results[0]
+		if res.Original != "https://arquivo.pt/" || res.StatusCode != "200" || res.Length != "1200" || res.Source.Name() != "test" {
+			t.Fatalf("Incorrect %v record: %+v", format, res)
+		}
+		if format != "json" && res.Offset != "102849414" {
+			t.Fatalf("Incorrect %v offset: %v", format, res.Offset)
+		}
+	}
+
+	if _, err := source.ParseResponse([]byte("pt,arquivo)/ 20200101000000 https://arquivo.pt/")); err == nil {
+		t.Fatalf("Unknown columns are accepted")
+	}
+
+	// Header row is skipped with configured fields, with or without it
+	fielded, _ := New(Config{Name: "test", IndexServer: "http://localhost/cdx", Fields: []string{"urlkey", "timestamp", "url"}}, 15, 2)
+	for _, resp := range []string{
+		`[["urlkey","timestamp","original"],["pt,arquivo)/","20200101000000","https://arquivo.pt/"]]`,
+		`[["pt,arquivo)/","20200101000000","https://arquivo.pt/"]]`,
+	} {
+		results, err := fielded.ParseResponse([]byte(resp))
+		if err != nil {
+			t.Fatalf("Cannot parse response with fields: %v", err)
+		}
+		if len(results) != 1 || results[0].Original != "https://arquivo.pt/" {
+			t.Fatalf("Incorrect results with fields: %+v", results)
+		}
+	}
+}
+
+func TestGetPages(t *testing.T) {
+	configs := []Config{
+		{Name: "json", IndexServer: server.WaybackIndexURL()},
+		{Name: "cdx", IndexServer: server.WaybackIndexURL(), Format: FormatCDX},
+		{Name: "ndjson", IndexServer: server.URL + "/CC-MAIN-2023-14-index", Format: FormatNDJSON, Pages: true},
+	}
+
+	for _, config := range configs {
+		source, err := New(config, 15, 2)
+		if err != nil {
+			t.Fatalf("Cannot create %v source: %v", config.Name, err)
+		}
+
+		results, err := source.GetPages(common.RequestConfig{URL: "archive.example.pt/*"})
+		if err != nil {
+			t.Fatalf("Cannot get %v pages: %v", config.Name, err)
+		}
+		if len(results) != 10 {
+			t.Fatalf("Incorrect number of %v results: %v, want=10", config.Name, len(results))
+		}
+
+		// Server responds with 404 for NDJSON without captures
+		if results, err = source.GetPages(common.RequestConfig{URL: "missing.example.pt/*"}); err != nil || len(results) != 0 {
+			t.Fatalf("Incorrect %v results without captures: %v, %v", config.Name, len(results), err)
+		}
+	}
+}
+
+func TestGetFile(t *testing.T) {
+	source, _ := New(Config{Name: "test", IndexServer: server.WaybackIndexURL(), ReplayURL: server.WaybackStorageURL() + "/{timestamp}id_/{url}"}, 15, 2)
+
+	results, err := source.GetPages(common.RequestConfig{URL: "archive.example.pt/page3"})
+	if err != nil || len(results) != 1 {
+		t.Fatalf("Cannot get pages: %v, %v", len(results), err)
+	}
+
+	file, err := source.GetFile(results[0])
+	if err != nil {
+		t.Fatalf("Cannot get file: %v", err)
+	}
+	if want := testutil.HTMLCapture(results[0].Original, results[0].Timestamp, 400).Body; !bytes.Equal(file, want) {
+		t.Fatalf("Incorrect file: %q", file)
+	}
+
+	capture, err := source.GetCapture(results[0])
+	if err != nil {
+		t.Fatalf("Cannot get capture: %v", err)
+	}
+	if capture.StatusCode != 200 || capture.Header.Get("Content-Type") == "" {
+		t.Fatalf("Incorrect capture: %v %v", capture.StatusCode, capture.Header)
+	}
+
+	source, _ = New(Config{Name: "test", IndexServer: server.WaybackIndexURL()}, 15, 2)
+	if _, err := source.GetFile(results[0]); err == nil {
+		t.Fatalf("File is downloaded without replay URL")
+	}
+}
+
+func TestLoadConfigs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sources.json")
+	os.WriteFile(path, []byte(`[
+		{"name": "arquivo", "index_server": "https://arquivo.pt/wayback/cdx", "format": "ndjson", "replay_url": "https://arquivo.pt/wayback/{timestamp}id_/{url}"},
+		{"name": "local", "index_server": "http://localhost:8080/cdx", "format": "cdx", "fields": ["urlkey", "timestamp", "original"], "pages": true}
+	]`), 0644)
+
+	configs, err := LoadConfigs(path)
+	if err != nil {
+		t.Fatalf("Cannot load configs: %v", err)
+	}
+	if len(configs) != 2 || configs[0].Format != FormatNDJSON || len(configs[1].Fields) != 3 || !configs[1].Pages {
+		t.Fatalf("Incorrect configs: %+v", configs)
+	}
+
+	os.WriteFile(path, []byte(`[{"name": "a", "index_server": "http://a/cdx"}, {"name": "a", "index_server": "http://b/cdx"}]`), 0644)
+	if _, err := LoadConfigs(path); err == nil {
+		t.Fatalf("Duplicate source names are accepted")
+	}
+
+	config, err := ParseConfig("local=http://localhost:8080/cdx,http://localhost:8080/{timestamp}id_/{url}")
+	if err != nil || config.Name != "local" || config.ReplayURL != "http://localhost:8080/{timestamp}id_/{url}" {
+		t.Fatalf("Incorrect config: %+v, %v", config, err)
+	}
+	if _, err := ParseConfig("local=http://localhost:8080/cdx,http://localhost:8080/replay"); err == nil {
+		t.Fatalf("Replay URL without placeholders is accepted")
+	}
+
+	config, err = ParseConfig("local=http://localhost:8080/cdx,rps=0.5")
+	if err != nil || config.RPS != 0.5 || config.ReplayURL != "" {
+		t.Fatalf("Incorrect config with rps: %+v, %v", config, err)
+	}
+	if _, err := ParseConfig("local=http://localhost:8080/cdx,rps=-1"); err == nil {
+		t.Fatalf("Negative rps is accepted")
+	}
+}
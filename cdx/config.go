@@ -0,0 +1,116 @@
+package cdx
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Format ... Output format of CDX server
+type Format string
+
+const (
+	FormatAuto   Format = ""       // Detected from response
+	FormatJSON   Format = "json"   // JSON array of rows, the first row is a header, like Wayback
+	FormatNDJSON Format = "ndjson" // JSON object per line, like pywb and Common Crawl
+	FormatCDX    Format = "cdx"    // Space separated fields per line, like OutbackCDX
+)
+
+// Columns of space separated output when Config.Fields is not set, selected by number of columns
+var (
+	WAYBACK_FIELDS = []string{"urlkey", "timestamp", "original", "mimetype", "statuscode", "digest", "length"}
+	CDX11_FIELDS   = []string{"urlkey", "timestamp", "original", "mimetype", "statuscode", "digest", "redirect", "robotflags", "length", "offset", "filename"}
+)
+
+// Config ... Describes CDX server of a web archive
+type Config struct {
+	Name        string   `json:"name"`         // Source name, used in --sources and output
+	IndexServer string   `json:"index_server"` // CDX API URL, like "https://arquivo.pt/wayback/cdx"
+	Format      Format   `json:"format"`       // Output format, detected from response if empty
+	Fields      []string `json:"fields"`       // Columns of space separated output or JSON output without header
+	ReplayURL   string   `json:"replay_url"`   // Template of raw capture URL with {timestamp} and {url}, like "https://arquivo.pt/wayback/{timestamp}id_/{url}"
+	Pages       bool     `json:"pages"`        // Server supports showNumPages and page parameters (pywb with ZipNum index)
+	RPS         float64  `json:"rps"`          // Max requests per second to index and replay servers, 0 means unlimited
+}
+
+// Validate ... Checks that config describes usable source
+func (c Config) Validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("Source name is not set")
+	}
+	if c.IndexServer == "" {
+		return fmt.Errorf("Index server of '%v' is not set", c.Name)
+	}
+
+	switch c.Format {
+	case FormatAuto, FormatJSON, FormatNDJSON, FormatCDX:
+	default:
+		return fmt.Errorf("Unknown format '%v' of '%v', use one of: json, ndjson, cdx", c.Format, c.Name)
+	}
+
+	if c.RPS < 0 {
+		return fmt.Errorf("Negative rps of '%v'", c.Name)
+	}
+
+	if c.ReplayURL != "" && (!strings.Contains(c.ReplayURL, "{timestamp}") || !strings.Contains(c.ReplayURL, "{url}")) {
+		return fmt.Errorf("Replay URL of '%v' must contain {timestamp} and {url}", c.Name)
+	}
+	return nil
+}
+
+// ParseConfig ... Parses short source definition "name=index_server[,replay_url][,rps=N]" used in command line
+func ParseConfig(spec string) (Config, error) {
+	name, rest, ok := strings.Cut(spec, "=")
+	if !ok {
+		return Config{}, fmt.Errorf("Invalid source '%v', use 'name=index_server[,replay_url][,rps=N]'", spec)
+	}
+
+	parts := strings.Split(rest, ",")
+	config := Config{Name: strings.TrimSpace(name), IndexServer: strings.TrimSpace(parts[0])}
+	for _, part := range parts[1:] {
+		part = strings.TrimSpace(part)
+		if value, ok := strings.CutPrefix(part, "rps="); ok {
+			rps, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return Config{}, fmt.Errorf("Invalid rps '%v' of '%v'", value, config.Name)
+			}
+			config.RPS = rps
+		} else if config.ReplayURL == "" {
+			config.ReplayURL = part
+		} else {
+			return Config{}, fmt.Errorf("Invalid source '%v', use 'name=index_server[,replay_url][,rps=N]'", spec)
+		}
+	}
+	return config, config.Validate()
+}
+
+// LoadConfigs ... Reads JSON file with array of source configs:
+//
+//	[{"name": "arquivo", "index_server": "https://arquivo.pt/wayback/cdx", "format": "ndjson",
+//	  "replay_url": "https://arquivo.pt/wayback/{timestamp}id_/{url}"}]
+func LoadConfigs(path string) ([]Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("[LoadConfigs] Cannot read file: %v", err)
+	}
+
+	var configs []Config
+	if err := jsoniter.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("[LoadConfigs] Cannot decode %v: %v", path, err)
+	}
+
+	names := map[string]bool{}
+	for _, config := range configs {
+		if err := config.Validate(); err != nil {
+			return nil, fmt.Errorf("[LoadConfigs] %v", err)
+		}
+		if names[config.Name] {
+			return nil, fmt.Errorf("[LoadConfigs] Source '%v' is defined twice", config.Name)
+		}
+		names[config.Name] = true
+	}
+	return configs, nil
+}
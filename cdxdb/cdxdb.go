@@ -0,0 +1,352 @@
+package cdxdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/glebarez/go-sqlite"
+	common "github.com/karust/gogetcrawl/common"
+)
+
+const COMMIT_SIZE = 500 // Number of records added in a single transaction
+
+const schema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id          INTEGER PRIMARY KEY,
+	query       TEXT NOT NULL,
+	sources     TEXT NOT NULL,
+	started_at  TEXT NOT NULL,
+	finished_at TEXT,
+	seen        INTEGER NOT NULL DEFAULT 0,
+	added       INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS captures (
+	id            INTEGER PRIMARY KEY,
+	urlkey        TEXT NOT NULL,
+	timestamp     TEXT NOT NULL,
+	source        TEXT NOT NULL,
+	url           TEXT NOT NULL,
+	mime          TEXT NOT NULL DEFAULT '',
+	mime_detected TEXT NOT NULL DEFAULT '',
+	status        TEXT NOT NULL DEFAULT '',
+	digest        TEXT NOT NULL DEFAULT '',
+	length        TEXT NOT NULL DEFAULT '',
+	offset        TEXT NOT NULL DEFAULT '',
+	filename      TEXT NOT NULL DEFAULT '',
+	charset       TEXT NOT NULL DEFAULT '',
+	languages     TEXT NOT NULL DEFAULT '',
+	crawl         TEXT NOT NULL DEFAULT '',
+	first_run     INTEGER NOT NULL REFERENCES runs(id),
+	last_run      INTEGER NOT NULL REFERENCES runs(id),
+	UNIQUE (urlkey, timestamp, source)
+);
+
+CREATE INDEX IF NOT EXISTS captures_url ON captures (url);
+CREATE INDEX IF NOT EXISTS captures_digest ON captures (digest);
+CREATE INDEX IF NOT EXISTS captures_first_run ON captures (first_run);
+`
+
+// Capture already stored keeps its first run, other columns are refreshed
+const upsert = `
+INSERT INTO captures (urlkey, timestamp, source, url, mime, mime_detected, status, digest, length, offset, filename, charset, languages, crawl, first_run, last_run)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (urlkey, timestamp, source) DO UPDATE SET
+	url = excluded.url, mime = excluded.mime, mime_detected = excluded.mime_detected, status = excluded.status,
+	digest = excluded.digest, length = excluded.length, offset = excluded.offset, filename = excluded.filename,
+	charset = excluded.charset, languages = excluded.languages, crawl = excluded.crawl, last_run = excluded.last_run`
+
+// Capture is stored by the same key as in captures, duplicates of several sources are merged by common.Merge
+const stored = `SELECT EXISTS (SELECT 1 FROM captures WHERE urlkey = ? AND timestamp = ? AND source = ?)`
+
+const captureColumns = `urlkey, timestamp, source, url, mime, mime_detected, status, digest, length, offset, filename, charset, languages, crawl, first_run, last_run`
+
+// DB ... SQLite store of CDX records collected by query runs.
+// Every capture is stored once by urlkey, timestamp and source, so re-runs only add new captures.
+type DB struct {
+	db *sql.DB
+}
+
+// Record ... Capture stored in DB
+type Record struct {
+	common.CdxResponse        // Source is not set, see SourceName
+	SourceName         string // Name of the source the capture was found in
+	FirstRun           int64  // ID of the run which added the capture
+	LastRun            int64  // ID of the last run which found the capture
+}
+
+// RunInfo ... Query run stored in DB
+type RunInfo struct {
+	ID         int64
+	Query      string
+	Sources    string
+	StartedAt  time.Time
+	FinishedAt time.Time // Zero if run was interrupted
+	Seen       int       // Number of records found by the run
+	Added      int       // Number of captures which were not stored before
+}
+
+// Open ... Opens database at path, creating it and its tables if needed
+func Open(path string) (*DB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("[Open] Cannot open database: %v", err)
+	}
+
+	// Single connection, SQLite allows only one writer anyway
+	db.SetMaxOpenConns(1)
+
+	for _, pragma := range []string{"PRAGMA journal_mode = WAL", "PRAGMA foreign_keys = ON", "PRAGMA busy_timeout = 5000"} {
+		if _, err := db.Exec(pragma); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("[Open] Cannot configure database: %v", err)
+		}
+	}
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("[Open] Cannot create tables: %v", err)
+	}
+	return &DB{db: db}, nil
+}
+
+// Close ... Closes database
+func (d *DB) Close() error {
+	return d.db.Close()
+}
+
+// SQL ... Returns underlying database for custom queries
+func (d *DB) SQL() *sql.DB {
+	return d.db
+}
+
+// Run ... Adds records found by a single query run. Safe to use from multiple workers, must be finished with Finish.
+type Run struct {
+	ID int64
+
+	db      *DB
+	mu      sync.Mutex
+	tx      *sql.Tx
+	stmt    *sql.Stmt // Upsert of records
+	exists  *sql.Stmt // Check if capture is stored
+	pending int
+	seen    int
+	added   int
+}
+
+// StartRun ... Records start of a query run
+//
+//	query: queried URLs or other description of the run
+//	sources: names of queried sources
+func (d *DB) StartRun(query string, sources []string) (*Run, error) {
+	res, err := d.db.Exec(`INSERT INTO runs (query, sources, started_at) VALUES (?, ?, ?)`,
+		query, strings.Join(sources, ","), time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, fmt.Errorf("[StartRun] Cannot save run: %v", err)
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("[StartRun] Cannot save run: %v", err)
+	}
+	return &Run{ID: id, db: d}, nil
+}
+
+// Add ... Upserts record, reports whether the capture of its source was not stored before, including earlier in the run,
+// so repeated records are new once. Records are committed in batches of COMMIT_SIZE and by Finish.
+func (r *Run) Add(res *common.CdxResponse) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.tx == nil {
+		tx, err := r.db.db.Begin()
+		if err != nil {
+			return false, fmt.Errorf("[Add] Cannot start transaction: %v", err)
+		}
+		stmt, err := tx.Prepare(upsert)
+		if err != nil {
+			tx.Rollback()
+			return false, fmt.Errorf("[Add] Cannot prepare statement: %v", err)
+		}
+		exists, err := tx.Prepare(stored)
+		if err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return false, fmt.Errorf("[Add] Cannot prepare statement: %v", err)
+		}
+		r.tx, r.stmt, r.exists = tx, stmt, exists
+	}
+
+	source := ""
+	if res.Source != nil {
+		source = res.Source.Name()
+	}
+
+	var known bool
+	if err := r.exists.QueryRow(res.Urlkey, res.Timestamp, source).Scan(&known); err != nil {
+		return false, fmt.Errorf("[Add] Cannot check record %v: %v", res.Original, err)
+	}
+
+	_, err := r.stmt.Exec(res.Urlkey, res.Timestamp, source, res.Original, res.MimeType, res.MimeDetected, res.StatusCode,
+		res.Digest, res.Length, res.Offset, res.Filename, res.Charset, res.Languages, res.Crawl, r.ID, r.ID)
+	if err != nil {
+		return false, fmt.Errorf("[Add] Cannot save record %v: %v", res.Original, err)
+	}
+
+	isNew := !known
+	r.seen++
+	if isNew {
+		r.added++
+	}
+
+	r.pending++
+	if r.pending >= COMMIT_SIZE {
+		return isNew, r.commit()
+	}
+	return isNew, nil
+}
+
+// Finish ... Commits added records and saves run statistics
+func (r *Run) Finish() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.commit(); err != nil {
+		return err
+	}
+
+	_, err := r.db.db.Exec(`UPDATE runs SET finished_at = ?, seen = ?, added = ? WHERE id = ?`,
+		time.Now().UTC().Format(time.RFC3339), r.seen, r.added, r.ID)
+	if err != nil {
+		return fmt.Errorf("[Finish] Cannot save run: %v", err)
+	}
+	return nil
+}
+
+// Added ... Returns number of captures which were not stored before the run
+func (r *Run) Added() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.added
+}
+
+func (r *Run) commit() error {
+	if r.tx == nil {
+		return nil
+	}
+
+	r.stmt.Close()
+	r.exists.Close()
+	err := r.tx.Commit()
+	r.tx, r.stmt, r.exists, r.pending = nil, nil, nil, 0
+	if err != nil {
+		return fmt.Errorf("[Add] Cannot commit records: %v", err)
+	}
+	return nil
+}
+
+// Filter ... Selects records in Records, empty fields match everything
+type Filter struct {
+	URLPrefix string // Original URL starts with it
+	Source    string // Source name
+	FromDate  string // Timestamp is not earlier, like "20200131"
+	ToDate    string // Timestamp is not later, like "20231231"
+	Digest    string
+	FirstRun  int64 // Captures added by the run
+	Limit     int
+}
+
+// Records ... Returns stored records matching filter, ordered by urlkey and timestamp
+func (d *DB) Records(ctx context.Context, filter Filter) ([]*Record, error) {
+	var where []string
+	var args []interface{}
+
+	if filter.URLPrefix != "" {
+		where = append(where, "substr(url, 1, ?) = ?")
+		args = append(args, len(filter.URLPrefix), filter.URLPrefix)
+	}
+	if filter.Source != "" {
+		where = append(where, "source = ?")
+		args = append(args, filter.Source)
+	}
+	if filter.FromDate != "" {
+		where = append(where, "timestamp >= ?")
+		args = append(args, filter.FromDate)
+	}
+	if filter.ToDate != "" {
+		// Every timestamp of the last day is included
+		toDate := filter.ToDate
+		if len(toDate) < 14 {
+			toDate += strings.Repeat("9", 14-len(toDate))
+		}
+		where = append(where, "timestamp <= ?")
+		args = append(args, toDate)
+	}
+	if filter.Digest != "" {
+		where = append(where, "digest = ?")
+		args = append(args, filter.Digest)
+	}
+	if filter.FirstRun != 0 {
+		where = append(where, "first_run = ?")
+		args = append(args, filter.FirstRun)
+	}
+
+	query := "SELECT " + captureColumns + " FROM captures"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY urlkey, timestamp, source"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("[Records] Cannot query records: %v", err)
+	}
+	defer rows.Close()
+
+	var records []*Record
+	for rows.Next() {
+		r := &Record{}
+		err := rows.Scan(&r.Urlkey, &r.Timestamp, &r.SourceName, &r.Original, &r.MimeType, &r.MimeDetected, &r.StatusCode,
+			&r.Digest, &r.Length, &r.Offset, &r.Filename, &r.Charset, &r.Languages, &r.Crawl, &r.FirstRun, &r.LastRun)
+		if err != nil {
+			return nil, fmt.Errorf("[Records] Cannot read record: %v", err)
+		}
+		records = append(records, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("[Records] Cannot read records: %v", err)
+	}
+	return records, nil
+}
+
+// Runs ... Returns stored query runs, the latest first
+func (d *DB) Runs(ctx context.Context) ([]*RunInfo, error) {
+	rows, err := d.db.QueryContext(ctx, `SELECT id, query, sources, started_at, COALESCE(finished_at, ''), seen, added FROM runs ORDER BY id DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("[Runs] Cannot query runs: %v", err)
+	}
+	defer rows.Close()
+
+	var runs []*RunInfo
+	for rows.Next() {
+		run := &RunInfo{}
+		var started, finished string
+		if err := rows.Scan(&run.ID, &run.Query, &run.Sources, &started, &finished, &run.Seen, &run.Added); err != nil {
+			return nil, fmt.Errorf("[Runs] Cannot read run: %v", err)
+		}
+		run.StartedAt, _ = time.Parse(time.RFC3339, started)
+		run.FinishedAt, _ = time.Parse(time.RFC3339, finished)
+		runs = append(runs, run)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("[Runs] Cannot read runs: %v", err)
+	}
+	return runs, nil
+}
@@ -0,0 +1,111 @@
+package cdxdb
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	common "github.com/karust/gogetcrawl/common"
+)
+
+// Source with a name only
+type namedSource struct {
+	common.Source
+	name string
+}
+
+func (s namedSource) Name() string { return s.name }
+
+func records(timestamps ...string) []*common.CdxResponse {
+	var res []*common.CdxResponse
+	for _, ts := range timestamps {
+		res = append(res, &common.CdxResponse{
+			Urlkey:    "ru,kamaloff)/",
+			Timestamp: ts,
+			Original:  "http://kamaloff.ru/",
+			MimeType:  "text/html",
+			Digest:    "FXOQP7LM7FWUC7S5MTDHZS2WMKNLCW2E",
+		})
+	}
+	return res
+}
+
+func addRun(t *testing.T, db *DB, res []*common.CdxResponse) *Run {
+	run, err := db.StartRun("kamaloff.ru/*", []string{"wb"})
+	if err != nil {
+		t.Fatalf("Cannot start run: %v", err)
+	}
+	for _, r := range res {
+		if _, err := run.Add(r); err != nil {
+			t.Fatalf("Cannot add record: %v", err)
+		}
+	}
+	if err := run.Finish(); err != nil {
+		t.Fatalf("Cannot finish run: %v", err)
+	}
+	return run
+}
+
+func TestIncrementalRuns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cdx.db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Cannot open database: %v", err)
+	}
+
+	first := addRun(t, db, records("20130522121421", "20180104074528"))
+	if first.Added() != 2 {
+		t.Fatalf("Incorrect number of added captures: %v, want=2", first.Added())
+	}
+	db.Close()
+
+	// Re-run after reopening adds only the new capture
+	db, _ = Open(path)
+	defer db.Close()
+
+	second := addRun(t, db, records("20130522121421", "20180104074528", "20200101000000"))
+	if second.Added() != 1 {
+		t.Fatalf("Incorrect number of added captures: %v, want=1", second.Added())
+	}
+
+	all, err := db.Records(context.Background(), Filter{URLPrefix: "http://kamaloff"})
+	if err != nil || len(all) != 3 {
+		t.Fatalf("Incorrect records: %v, %v", len(all), err)
+	}
+	if all[0].FirstRun != first.ID || all[0].LastRun != second.ID {
+		t.Fatalf("Incorrect runs of capture: first=%v, last=%v", all[0].FirstRun, all[0].LastRun)
+	}
+
+	added, _ := db.Records(context.Background(), Filter{FirstRun: second.ID})
+	if len(added) != 1 || added[0].Timestamp != "20200101000000" {
+		t.Fatalf("Incorrect captures added by the second run: %v", len(added))
+	}
+
+	dated, _ := db.Records(context.Background(), Filter{FromDate: "2014", ToDate: "20180104"})
+	if len(dated) != 1 || dated[0].Timestamp != "20180104074528" {
+		t.Fatalf("Incorrect captures in date range: %v", len(dated))
+	}
+
+	runs, err := db.Runs(context.Background())
+	if err != nil || len(runs) != 2 {
+		t.Fatalf("Incorrect runs: %v, %v", len(runs), err)
+	}
+	if runs[0].ID != second.ID || runs[0].Seen != 3 || runs[0].Added != 1 || runs[0].FinishedAt.IsZero() {
+		t.Fatalf("Incorrect run info: %+v", runs[0])
+	}
+
+	// Repeated capture is new once, the same capture found by another source for the first time is new too
+	third, _ := db.StartRun("kamaloff.ru/*", []string{"wb", "cc"})
+	repeated := records("20210101000000", "20210101000000", "20210101000000", "20200101000000")
+	repeated[2].Source = namedSource{name: "CommonCrawl"}
+	repeated[3].Source = namedSource{name: "CommonCrawl"}
+	for i, r := range repeated {
+		if isNew, err := third.Add(r); err != nil || isNew != (i != 1) {
+			t.Fatalf("Incorrect newness of record %v: %v, %v", i, isNew, err)
+		}
+	}
+	third.Finish()
+	if third.Added() != 3 {
+		t.Fatalf("Incorrect number of added captures: %v, want=3", third.Added())
+	}
+}
@@ -1,20 +1,29 @@
 package cmd
 
 import (
+	"context"
 	"log"
 	"os"
 	"path/filepath"
 	"sync"
 	"time"
 
+	"github.com/karust/gogetcrawl/blobstore"
 	"github.com/karust/gogetcrawl/common"
+	"github.com/karust/gogetcrawl/warcwriter"
 	"github.com/spf13/cobra"
 )
 
 type fileScenario struct {
-	finishedWorkers uint
-	outputDir       string
-	downloadRate    float32
+	outputDir    string
+	downloadRate float32
+	isWARC       bool
+	warcSize     int64
+	warcPrefix   string
+	warcDecoded  bool
+	warc         *warcwriter.Writer
+	isStore      bool
+	store        *blobstore.Store
 }
 
 var fileScn = fileScenario{}
@@ -23,39 +32,49 @@ var fileCMD = &cobra.Command{
 	Use:     "file",
 	Aliases: []string{"download"},
 	Short:   "Download files located in web arhives for desired domains",
-	Args:    cobra.MatchAll(cobra.MinimumNArgs(1), cobra.OnlyValidArgs),
+	Args:    cobra.MatchAll(cobra.MinimumNArgs(1), cobra.OnlyValidArgs, noResumeSort),
 	Run:     fileScn.spawnWorkers,
 }
 
-func (fs *fileScenario) worker(configs <-chan common.RequestConfig) {
-	for {
-		select {
-		case config, ok := <-configs:
-			if ok {
-				var wg sync.WaitGroup
-				for _, s := range sources {
-
-					wg.Add(1)
-					go func(s common.Source) {
-						defer wg.Done()
-						s.FetchPages(config, results, errors)
-					}(s)
-
-					//wg.Add(1)
-					go func() {
-						//defer wg.Done()
-						common.SaveFiles(results, fs.outputDir, errors, fs.downloadRate)
-					}()
-				}
-				wg.Wait()
-			} else {
-				fs.finishedWorkers += 1
+// Download files of received records until channel is closed
+func (fs *fileScenario) worker(ctx context.Context, records <-chan pageRecord) {
+	for record := range records {
+		err := fs.save(ctx, record.res)
+		if err != nil {
+			if ctx.Err() != nil {
 				return
 			}
+			log.Printf("ERROR: %v\n", err)
+		}
+		// Failed download is logged, resumed run doesn't repeat it
+		record.page.done(1)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(float64(fs.downloadRate) * float64(time.Second))):
 		}
 	}
 }
 
+// Save file of a record as a loose file, into content-addressed store or WARC
+func (fs *fileScenario) save(ctx context.Context, res *common.CdxResponse) error {
+	if fs.store != nil {
+		_, err := fs.store.Save(ctx, res)
+		return err
+	}
+	if fs.warc == nil {
+		return common.SaveResult(ctx, res, fs.outputDir)
+	}
+
+	// Capture has archived HTTP headers, unlike payload returned by some archives as file
+	capture, err := res.Source.GetCaptureContext(ctx, res)
+	if err != nil {
+		return err
+	}
+	return fs.warc.WriteCapture(capture)
+}
+
 func (fs *fileScenario) spawnWorkers(cmd *cobra.Command, args []string) {
 	fp, _ := filepath.Abs(fs.outputDir)
 	err := os.MkdirAll(fp, os.ModePerm)
@@ -65,45 +84,51 @@ func (fs *fileScenario) spawnWorkers(cmd *cobra.Command, args []string) {
 		log.Printf("Setting '%v' as output directorty", fp)
 	}
 
-	configs := getRequestConfigs(args)
-	initSources()
+	if fs.isWARC && fs.isStore {
+		log.Fatalf("Flags --warc and --store cannot be used together")
+	}
 
-	var wg sync.WaitGroup
+	if fs.isStore {
+		fs.store, err = blobstore.Open(fp)
+		if err != nil {
+			log.Fatalf("Cannot open file store: %v", err)
+		}
+		defer fs.store.Close()
+	}
 
-	// Spawn Workers
-	go func() {
-		for i := uint(0); i < maxWorkers; i++ {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				fs.worker(configs)
-			}()
+	if fs.isWARC {
+		fs.warc, err = warcwriter.NewWriter(fp, fs.warcPrefix, warcwriter.WithMaxSize(fs.warcSize<<20), warcwriter.WithSoftware("gogetcrawl/"+version), warcwriter.WithDecoded(fs.warcDecoded))
+		if err != nil {
+			log.Fatalf("Cannot create WARC writer: %v", err)
 		}
-	}()
+		defer fs.warc.Close()
+	}
 
+	configs := getRequestConfigs(args)
 	close(configs)
+	initSources()
 
-	// Read Results and errors
-	for fs.finishedWorkers != maxWorkers {
-		select {
-		case err, ok := <-errors:
-			if ok {
-				log.Printf("ERROR: %v\n", err)
-			}
-		// Unblock if no errors produced
-		case <-time.After(time.Second * 3):
-			continue
-		}
-	}
+	records := collectRecords(cmd.Context(), mergePages(cmd.Context(), collectPages(cmd.Context(), configs)))
 
+	var wg sync.WaitGroup
+	for i := uint(0); i < maxWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fs.worker(cmd.Context(), records)
+		}()
+	}
 	wg.Wait()
-	close(errors)
-	close(results)
 }
 
 func init() {
 	fileCMD.Flags().StringVarP(&fileScn.outputDir, "dir", "d", "", "Path to the output directory")
 	fileCMD.Flags().Float32VarP(&fileScn.downloadRate, "rate", "", 1.0, "Download rate in seconds for each worker (thread). Ex: 5, 1.5")
+	fileCMD.Flags().BoolVarP(&fileScn.isWARC, "warc", "", false, "Save captures as WARC/1.1 response records instead of loose files")
+	fileCMD.Flags().Int64VarP(&fileScn.warcSize, "warc-size", "", 1024, "Max size of a WARC file in MB, the next file is started after it")
+	fileCMD.Flags().StringVarP(&fileScn.warcPrefix, "warc-prefix", "", "gogetcrawl", "Prefix of WARC file names")
+	fileCMD.Flags().BoolVarP(&fileScn.warcDecoded, "warc-decoded", "", false, "Store decoded bodies in WARC records instead of archived payloads, their digests won't match CDX")
+	fileCMD.Flags().BoolVarP(&fileScn.isStore, "store", "", false, "Save each unique payload once under its digest, with manifest.jsonl mapping captures to blobs")
 	rootCmd.AddCommand(fileCMD)
 	fileCMD.MarkFlagRequired("dir")
 }
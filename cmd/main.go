@@ -1,16 +1,25 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"mime"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/karust/gogetcrawl/archivetoday"
+	"github.com/karust/gogetcrawl/cdx"
 	"github.com/karust/gogetcrawl/common"
 	"github.com/karust/gogetcrawl/commoncrawl"
+	"github.com/karust/gogetcrawl/localcdx"
+	"github.com/karust/gogetcrawl/localwarc"
+	"github.com/karust/gogetcrawl/memento"
 	"github.com/karust/gogetcrawl/wayback"
 	"github.com/spf13/cobra"
 )
@@ -22,6 +31,7 @@ var (
 	fromDateFilter string
 	toDateFilter   string
 	isCollapse     bool
+	collapseBy     []string
 	isSuccessful   bool
 	isLogging      bool
 	isVerbose      bool
@@ -31,6 +41,37 @@ var (
 	maxWorkers     uint
 	extensions     []string
 	sourceNames    []string
+	proxy          string
+	userAgent      string
+	maxConns       int
+	wbIndexServer  string
+	wbStorage      string
+	ccIndexServer  string
+	ccStorage      string
+	wbRate         float64
+	ccRate         float64
+	atRate         float64
+	mmRate         float64
+	mmTimeMap      string
+	mmTimeGate     string
+	lcIndexes      []string
+	lcWARCDir      string
+	lwDir          string
+	lwIndexDir     string
+	cdxSources     []string
+	cdxConfigPath  string
+	isResume       bool
+	noVerifyDigest bool
+	stateDir       string
+	pagination     string
+	ccCrawls       int
+	ccByDate       bool
+	isDedup        bool
+	isMerge        bool
+	mergeWindow    time.Duration
+	isSort         bool
+	closestDate    string
+	closestTime    time.Time // Parsed closestDate, zero to get all captures
 )
 
 var rootCmd = &cobra.Command{
@@ -38,19 +79,116 @@ var rootCmd = &cobra.Command{
 	Version: version,
 	Short:   "gogetcrawl - helps you to collect URLs and Files from web archives",
 	Long: `gogetcrawl is a tool that collects URLs or downloads files 
-from 2 different web archive sources - Wayback Mahine and Common Crawl.
+from web archive sources - Wayback Mahine, Common Crawl, archive.today and Memento archives.
 You can use different filters and arguments to solve your task more effectively.`,
 }
 
 var sources []common.Source
-var results = make(chan []*common.CdxResponse)
-var errors = make(chan error)
+
+// Saves pagination progress of every query to a source, so an interrupted run can be resumed
+var checkpoints *common.CheckpointStore
+
+// Create HTTP client shared by all sources
+func initClient(cdxConfigs map[string]cdx.Config) *common.Client {
+	// Limiter is shared by all workers, rates are set for hosts of each source
+	limiter := common.NewRateLimiter(0, 1)
+	if wbRate > 0 {
+		limiter.SetHostRate(wbIndexServer, wbRate)
+		limiter.SetHostRate(wbStorage, wbRate)
+	}
+	if ccRate > 0 {
+		limiter.SetHostRate(ccIndexServer, ccRate)
+		limiter.SetHostRate(ccStorage, ccRate)
+	}
+	if atRate > 0 {
+		limiter.SetHostRate(archivetoday.INDEX_SERVER, atRate)
+		limiter.SetHostRate(archivetoday.CRAWL_STORAGE, atRate)
+	}
+	if mmRate > 0 {
+		limiter.SetHostRate(mmTimeMap, mmRate)
+		limiter.SetHostRate(mmTimeGate, mmRate)
+	}
+	for _, s := range sourceNames {
+		if config, ok := cdxConfigs[s]; ok && config.RPS > 0 {
+			limiter.SetHostRate(config.IndexServer, config.RPS)
+			if config.ReplayURL != "" {
+				limiter.SetHostRate(config.ReplayURL, config.RPS)
+			}
+		}
+	}
+
+	opts := []common.ClientOption{common.WithRateLimiter(limiter)}
+
+	if proxy != "" {
+		opts = append(opts, common.WithProxy(proxy))
+	}
+
+	if userAgent != "" {
+		opts = append(opts, common.WithUserAgent(userAgent))
+	}
+
+	if maxConns != 0 {
+		opts = append(opts, common.WithMaxConnsPerHost(maxConns))
+	}
+
+	client, err := common.NewClient(opts...)
+	if err != nil {
+		log.Fatalf("Cannot initialize HTTP client: %v", err)
+	}
+	return client
+}
+
+// Read CDX servers defined with --cdx-config and --cdx by their names, flags override the file
+func loadCDXConfigs() map[string]cdx.Config {
+	configs := map[string]cdx.Config{}
+	if cdxConfigPath != "" {
+		loaded, err := cdx.LoadConfigs(cdxConfigPath)
+		if err != nil {
+			log.Fatalf("Cannot load CDX sources: %v", err)
+		}
+		for _, config := range loaded {
+			configs[config.Name] = config
+		}
+	}
+
+	for _, spec := range cdxSources {
+		config, err := cdx.ParseConfig(spec)
+		if err != nil {
+			log.Fatalf("Please check `--cdx`: %v", err)
+		}
+		configs[config.Name] = config
+	}
+
+	for _, name := range []string{"wb", "cc", "at", "mm", "lc", "lw"} {
+		if _, ok := configs[name]; ok {
+			log.Fatalf("CDX source name '%v' is reserved for a built-in source", name)
+		}
+	}
+	return configs
+}
 
 func initSources() {
+	cdxConfigs := loadCDXConfigs()
+	client := initClient(cdxConfigs)
+
 	for _, s := range sourceNames {
+		if config, ok := cdxConfigs[s]; ok {
+			log.Println("Initializing CDX source", s)
+			source, err := cdx.New(config, maxTimeout, maxRetries, cdx.WithClient(client), cdx.WithVerifyDigest(!noVerifyDigest))
+			if err != nil {
+				log.Fatalf("Cannot initialize CDX source: %v", err)
+			}
+			sources = append(sources, source)
+			continue
+		}
+
 		if s == "cc" {
 			log.Println("Initializing CommonCrawl")
-			cc, err := commoncrawl.New(maxTimeout, maxRetries)
+			cc, err := commoncrawl.New(maxTimeout, maxRetries,
+				commoncrawl.WithClient(client),
+				commoncrawl.WithIndexServer(ccIndexServer),
+				commoncrawl.WithCrawlStorage(ccStorage),
+			)
 			if err != nil {
 				log.Fatalf("Cannot initialize CommonCrawl source: %v", err)
 			}
@@ -59,17 +197,69 @@ func initSources() {
 
 		if s == "wb" {
 			log.Println("Initializing Wayback")
-			wb, err := wayback.New(maxTimeout, maxRetries)
+			wb, err := wayback.New(maxTimeout, maxRetries,
+				wayback.WithClient(client),
+				wayback.WithIndexServer(wbIndexServer),
+				wayback.WithCrawlStorage(wbStorage),
+				wayback.WithVerifyDigest(!noVerifyDigest),
+			)
 			if err != nil {
 				log.Fatalf("Cannot initialize Wayback source: %v", err)
 			}
 			sources = append(sources, wb)
 		}
+
+		if s == "at" {
+			log.Println("Initializing ArchiveToday")
+			at, err := archivetoday.New(maxTimeout, maxRetries, archivetoday.WithClient(client))
+			if err != nil {
+				log.Fatalf("Cannot initialize ArchiveToday source: %v", err)
+			}
+			sources = append(sources, at)
+		}
+
+		if s == "mm" {
+			log.Println("Initializing Memento")
+			mm, err := memento.New(maxTimeout, maxRetries,
+				memento.WithClient(client),
+				memento.WithTimeMapServer(mmTimeMap),
+				memento.WithTimeGateServer(mmTimeGate),
+			)
+			if err != nil {
+				log.Fatalf("Cannot initialize Memento source: %v", err)
+			}
+			sources = append(sources, mm)
+		}
+
+		if s == "lc" {
+			log.Println("Initializing local CDX indexes")
+			lc, err := localcdx.New(lcIndexes, localcdx.WithWARCDir(lcWARCDir))
+			if err != nil {
+				log.Fatalf("Cannot initialize local CDX source: %v", err)
+			}
+			sources = append(sources, lc)
+		}
+
+		if s == "lw" {
+			log.Println("Indexing local WARC files")
+			lw, err := localwarc.New(lwDir, localwarc.WithIndexDir(lwIndexDir))
+			if err != nil {
+				log.Fatalf("Cannot initialize local WARC source: %v", err)
+			}
+			sources = append(sources, lw)
+		}
 	}
 
 	if len(sources) == 0 {
 		log.Fatalf("No archive sources provided.")
 	}
+
+	if isResume {
+		var err error
+		if checkpoints, err = common.NewCheckpointStore(stateDir); err != nil {
+			log.Fatalf("Cannot initialize checkpoints: %v", err)
+		}
+	}
 }
 
 // Prepare arvhive request configs
@@ -105,25 +295,267 @@ func getRequestConfigs(args []string) chan common.RequestConfig {
 		}
 	}
 
-	for _, domain := range args {
-		config := common.RequestConfig{
-			URL:      domain,
-			Filters:  filters,
-			Limit:    maxResults,
-			FromDate: fromDateFilter,
-			ToDate:   toDateFilter,
+	if closestDate != "" {
+		var err error
+		if closestTime, err = common.ParseTimestamp(closestDate); err != nil {
+			log.Fatalln(fmt.Sprintf("Please check `--closest` date: %v", err))
 		}
+	}
 
-		if isCollapse {
-			config.CollapseColumn = "urlkey"
+	if _, err := common.ParseCollapses(collapseBy); err != nil {
+		log.Fatalln(fmt.Sprintf("Please check `--collapse-by`: %v", err))
+	}
+
+	collapse := collapseBy
+	if isCollapse {
+		collapse = append([]string{"urlkey"}, collapseBy...)
+	}
+
+	paginationMode, err := common.ParsePagination(pagination)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	for _, domain := range args {
+		config := common.RequestConfig{
+			URL:          domain,
+			Filters:      filters,
+			Limit:        maxResults,
+			FromDate:     fromDateFilter,
+			ToDate:       toDateFilter,
+			Pagination:   paginationMode,
+			Crawls:       ccCrawls,
+			CrawlsByDate: ccByDate,
+			DedupDigest:  isDedup,
+			Collapse:     collapse,
 		}
 		confChan <- config
 	}
 	return confChan
 }
 
+// Arguments validator rejecting --resume with --sort, sorted records are written only after all pages are done
+func noResumeSort(cmd *cobra.Command, args []string) error {
+	if isResume && isSort {
+		return fmt.Errorf("--resume cannot be used with --sort, sorted records are written after all queries are done")
+	}
+	return nil
+}
+
+// page ... Records of a single page of a source. With --resume, the source saves its progress and requests the next page
+// only after every record of the page is processed by done, so an interrupted run continues from the first unwritten page.
+type page struct {
+	records []*common.CdxResponse
+	pending sync.WaitGroup
+}
+
+func newPage(records []*common.CdxResponse) *page {
+	p := &page{records: records}
+	p.pending.Add(len(records))
+	return p
+}
+
+// done ... Marks n records of the page as written or downloaded
+func (p *page) done(n int) {
+	p.pending.Add(-n)
+}
+
+// Waits until all records of the page are done or ctx is done
+func (p *page) wait(ctx context.Context) {
+	processed := make(chan struct{})
+	go func() {
+		p.pending.Wait()
+		close(processed)
+	}()
+
+	select {
+	case <-processed:
+	case <-ctx.Done():
+	}
+}
+
+// pageRecord ... Record with the page it belongs to, see page.done
+type pageRecord struct {
+	res  *common.CdxResponse
+	page *page
+}
+
+// Query every source for each request config using maxWorkers workers. Pages are sent as sources return them.
+// Returned channel is closed once all configs are processed.
+func collectPages(ctx context.Context, configs <-chan common.RequestConfig) <-chan *page {
+	pages := make(chan *page)
+	var wg sync.WaitGroup
+
+	for i := uint(0); i < maxWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for config := range configs {
+				var sourcesWg sync.WaitGroup
+				for _, s := range sources {
+					sourcesWg.Add(1)
+					go func(s common.Source, config common.RequestConfig) {
+						defer sourcesWg.Done()
+						if !closestTime.IsZero() {
+							closestRecord(ctx, s, config, pages)
+							return
+						}
+						iterateSource(ctx, s, config, pages)
+					}(s, config)
+				}
+				sourcesWg.Wait()
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(pages)
+	}()
+
+	return pages
+}
+
+// Split pages into records, see collectPages
+func collectRecords(ctx context.Context, pages <-chan *page) <-chan pageRecord {
+	records := make(chan pageRecord)
+
+	go func() {
+		defer close(records)
+		for p := range pages {
+			for _, res := range p.records {
+				select {
+				case records <- pageRecord{res: res, page: p}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return records
+}
+
+// Records are merged by any of --merge, --merge-window and --sort
+func isMerging() bool {
+	return isMerge || mergeWindow != 0 || isSort
+}
+
+// Deduplicate records of all sources page by page if merging is enabled, duplicates are done at once.
+// With --sort all records are sent as a single page once pages are over.
+func mergePages(ctx context.Context, pages <-chan *page) <-chan *page {
+	if !isMerging() {
+		return pages
+	}
+
+	merged := make(chan *page)
+	merger := common.NewMerger(common.MergeOptions{ByDigest: mergeWindow == 0, Window: mergeWindow})
+
+	go func() {
+		defer close(merged)
+
+		var sorted []*common.CdxResponse
+		for p := range pages {
+			var kept []*common.CdxResponse
+			for _, res := range p.records {
+				if !merger.Add(res) {
+					continue
+				}
+				if isSort {
+					sorted = append(sorted, res)
+					continue
+				}
+
+				// Sent record is not changed by merger anymore
+				sent := *res
+				sent.Sources = append([]string{}, res.Sources...)
+				kept = append(kept, &sent)
+			}
+			p.done(len(p.records) - len(kept))
+
+			if len(kept) == 0 {
+				continue
+			}
+			p.records = kept
+			select {
+			case merged <- p:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if len(sorted) > 0 {
+			common.SortRecords(sorted)
+			select {
+			case merged <- newPage(sorted):
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	return merged
+}
+
+func iterateSource(ctx context.Context, s common.Source, config common.RequestConfig, pages chan<- *page) {
+	if checkpoints != nil {
+		cp, err := checkpoints.Load(s.Name(), config)
+		if err != nil {
+			log.Printf("ERROR: [%v] %v: %v\n", s.Name(), config.URL, err)
+			return
+		}
+		if cp.NextPage > 0 || cp.ResumeKey != "" {
+			log.Printf("[%v] %v: resuming from page %v, %v results done\n", s.Name(), config.URL, cp.NextPage, cp.Results)
+		}
+		config.Checkpoint = cp
+	}
+
+	it := s.Iterate(ctx, config)
+	defer it.Close()
+
+	for it.NextPage() {
+		p := newPage(it.Page())
+		select {
+		case pages <- p:
+		case <-ctx.Done():
+			return
+		}
+
+		// Checkpoint is saved when the next page is requested, so wait until this one is written
+		if config.Checkpoint != nil {
+			p.wait(ctx)
+		}
+	}
+
+	if err := it.Err(); err != nil {
+		log.Printf("ERROR: [%v] %v: %v\n", s.Name(), config.URL, err)
+	}
+}
+
+// Find capture closest to --closest date, negotiated with the archive if source supports it
+func closestRecord(ctx context.Context, s common.Source, config common.RequestConfig, pages chan<- *page) {
+	res, err := common.Closest(ctx, s, config, closestTime)
+	if errors.Is(err, common.ErrNotFound) {
+		log.Printf("[%v] %v: no captures\n", s.Name(), config.URL)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: [%v] %v: %v\n", s.Name(), config.URL, err)
+		return
+	}
+
+	select {
+	case pages <- newPage([]*common.CdxResponse{res}):
+	case <-ctx.Done():
+	}
+}
+
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	// Cancel in-flight requests on Ctrl+C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
 		fmt.Fprintf(os.Stderr, "There was an error while executing CLI: '%s'", err)
 		os.Exit(1)
 	}
@@ -153,16 +585,47 @@ func init() {
 	cobra.OnInitialize(initArgs)
 	rootCmd.PersistentFlags().StringSliceVarP(&filters, "filter", "f", []string{}, `Filters to use. You can use multiple. Example: --filter "mimetype:application/pdf"`)
 	rootCmd.PersistentFlags().BoolVarP(&isCollapse, "collapse", "c", false, `Get only unique URLs.`)
+	rootCmd.PersistentFlags().StringSliceVarP(&collapseBy, "collapse-by", "", []string{}, `Skip adjacent captures with the same field value. Example: --collapse-by timestamp:8,digest for one capture of each content per day`)
 	rootCmd.PersistentFlags().BoolVarP(&isSuccessful, "successful", "", false, `Get only status 200 response items.`)
 	rootCmd.PersistentFlags().IntVarP(&maxTimeout, "timeout", "t", 30, `Max timeout of requests.`)
 	rootCmd.PersistentFlags().IntVarP(&maxRetries, "retries", "r", 3, `Max request retries."`)
 	rootCmd.PersistentFlags().UintVarP(&maxResults, "limit", "l", 0, `Max number of results to fetch."`)
 	rootCmd.PersistentFlags().UintVarP(&maxWorkers, "workers", "w", 4, `Max number of workers (threads) to use. URL consumes 1 worker"`)
 	rootCmd.PersistentFlags().StringSliceVarP(&extensions, "ext", "e", []string{}, `Which extensions to collect. Example: --ext "pdf,xml,jpeg"`)
-	rootCmd.PersistentFlags().StringSliceVarP(&sourceNames, "sources", "s", []string{"wb", "cc"}, `Web archive sources to use. Example: --sources "wb" to use only the Wayback`)
+	rootCmd.PersistentFlags().StringSliceVarP(&sourceNames, "sources", "s", []string{"wb", "cc"}, `Web archive sources to use: "wb" (Wayback), "cc" (CommonCrawl), "at" (archive.today, exact URLs only), "mm" (Memento aggregator, exact URLs only), "lc" (local CDX indexes from --lc-index), "lw" (local WARC files from --lw-dir) or a name from --cdx and --cdx-config. Example: --sources "wb" to use only the Wayback`)
 	rootCmd.PersistentFlags().BoolVarP(&isVerbose, "verbose", "v", false, `Use verbose output.`)
 	rootCmd.PersistentFlags().BoolVarP(&isLogging, "log", "", false, `Print logs to ./logs.txt.`)
 	rootCmd.PersistentFlags().StringVarP(&fromDateFilter, "from", "", "", "Filter from date, example: --from 20200131 (filter from 31 Jan 2020)")
 	rootCmd.PersistentFlags().StringVarP(&toDateFilter, "to", "", "", "Filter to date, example: --to 20230401 (filter to 1 Apr 2023)")
+	rootCmd.PersistentFlags().StringVarP(&proxy, "proxy", "", "", "HTTP or SOCKS5 proxy to use, example: --proxy socks5://127.0.0.1:9050")
+	rootCmd.PersistentFlags().StringVarP(&userAgent, "user-agent", "", "", "User-Agent to use for requests, random one is used for each request by default")
+	rootCmd.PersistentFlags().IntVarP(&maxConns, "max-conns", "", 0, "Max number of connections per host, 0 means fasthttp default")
+	rootCmd.PersistentFlags().StringVarP(&wbIndexServer, "wb-index-server", "", wayback.INDEX_SERVER, "Wayback CDX server URL, to use a local or mirror CDX server")
+	rootCmd.PersistentFlags().StringVarP(&wbStorage, "wb-storage", "", wayback.CRAWL_STORAGE, "Wayback archived files URL")
+	rootCmd.PersistentFlags().StringVarP(&ccIndexServer, "cc-index-server", "", commoncrawl.INDEX_SERVER, "CommonCrawl index server URL, to use a local or mirror index server")
+	rootCmd.PersistentFlags().StringVarP(&ccStorage, "cc-storage", "", commoncrawl.CRAWL_STORAGE, "CommonCrawl WARC files storage URL")
+	rootCmd.PersistentFlags().Float64VarP(&wbRate, "wb-rps", "", 0, "Max requests per second to Wayback, 0 means unlimited. Example: --wb-rps 0.5")
+	rootCmd.PersistentFlags().Float64VarP(&ccRate, "cc-rps", "", 0, "Max requests per second to CommonCrawl, 0 means unlimited")
+	rootCmd.PersistentFlags().StringArrayVarP(&cdxSources, "cdx", "", []string{}, `Define CDX server source to use in --sources, replay URL is needed for downloads, rps limits requests per second. Example: --cdx "arquivo=https://arquivo.pt/wayback/cdx,https://arquivo.pt/wayback/{timestamp}id_/{url},rps=1"`)
+	rootCmd.PersistentFlags().StringVarP(&cdxConfigPath, "cdx-config", "", "", "JSON file with CDX server sources to use in --sources, see README")
+	rootCmd.PersistentFlags().Float64VarP(&atRate, "at-rps", "", 0, "Max requests per second to archive.today, 0 means unlimited")
+	rootCmd.PersistentFlags().StringVarP(&mmTimeMap, "memento-timemap", "", memento.TIMEMAP_SERVER, "Memento TimeMap URL of an archive or aggregator, TimeMaps are requested as <url>/<original>")
+	rootCmd.PersistentFlags().StringVarP(&mmTimeGate, "memento-timegate", "", memento.TIMEGATE_SERVER, "Memento TimeGate URL of an archive or aggregator, used with --closest")
+	rootCmd.PersistentFlags().Float64VarP(&mmRate, "mm-rps", "", 0, "Max requests per second to Memento TimeMap and TimeGate, 0 means unlimited")
+	rootCmd.PersistentFlags().StringSliceVarP(&lcIndexes, "lc-index", "", []string{}, "Local sorted CDX/CDXJ files, ZipNum .idx files or directories with them to search with --sources lc")
+	rootCmd.PersistentFlags().StringVarP(&lcWARCDir, "lc-warc-dir", "", "", "Directory of WARC files referenced by local CDX indexes, needed to download files")
+	rootCmd.PersistentFlags().StringVarP(&lwDir, "lw-dir", "", "", "Directory of .warc and .warc.gz files to index and search with --sources lw")
+	rootCmd.PersistentFlags().StringVarP(&lwIndexDir, "lw-index-dir", "", "", "Directory to keep index of --lw-dir, user cache directory by default")
+	rootCmd.PersistentFlags().StringVarP(&closestDate, "closest", "", "", "Get only the capture of each URL closest to date, example: --closest 20190601 or --closest 2019-06-01T12:00:00")
+	rootCmd.PersistentFlags().BoolVarP(&noVerifyDigest, "no-verify-digest", "", false, "Don't check files downloaded from Wayback and --cdx sources against CDX digests. Common Crawl and local WARCs are always checked")
+	rootCmd.PersistentFlags().BoolVarP(&isResume, "resume", "", false, "Continue queries from the page where the last run stopped")
+	rootCmd.PersistentFlags().StringVarP(&stateDir, "state-dir", "", ".gogetcrawl", "Directory to save progress of queries for --resume")
+	rootCmd.PersistentFlags().StringVarP(&pagination, "pagination", "", "auto", `Wayback pagination: "pages", "resumekey" or "auto" to use resume keys when pages cannot be counted`)
+	rootCmd.PersistentFlags().IntVarP(&ccCrawls, "cc-crawls", "", 0, "Number of the latest CommonCrawl crawls to search, -1 for all. Only the latest one by default")
+	rootCmd.PersistentFlags().BoolVarP(&ccByDate, "cc-by-date", "", false, "Search CommonCrawl crawls overlapping --from and --to dates")
+	rootCmd.PersistentFlags().BoolVarP(&isDedup, "dedup", "", false, "Skip CommonCrawl captures with the same URL and digest found in a newer crawl")
+	rootCmd.PersistentFlags().BoolVarP(&isMerge, "merge", "", false, "Skip captures found by several sources, the same URL and digest is the same capture")
+	rootCmd.PersistentFlags().DurationVarP(&mergeWindow, "merge-window", "", 0, "Merge captures of the same URL closer in time than the window instead of by digest. Example: --merge-window 1h")
+	rootCmd.PersistentFlags().BoolVarP(&isSort, "sort", "", false, "Merge captures and output them chronologically once all queries are done")
 	//TODOrootCmd.PersistentFlags().BoolVarP(&isDisablePagination, "disable-pagination", "", "", "")
 }
@@ -1,19 +1,26 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"sync"
+	"strings"
 
+	"github.com/karust/gogetcrawl/cdxdb"
 	"github.com/karust/gogetcrawl/common"
+	"github.com/karust/gogetcrawl/output"
 	"github.com/spf13/cobra"
 )
 
 type urlScenario struct {
-	outputFile      string
-	finishedWorkers uint
+	outputFile string
+	format     string
+	fields     []string
+	isAppend   bool // Output file has records of the previous run
+	sqlitePath string
+	isOnlyNew  bool
 }
 
 var urlScn = urlScenario{}
@@ -22,97 +29,142 @@ var urlCMD = &cobra.Command{
 	Use:     "url",
 	Aliases: []string{"collect"},
 	Short:   "Collect URLs from web archives for desired domain",
-	Args:    cobra.MatchAll(cobra.MinimumNArgs(1), cobra.OnlyValidArgs),
+	Args:    cobra.MatchAll(cobra.MinimumNArgs(1), cobra.OnlyValidArgs, noResumeSort),
 	Run:     urlScn.spawnWorkers,
 }
 
-func (us *urlScenario) worker(configs chan common.RequestConfig) {
-	for {
-		select {
-		case config, ok := <-configs:
-			if ok {
-				var wg sync.WaitGroup
-
-				for _, s := range sources {
-					wg.Add(1)
-					go func(s common.Source) {
-						defer wg.Done()
-						s.FetchPages(config, results, errors)
-					}(s)
-				}
-				wg.Wait()
-			} else {
-				us.finishedWorkers += 1
-				return
-			}
-		}
+func (us *urlScenario) spawnWorkers(cmd *cobra.Command, args []string) {
+	format, err := output.ParseFormat(us.format)
+	if err != nil {
+		log.Fatalln(err)
 	}
-}
 
-func (us *urlScenario) spawnWorkers(cmd *cobra.Command, args []string) {
-	output, err := us.getOutputTarget()
+	target, closeTarget, err := us.getOutputTarget()
 	if err != nil {
 		log.Fatalf("Error obtaining output: %v", err)
 	}
 
+	if us.isAppend && format == output.FormatParquet {
+		log.Fatalf("Cannot append to Parquet file '%v', remove it or use another output", us.outputFile)
+	}
+
+	var opts []output.Option
+	if us.isAppend {
+		opts = append(opts, output.WithoutHeader())
+	}
+	writer, err := output.NewWriter(target, format, us.fields, opts...)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	configs := getRequestConfigs(args)
+	close(configs)
 	initSources()
 
-	var wg sync.WaitGroup
+	var run *cdxdb.Run
+	if us.sqlitePath != "" {
+		db, err := cdxdb.Open(us.sqlitePath)
+		if err != nil {
+			log.Fatalf("Cannot open SQLite database: %v", err)
+		}
+		defer db.Close()
 
-	// Spawn Workers
-	go func() {
-		for i := uint(0); i < maxWorkers; i++ {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				us.worker(configs)
-			}()
+		if run, err = db.StartRun(strings.Join(args, " "), sourceNames); err != nil {
+			log.Fatalln(err)
 		}
-	}()
+	} else if us.isOnlyNew {
+		log.Fatalf("Flag --only-new requires --sqlite")
+	}
 
-	close(configs)
+	// Output is closed on failure too, so Parquet file gets its footer
+	err = us.writeRecords(cmd.Context(), configs, writer, run)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := closeTarget(); err == nil {
+		err = closeErr
+	}
 
-	// Read Results and errors
-	for us.finishedWorkers != maxWorkers {
-		select {
-		case res, ok := <-results:
-			if ok {
-				fmt.Fprintf(output, "%v", us.formatResultOutput(res))
-			}
-		case err, ok := <-errors:
-			if ok {
-				log.Println(err)
-			}
+	if run != nil {
+		if finishErr := run.Finish(); finishErr != nil {
+			log.Println(finishErr)
+		} else {
+			log.Printf("Saved %v new captures to '%v'", run.Added(), us.sqlitePath)
 		}
 	}
-
-	wg.Wait()
-	close(results)
-	close(errors)
+	if err != nil {
+		log.Fatalf("Cannot write output: %v", err)
+	}
 }
 
-func (us *urlScenario) getOutputTarget() (io.Writer, error) {
-	if us.outputFile != "" {
-		file, err := os.OpenFile(us.outputFile, os.O_CREATE|os.O_WRONLY, 0666)
+// Write records of all sources page by page as they are received, so Parquet gets a row group per page
+func (us *urlScenario) writeRecords(ctx context.Context, configs <-chan common.RequestConfig, writer output.Writer, run *cdxdb.Run) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for p := range mergePages(ctx, collectPages(ctx, configs)) {
+		records, err := us.saveRecords(run, p.records)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		return file, nil
+		if len(records) > 0 {
+			if err := writer.WritePage(records); err != nil {
+				return err
+			}
+		}
+		p.done(len(p.records))
 	}
+	return nil
+}
 
-	return os.Stdout, nil
+// Save records to SQLite if enabled, returns records to output
+func (us *urlScenario) saveRecords(run *cdxdb.Run, records []*common.CdxResponse) ([]*common.CdxResponse, error) {
+	if run == nil {
+		return records, nil
+	}
+
+	var kept []*common.CdxResponse
+	for _, res := range records {
+		isNew, err := run.Add(res)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot save record: %v", err)
+		}
+		if !us.isOnlyNew || isNew {
+			kept = append(kept, res)
+		}
+	}
+	return kept, nil
 }
 
-func (us *urlScenario) formatResultOutput(results []*common.CdxResponse) string {
-	output := ""
-	for _, r := range results {
-		output += r.Original + "\n"
+// Returns output and function closing it
+func (us *urlScenario) getOutputTarget() (io.Writer, func() error, error) {
+	if us.outputFile != "" {
+		flags := os.O_CREATE | os.O_WRONLY
+		if isResume {
+			// Keep URLs collected by the previous run
+			flags |= os.O_APPEND
+		} else {
+			flags |= os.O_TRUNC
+		}
+
+		file, err := os.OpenFile(us.outputFile, flags, 0666)
+		if err != nil {
+			return nil, nil, err
+		}
+		if info, err := file.Stat(); err == nil && isResume && info.Size() > 0 {
+			us.isAppend = true
+		}
+		return file, file.Close, nil
 	}
-	return output
+
+	return os.Stdout, func() error { return nil }, nil
 }
 
 func init() {
 	urlCMD.Flags().StringVarP(&urlScn.outputFile, "output", "o", "", "Path to the output file")
+	urlCMD.Flags().StringVarP(&urlScn.format, "format", "", "txt", "Output format: txt, jsonl, csv, tsv, cdxj or parquet")
+	urlCMD.Flags().StringVarP(&urlScn.sqlitePath, "sqlite", "", "", "Path to SQLite database to save records to, captures found by previous runs are kept")
+	urlCMD.Flags().BoolVarP(&urlScn.isOnlyNew, "only-new", "", false, "Output only captures which are not in --sqlite database yet")
+	urlCMD.Flags().StringSliceVarP(&urlScn.fields, "fields", "", []string{}, "Record fields to output, in order. Any of: "+strings.Join(output.Fields, ","))
 	rootCmd.AddCommand(urlCMD)
 }
@@ -0,0 +1,230 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Capture ... Archived HTTP response of a CDX record, returned by Source.GetCapture
+type Capture struct {
+	Record     *CdxResponse // CDX record of the capture
+	StatusCode int          // Original HTTP status code
+	Header     http.Header  // Original HTTP response headers
+	WARCHeader http.Header  // WARC record header fields, empty if archive doesn't serve WARC records
+	Body       []byte       // Payload, de-chunked and decoded according to Content-Encoding
+	Payload    []byte       // Payload as archived, like read from Source.OpenPayload: de-chunked, but not decoded
+	Encoding   string       // Content-Encoding of Payload, empty if it isn't compressed
+}
+
+// Payload ... Stream of capture payload as stored by archive: de-chunked, but not decoded.
+// CDX record digest is computed from it.
+type Payload struct {
+	io.ReadCloser
+	Encoding string // Content-Encoding of the payload, empty if it isn't compressed
+}
+
+// Decode ... Returns stream decoding payload according to its Encoding. Payload is closed on error.
+func (p *Payload) Decode() (io.ReadCloser, error) {
+	body, err := DecodeContentReader(p.Encoding, p.ReadCloser)
+	if err != nil {
+		err = drainError(p.ReadCloser, err)
+		p.Close()
+		return nil, err
+	}
+	return body, nil
+}
+
+// ParseHTTPResponse ... Parses raw HTTP response as stored in WARC response records into capture of record.
+// Chunked body is de-chunked and content is decoded. Truncated body is returned as is.
+func ParseHTTPResponse(record *CdxResponse, message []byte) (*Capture, error) {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(message)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse HTTP response: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Archives often truncate large payloads, keep what was read
+	body, _ := io.ReadAll(resp.Body)
+
+	capture := &Capture{
+		Record:     record,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		WARCHeader: http.Header{},
+		Body:       body,
+		Payload:    body,
+	}
+	capture.decodeBody()
+	return capture, nil
+}
+
+// NewCapture ... Creates capture of record from response headers and payload.
+// Content is decoded according to Content-Encoding header.
+func NewCapture(record *CdxResponse, statusCode int, header http.Header, body []byte) *Capture {
+	capture := &Capture{
+		Record:     record,
+		StatusCode: statusCode,
+		Header:     header,
+		WARCHeader: http.Header{},
+		Body:       body,
+		Payload:    body,
+	}
+	capture.decodeBody()
+	return capture
+}
+
+const ORIG_HEADER_PREFIX = "X-Archive-Orig-" // Prefix of original headers in replay responses of Wayback compatible servers
+
+// NewReplayCapture ... Creates capture of record from raw (id_) replay response of Wayback compatible server.
+// Original headers prefixed with X-Archive-Orig- are returned without prefix, mirrors like pywb may return them as is.
+// Returns StatusError if response isn't an archived capture.
+func NewReplayCapture(record *CdxResponse, resp *Response, url string) (*Capture, error) {
+	header := http.Header{}
+	for k, v := range resp.Header {
+		if len(k) > len(ORIG_HEADER_PREFIX) && strings.EqualFold(k[:len(ORIG_HEADER_PREFIX)], ORIG_HEADER_PREFIX) {
+			header[http.CanonicalHeaderKey(k[len(ORIG_HEADER_PREFIX):])] = v
+		}
+	}
+
+	archived := len(header) > 0 || resp.Header.Get("Memento-Datetime") != ""
+	if resp.StatusCode != http.StatusOK && !archived {
+		return nil, StatusError(resp.StatusCode, url)
+	}
+
+	body, encoding := resp.Body, ""
+	if len(header) == 0 {
+		header = resp.Header
+	} else {
+		// Content type isn't prefixed, body is transferred de-chunked
+		header.Set("Content-Type", resp.Header.Get("Content-Type"))
+		header.Del("Transfer-Encoding")
+
+		if encoding = resp.Header.Get("Content-Encoding"); encoding != "" {
+			if decoded, err := DecodeContent(encoding, body); err == nil {
+				body = decoded
+				header.Del("Content-Encoding")
+			}
+		}
+	}
+
+	capture := NewCapture(record, resp.StatusCode, header, body)
+	if encoding != "" {
+		capture.Payload, capture.Encoding = resp.Body, encoding
+	}
+	return capture, nil
+}
+
+// Decode body and remove encoding headers which don't describe it anymore.
+// Body is left as is if it cannot be decoded.
+func (c *Capture) decodeBody() {
+	encoding := strings.ToLower(strings.TrimSpace(c.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" {
+		return
+	}
+
+	decoded, err := DecodeContent(encoding, c.Body)
+	if err != nil {
+		return
+	}
+
+	c.Body, c.Encoding = decoded, c.Header.Get("Content-Encoding")
+	c.Header.Del("Content-Encoding")
+	c.Header.Del("Content-Length")
+}
+
+// DecodeContent ... Decodes body compressed with Content-Encoding: gzip, deflate, br or zstd
+func DecodeContent(encoding string, body []byte) ([]byte, error) {
+	reader, err := DecodeContentReader(encoding, io.NopCloser(bytes.NewReader(body)))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decode %v content: %v", encoding, err)
+	}
+	return decoded, nil
+}
+
+// DecodeContentReader ... Returns stream decoding body compressed with Content-Encoding, see DecodeContent.
+// Closing it closes body. Body is returned as is for empty or identity encoding.
+func DecodeContentReader(encoding string, body io.ReadCloser) (io.ReadCloser, error) {
+	var reader io.Reader
+	var err error
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(body)
+	case "deflate":
+		// Servers send either zlib wrapped or raw deflate data, peek the zlib header to tell
+		buffered := bufio.NewReader(body)
+		header, _ := buffered.Peek(2)
+		if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			reader, err = zlib.NewReader(buffered)
+		} else {
+			reader = flate.NewReader(buffered)
+		}
+	case "br":
+		reader = brotli.NewReader(body)
+	case "zstd":
+		var decoder *zstd.Decoder
+		if decoder, err = zstd.NewReader(body); err == nil {
+			reader = decoder.IOReadCloser()
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported content encoding: %v", encoding)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decode %v content: %v", encoding, err)
+	}
+
+	return &decodedBody{Reader: reader, body: body}, nil
+}
+
+// decodedBody ... Closes both decoder and underlying body
+type decodedBody struct {
+	io.Reader
+	body io.ReadCloser
+}
+
+// Decoders may stop before the end of body, it's read to the end so wrapped readers like digest check see it
+func (d *decodedBody) Read(p []byte) (int, error) {
+	n, err := d.Reader.Read(p)
+	if err == io.EOF {
+		if _, drainErr := io.Copy(io.Discard, d.body); drainErr != nil {
+			err = drainErr
+		}
+	} else if err != nil {
+		err = drainError(d.body, err)
+	}
+	return n, err
+}
+
+// Corrupted payload usually cannot be decoded. The rest of body is read, so digest check can tell it.
+func drainError(body io.Reader, err error) error {
+	if _, drainErr := io.Copy(io.Discard, body); errors.Is(drainErr, ErrDigestMismatch) {
+		return drainErr
+	}
+	return err
+}
+
+func (d *decodedBody) Close() error {
+	if closer, ok := d.Reader.(io.Closer); ok {
+		closer.Close()
+	}
+	return d.body.Close()
+}
@@ -0,0 +1,44 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"testing"
+)
+
+func TestParseHTTPResponse(t *testing.T) {
+	payload := []byte("<html>chunked and compressed</html>")
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(payload)
+	gz.Close()
+
+	// Two chunks of gzip data
+	half := compressed.Len() / 2
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "%x\r\n%s\r\n", half, compressed.Bytes()[:half])
+	fmt.Fprintf(&body, "%x\r\n%s\r\n0\r\n\r\n", compressed.Len()-half, compressed.Bytes()[half:])
+
+	message := "HTTP/1.1 404 Not Found\r\nContent-Type: text/html\r\nContent-Encoding: gzip\r\nTransfer-Encoding: chunked\r\nX-Test: 1\r\n\r\n" + body.String()
+
+	record := &CdxResponse{Original: "http://example.com/"}
+	capture, err := ParseHTTPResponse(record, []byte(message))
+	if err != nil {
+		t.Fatalf("Cannot parse response: %v", err)
+	}
+
+	if capture.StatusCode != 404 || capture.Record != record {
+		t.Fatalf("Incorrect status=%v or record=%v", capture.StatusCode, capture.Record)
+	}
+	if capture.Header.Get("X-Test") != "1" || capture.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("Incorrect headers: %v", capture.Header)
+	}
+	if !bytes.Equal(capture.Body, payload) {
+		t.Fatalf("Incorrect body: %q, want=%q", capture.Body, payload)
+	}
+	if !bytes.Equal(capture.Payload, compressed.Bytes()) || capture.Encoding != "gzip" {
+		t.Fatalf("Incorrect archived payload: %q, encoding=%v", capture.Payload, capture.Encoding)
+	}
+}
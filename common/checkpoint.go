@@ -0,0 +1,185 @@
+package common
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Checkpoint ... Progress of a query to a single source, saved to a state file
+// every time records of a page are consumed. Set it in RequestConfig to resume pagination.
+type Checkpoint struct {
+	Source    string `json:"source"`
+	URL       string `json:"url"`
+	NextPage  int    `json:"next_page"`            // First page which records weren't consumed
+	ResumeKey string `json:"resume_key,omitempty"` // Wayback resumeKey of the next request
+	Results   int    `json:"results"`              // Number of consumed records
+
+	Parts map[string]*Checkpoint `json:"parts,omitempty"` // Progress of query parts, like Common Crawl indexes
+	Done  bool                   `json:"done,omitempty"`  // Part is completed
+
+	mu     sync.Mutex
+	path   string
+	parent *Checkpoint
+}
+
+// CheckpointStore ... Directory with checkpoint files, one per source and query
+type CheckpointStore struct {
+	dir string
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// NewCheckpointStore ... Creates directory for checkpoint files if needed
+func NewCheckpointStore(dir string) (*CheckpointStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("[NewCheckpointStore] Cannot create state dir: %v", err)
+	}
+	return &CheckpointStore{dir: dir}, nil
+}
+
+// Path to checkpoint file of query to source. Different query parameters result in different files.
+func (s *CheckpointStore) path(source string, config RequestConfig) string {
+	query, _ := jsoniter.Marshal(config)
+	sum := sha1.Sum(append([]byte(source+"\n"), query...))
+	name := unsafeFilenameChars.ReplaceAllString(source+"-"+config.URL, "_")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return filepath.Join(s.dir, fmt.Sprintf("%v-%v.json", name, hex.EncodeToString(sum[:6])))
+}
+
+// Load ... Returns saved checkpoint of query to source, or a new one starting from the first page
+func (s *CheckpointStore) Load(source string, config RequestConfig) (*Checkpoint, error) {
+	cp := &Checkpoint{Source: source, URL: config.URL, path: s.path(source, config)}
+
+	data, err := os.ReadFile(cp.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("[Load] Cannot read checkpoint: %v", err)
+	}
+
+	if err := jsoniter.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("[Load] Cannot decode checkpoint '%v': %v", cp.path, err)
+	}
+	return cp, nil
+}
+
+// New ... Returns checkpoint of query to source starting from the first page, ignoring saved one
+func (s *CheckpointStore) New(source string, config RequestConfig) *Checkpoint {
+	return &Checkpoint{Source: source, URL: config.URL, path: s.path(source, config)}
+}
+
+// Part ... Returns checkpoint of a query part, like a single Common Crawl index.
+// Parts are saved to the state file of their parent and marked as done on completion.
+func (cp *Checkpoint) Part(name string) *Checkpoint {
+	root := cp.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	if cp.Parts == nil {
+		cp.Parts = map[string]*Checkpoint{}
+	}
+
+	part, ok := cp.Parts[name]
+	if !ok {
+		part = &Checkpoint{Source: cp.Source, URL: cp.URL}
+		cp.Parts[name] = part
+	}
+	part.parent = cp
+	return part
+}
+
+// PartsResults ... Returns number of consumed records in all parts
+func (cp *Checkpoint) PartsResults() int {
+	root := cp.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	results := 0
+	for _, part := range cp.Parts {
+		results += part.Results
+	}
+	return results
+}
+
+// PageDone ... Records that all records up to nextPage were consumed
+func (cp *Checkpoint) PageDone(nextPage, results int) error {
+	root := cp.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	cp.NextPage, cp.Results = nextPage, results
+	return root.save()
+}
+
+// ResumeKeyDone ... Records that all records before resumeKey were consumed
+func (cp *Checkpoint) ResumeKeyDone(resumeKey string, results int) error {
+	root := cp.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	cp.ResumeKey, cp.Results = resumeKey, results
+	return root.save()
+}
+
+// Complete ... Removes state file of finished query, so the next run starts from scratch.
+// Completed part is marked as done instead.
+func (cp *Checkpoint) Complete() error {
+	root := cp.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	if cp != root {
+		cp.Done = true
+		return root.save()
+	}
+
+	if cp.path == "" {
+		return nil
+	}
+
+	err := os.Remove(cp.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("[Complete] Cannot remove checkpoint: %v", err)
+	}
+	return nil
+}
+
+func (cp *Checkpoint) root() *Checkpoint {
+	for cp.parent != nil {
+		cp = cp.parent
+	}
+	return cp
+}
+
+// Write state to temporary file first, so crash doesn't leave it half written
+func (cp *Checkpoint) save() error {
+	if cp.path == "" {
+		return nil
+	}
+
+	data, err := jsoniter.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return fmt.Errorf("[Save] Cannot encode checkpoint: %v", err)
+	}
+
+	tmp := cp.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("[Save] Cannot write checkpoint: %v", err)
+	}
+
+	if err := os.Rename(tmp, cp.path); err != nil {
+		return fmt.Errorf("[Save] Cannot write checkpoint: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Negotiator ... Source which finds capture of URL closest to a time without listing all captures, like Memento TimeGate
+type Negotiator interface {
+	Closest(ctx context.Context, url string, t time.Time) (*CdxResponse, error)
+}
+
+// ParseTimestamp ... Parses CDX timestamp in UTC, partial timestamps like "201906" are padded with zeros.
+// Separators are ignored, so dates like "2019-06-01" are accepted too.
+func ParseTimestamp(timestamp string) (time.Time, error) {
+	digits := strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, timestamp)
+	if len(digits) < 4 {
+		return time.Time{}, fmt.Errorf("Invalid timestamp '%v', use YYYYMMDD[hhmmss]", timestamp)
+	}
+
+	t, err := time.Parse(timestampLayout, padDate(digits, '0'))
+	if err != nil {
+		// Zero month and day of partial timestamps are not valid dates
+		t, err = time.Parse(timestampLayout[:len(digits)], digits)
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid timestamp '%v', use YYYYMMDD[hhmmss]", timestamp)
+	}
+	return t, nil
+}
+
+// Closest ... Returns capture of config URL closest to t. Negotiator sources are asked directly,
+// records of other sources are iterated to find the nearest one. Returns ErrNotFound if there are no captures.
+func Closest(ctx context.Context, source Source, config RequestConfig, t time.Time) (*CdxResponse, error) {
+	if negotiator, ok := source.(Negotiator); ok {
+		return negotiator.Closest(ctx, config.URL, t)
+	}
+
+	it := source.Iterate(ctx, config)
+	defer it.Close()
+
+	var closest *CdxResponse
+	var best time.Duration
+	for it.Next() {
+		res := it.Record()
+		captured, err := time.Parse(timestampLayout, res.Timestamp)
+		if err != nil {
+			continue
+		}
+
+		distance := captured.Sub(t)
+		if distance < 0 {
+			distance = -distance
+		}
+		if closest == nil || distance < best {
+			closest, best = res, distance
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	if closest == nil {
+		return nil, &Error{Kind: KindNotFound, Op: "Closest", Source: source.Name(), URL: config.URL, Page: -1}
+	}
+	return closest, nil
+}
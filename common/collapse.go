@@ -0,0 +1,99 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Collapse ... Skips adjacent records with equal value of Field, or its first Prefix characters if Prefix is set
+type Collapse struct {
+	Field  string
+	Prefix int
+}
+
+// ParseCollapse ... Parses CDX server collapse parameter like "urlkey", "digest" or "timestamp:8" (one capture per day)
+func ParseCollapse(spec string) (Collapse, error) {
+	name, prefix, hasPrefix := strings.Cut(strings.ToLower(strings.TrimSpace(spec)), ":")
+	if alias, ok := cdxAliases[name]; ok {
+		name = alias
+	}
+	if _, ok := cdxFields[name]; !ok {
+		return Collapse{}, fmt.Errorf("Unknown collapse field '%v'", name)
+	}
+
+	collapse := Collapse{Field: name}
+	if hasPrefix {
+		n, err := strconv.Atoi(prefix)
+		if err != nil || n <= 0 {
+			return Collapse{}, fmt.Errorf("Invalid collapse prefix length '%v'", prefix)
+		}
+		collapse.Prefix = n
+	}
+	return collapse, nil
+}
+
+// ParseCollapses ... Parses collapse parameters, see ParseCollapse
+func ParseCollapses(specs []string) ([]Collapse, error) {
+	collapses := make([]Collapse, 0, len(specs))
+	for _, spec := range specs {
+		collapse, err := ParseCollapse(spec)
+		if err != nil {
+			return nil, err
+		}
+		collapses = append(collapses, collapse)
+	}
+	return collapses, nil
+}
+
+// String ... Returns collapse parameter for CDX server
+func (c Collapse) String() string {
+	if c.Prefix > 0 {
+		return fmt.Sprintf("%v:%v", c.Field, c.Prefix)
+	}
+	return c.Field
+}
+
+func (c Collapse) value(res *CdxResponse) string {
+	value := cdxFields[c.Field](res)
+	if c.Prefix > 0 && len(value) > c.Prefix {
+		value = value[:c.Prefix]
+	}
+	return value
+}
+
+// Collapser ... Collapses records on the client like Wayback CDX server does, for sources which ignore collapse parameters.
+// Collapses are applied one after another, each compares a record with the last one it passed.
+// Only adjacent records are collapsed, so records must come in index order.
+type Collapser struct {
+	collapses []Collapse
+	last      []*string
+}
+
+// NewCollapser ... Creates collapser applying collapses in given order
+func NewCollapser(collapses []Collapse) *Collapser {
+	return &Collapser{collapses: collapses, last: make([]*string, len(collapses))}
+}
+
+// Keep ... Reports whether record is not collapsed into the previous ones
+func (c *Collapser) Keep(res *CdxResponse) bool {
+	for i, collapse := range c.collapses {
+		value := collapse.value(res)
+		if c.last[i] != nil && *c.last[i] == value {
+			return false
+		}
+		c.last[i] = &value
+	}
+	return true
+}
+
+// Filter ... Returns records which are kept, reusing results slice
+func (c *Collapser) Filter(results []*CdxResponse) []*CdxResponse {
+	kept := results[:0]
+	for _, res := range results {
+		if c.Keep(res) {
+			kept = append(kept, res)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,33 @@
+package common
+
+import "testing"
+
+func TestCollapser(t *testing.T) {
+	for _, spec := range []string{"original", "url", "timestamp:8", "Digest"} {
+		if _, err := ParseCollapse(spec); err != nil {
+			t.Fatalf("Cannot parse collapse %v: %v", spec, err)
+		}
+	}
+	for _, spec := range []string{"", "crawl", "timestamp:", "timestamp:0"} {
+		if _, err := ParseCollapse(spec); err == nil {
+			t.Fatalf("Invalid collapse %q is accepted", spec)
+		}
+	}
+
+	collapses, _ := ParseCollapses([]string{"timestamp:8", "digest"})
+	if collapses[0].String() != "timestamp:8" || collapses[1].String() != "digest" {
+		t.Fatalf("Incorrect collapse parameters: %v", collapses)
+	}
+
+	records := []*CdxResponse{
+		{Timestamp: "20200101000000", Digest: "A"},
+		{Timestamp: "20200101120000", Digest: "B"}, // same day
+		{Timestamp: "20200102000000", Digest: "C"},
+		{Timestamp: "20200103000000", Digest: "C"}, // same digest
+		{Timestamp: "20200104000000", Digest: "B"},
+	}
+	kept := NewCollapser(collapses).Filter(records)
+	if len(kept) != 3 || kept[1].Timestamp != "20200102000000" || kept[2].Timestamp != "20200104000000" {
+		t.Fatalf("Incorrect collapsed records: %v", len(kept))
+	}
+}
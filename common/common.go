@@ -1,8 +1,9 @@
 package common
 
 import (
-	"errors"
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"mime"
 	"net/http"
@@ -11,49 +12,87 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
-
-	"github.com/corpix/uarand"
-	"github.com/valyala/fasthttp"
 )
 
-var Status503Error = errors.New("Server returned 503 status response")
-var Status500Error = errors.New("Server returned 500 status response. (Slow down)")
-
 // WebArchive and Common Crawl (index.commoncrawl.org) CDX API Response structure from
 type CdxResponse struct {
-	Urlkey       string `json:"urlkey,omitempty"`
-	Timestamp    string `json:"timestamp,omitempty"`
-	Charset      string `json:"charset,omitempty"`
-	MimeType     string `json:"mime,omitempty"`
-	Languages    string `json:"languages,omitempty"`
-	MimeDetected string `json:"mimedetected,omitempty"`
-	Digest       string `json:"digest,omitempty"`
-	Offset       string `json:"offset,omitempty"`
-	Original     string `json:"url,omitempty"` // Original URL
-	Length       string `json:"length,omitempty"`
-	StatusCode   string `json:"status,omitempty"`
-	Filename     string `json:"filename,omitempty"`
+	Urlkey       string   `json:"urlkey,omitempty"`
+	Timestamp    string   `json:"timestamp,omitempty"`
+	Charset      string   `json:"charset,omitempty"`
+	MimeType     string   `json:"mime,omitempty"`
+	Languages    string   `json:"languages,omitempty"`
+	MimeDetected string   `json:"mimedetected,omitempty"`
+	Digest       string   `json:"digest,omitempty"`
+	Offset       string   `json:"offset,omitempty"`
+	Original     string   `json:"url,omitempty"` // Original URL
+	Length       string   `json:"length,omitempty"`
+	StatusCode   string   `json:"status,omitempty"`
+	Filename     string   `json:"filename,omitempty"`
+	Crawl        string   `json:"crawl,omitempty"`   // Common Crawl index ID the record was found in
+	Memento      string   `json:"memento,omitempty"` // URL of the capture in its archive, set by Memento sources
+	Sources      []string `json:"sources,omitempty"` // Names of all sources which have the capture, set by Merge
 	Source       Source
 }
 
 // Source of web archive data
+//
+//	Methods with the Context suffix stop as soon as the context is cancelled
+//	GetFile and OpenFile return payload de-chunked and decoded, GetCapture and OpenPayload keep it as archived
 type Source interface {
 	Name() string
 	ParseResponse(resp []byte) ([]*CdxResponse, error)
 	GetNumPages(url string) (int, error)
+	GetNumPagesContext(ctx context.Context, url string) (int, error)
 	GetPages(config RequestConfig) ([]*CdxResponse, error)
+	GetPagesContext(ctx context.Context, config RequestConfig) ([]*CdxResponse, error)
 	FetchPages(config RequestConfig, results chan []*CdxResponse, errors chan error)
+	FetchPagesContext(ctx context.Context, config RequestConfig, results chan []*CdxResponse, errors chan error)
+	Iterate(ctx context.Context, config RequestConfig) *Iterator
 	GetFile(*CdxResponse) ([]byte, error)
+	GetFileContext(ctx context.Context, page *CdxResponse) ([]byte, error)
+	GetCapture(*CdxResponse) (*Capture, error)
+	GetCaptureContext(ctx context.Context, page *CdxResponse) (*Capture, error)
+	OpenFile(ctx context.Context, page *CdxResponse) (io.ReadCloser, error)
+	OpenPayload(ctx context.Context, page *CdxResponse) (*Payload, error)
+}
+
+// Pagination ... How pages of CDX server results are requested
+type Pagination int
+
+const (
+	PaginationAuto      Pagination = iota // Numbered pages, resume keys if server cannot count pages
+	PaginationPages                       // Numbered pages: showNumPages and page parameters
+	PaginationResumeKey                   // Batches continued with resume key until exhausted: showResumeKey and resumeKey parameters (Wayback only)
+)
+
+// ParsePagination ... Returns pagination mode by its name: "auto", "pages" or "resumekey"
+func ParsePagination(name string) (Pagination, error) {
+	switch strings.ToLower(name) {
+	case "", "auto":
+		return PaginationAuto, nil
+	case "pages", "page":
+		return PaginationPages, nil
+	case "resumekey", "resume-key":
+		return PaginationResumeKey, nil
+	}
+	return PaginationAuto, fmt.Errorf("Unknown pagination mode: '%v'", name)
 }
 
 type RequestConfig struct {
-	URL            string   // Url to parse
-	Filters        []string // Extenstion to search
-	Limit          uint     // Max number of results per page
-	CollapseColumn string   // Which column to use to collapse results
-	SinglePage     bool     // Get results only from 1st page (mostly used for tests)
-	FromDate       string   // Filter results from Date
-	ToDate         string   // Filter results to Date
+	URL            string     // Url to parse
+	Filters        []string   // Extenstion to search
+	Limit          uint       // Max number of results per page
+	CollapseColumn string     // Which column to use to collapse results. Deprecated: use Collapse.
+	Collapse       []string   // Collapse parameters applied in order, like "urlkey", "digest" or "timestamp:8", see ParseCollapse
+	SinglePage     bool       // Get results only from 1st page (mostly used for tests)
+	FromDate       string     // Filter results from Date
+	ToDate         string     // Filter results to Date
+	Pagination     Pagination // How to request pages, supported by Wayback only
+	Crawls         int        // Common Crawl only: number of the latest crawls to search, -1 for all, 0 for the latest one or all overlapping dates with CrawlsByDate
+	CrawlsByDate   bool       // Common Crawl only: search only crawls overlapping FromDate/ToDate
+	DedupDigest    bool       // Common Crawl only: skip captures of URL with the same digest found in a newer crawl
+
+	Checkpoint *Checkpoint `json:"-"` // Saves pagination progress and resumes from it, nil to start from the first page
 }
 
 // GetUrlFromConfig ... Compose URL with CDX server request parameters
@@ -64,8 +103,8 @@ func (config RequestConfig) GetUrl(serverURL string, page int) string {
 		reqURL = fmt.Sprintf("%v&limit=%v", reqURL, config.Limit)
 	}
 
-	if config.CollapseColumn != "" {
-		reqURL = fmt.Sprintf("%v&collapse=%v", reqURL, config.CollapseColumn)
+	for _, collapse := range config.CollapseSpecs() {
+		reqURL = fmt.Sprintf("%v&collapse=%v", reqURL, url.QueryEscape(collapse))
 	}
 
 	for _, filter := range config.Filters {
@@ -88,69 +127,37 @@ func (config RequestConfig) GetUrl(serverURL string, page int) string {
 	return reqURL
 }
 
-func DoRequest(url string, timeout int, headers map[string]string) ([]byte, error) {
-	timeoutDuration := time.Second * time.Duration(timeout)
-
-	req := fasthttp.AcquireRequest()
-	req.SetRequestURI(url)
-	req.Header.SetMethod(fasthttp.MethodGet)
-	req.Header.Set(fasthttp.HeaderUserAgent, uarand.GetRandom())
-	for k, v := range headers {
-		req.Header.Set(k, v)
-	}
-	defer fasthttp.ReleaseRequest(req)
-
-	resp := fasthttp.AcquireResponse()
-	defer fasthttp.ReleaseResponse(resp)
-
-	client := &fasthttp.Client{}
-	client.ReadTimeout = timeoutDuration
-	err := client.DoTimeout(req, resp, timeoutDuration)
-	if err != nil {
-		return nil, fmt.Errorf("[GetRequest] Error making request: %v", err)
-	}
-
-	switch resp.StatusCode() {
-	case 500:
-		return nil, Status500Error
-	case 503:
-		return resp.Body(), Status503Error
-	}
-
-	if len(resp.Body()) > 0 {
-		return resp.Body(), nil
+// CollapseSpecs ... Returns collapse parameters of config, CollapseColumn goes first
+func (config RequestConfig) CollapseSpecs() []string {
+	var specs []string
+	if config.CollapseColumn != "" {
+		specs = append(specs, config.CollapseColumn)
 	}
-
-	if resp.StatusCode() != 200 {
-		return nil, fmt.Errorf("[GetRequest] Got %v status response", resp.StatusCode())
+	for _, spec := range config.Collapse {
+		if spec != "" {
+			specs = append(specs, spec)
+		}
 	}
+	return specs
+}
 
-	if resp.Body() == nil {
-		return nil, fmt.Errorf("[GetRequest] Response body is empty")
-	}
+func DoRequest(url string, timeout int, headers map[string]string) ([]byte, error) {
+	return DoRequestContext(context.Background(), url, timeout, headers)
+}
 
-	return resp.Body(), nil
+// DoRequestContext ... Performs HTTP GET request using DefaultClient, aborted when ctx is done
+func DoRequestContext(ctx context.Context, url string, timeout int, headers map[string]string) ([]byte, error) {
+	return DefaultClient.DoRequest(ctx, url, timeout, headers)
 }
 
 // Get ... Performs HTTP GET request and returns response bytes
 func Get(url string, timeout int, maxRetries int) ([]byte, error) {
-	var err error
-	var responseBytes []byte
-
-	for i := maxRetries; i != 0; i-- {
-		log.Printf("GET [t=%v] [r=%v]: %v", timeout, maxRetries, url)
-
-		responseBytes, err = DoRequest(url, timeout, nil)
-		if err == nil {
-			return responseBytes, nil
-		}
-
-		if err == Status503Error || err == Status500Error {
-			time.Sleep(time.Duration(timeout * int(time.Second)))
-		}
-	}
+	return GetContext(context.Background(), url, timeout, maxRetries)
+}
 
-	return nil, fmt.Errorf("Perfomed max retries, no result: %v", err)
+// GetContext ... Performs HTTP GET request with retries using DefaultClient, stops retrying when ctx is done
+func GetContext(ctx context.Context, url string, timeout int, maxRetries int) ([]byte, error) {
+	return DefaultClient.Get(ctx, url, timeout, maxRetries)
 }
 
 // Save data using file fullpath
@@ -165,39 +172,92 @@ func SaveFile(data []byte, path string) error {
 
 // Save files from CDX Response channel into output directory
 func SaveFiles(results <-chan []*CdxResponse, outputDir string, errors chan error, downloadRate float32) {
+	SaveFilesContext(context.Background(), results, outputDir, errors, downloadRate)
+}
+
+// SaveFilesContext ... Saves files from CDX Response channel into output directory.
+// Returns when ctx is done or results channel is closed.
+func SaveFilesContext(ctx context.Context, results <-chan []*CdxResponse, outputDir string, errors chan error, downloadRate float32) {
 	log.Println("[SaveFiles] worker started:", outputDir)
 
+	sendErr := func(err error) {
+		select {
+		case errors <- err:
+		case <-ctx.Done():
+		}
+	}
+
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case resBatch, ok := <-results:
-			if ok {
-				for _, res := range resBatch {
-					data, err := res.Source.GetFile(res)
-					if err != nil {
-						errors <- err
-						continue
-					}
-
-					exts, _ := mime.ExtensionsByType(res.MimeType)
-					if exts == nil {
-						exts = []string{""}
-					}
-
-					filename := fmt.Sprintf("%v-%v-%v%v", res.Original, res.Timestamp, res.Source.Name(), exts[0])
-					escapedFilename := url.QueryEscape(filename)
-					fullPath := filepath.Join(outputDir, escapedFilename)
+			if !ok {
+				return
+			}
 
-					err = SaveFile(data, fullPath)
-					if err != nil {
-						errors <- err
+			for _, res := range resBatch {
+				if err := SaveResult(ctx, res, outputDir); err != nil {
+					if ctx.Err() != nil {
+						return
 					}
+					sendErr(err)
+				}
 
-					time.Sleep(time.Second * time.Duration(downloadRate))
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Second * time.Duration(downloadRate)):
 				}
 			}
 		}
 	}
+}
 
+// SaveResult ... Downloads file of a CDX record and saves it into output directory.
+// File is streamed to disk, so large files are not buffered in memory.
+func SaveResult(ctx context.Context, res *CdxResponse, outputDir string) error {
+	exts, _ := mime.ExtensionsByType(res.MimeType)
+	if exts == nil {
+		exts = []string{""}
+	}
+
+	filename := fmt.Sprintf("%v-%v-%v%v", res.Original, res.Timestamp, res.Source.Name(), exts[0])
+	escapedFilename := url.QueryEscape(filename)
+	fullPath := filepath.Join(outputDir, escapedFilename)
+
+	// Payload is checked against the digest while saved, truncated downloads are repeated
+	return RetryDigest(ctx, DIGEST_RETRIES, func() error {
+		stream, err := res.Source.OpenFile(ctx, res)
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+
+		return SaveStream(stream, fullPath)
+	})
+}
+
+// SaveStream ... Saves data from reader using file fullpath.
+// Data is written to a temporary file first, so failed downloads don't leave partial files.
+func SaveStream(reader io.Reader, path string) error {
+	tmp := path + ".part"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(file, reader); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err = file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
 }
 
 func GetFileExtenstion(file *[]byte) (string, error) {
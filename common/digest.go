@@ -0,0 +1,179 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const DIGEST_RETRIES = 3 // Number of downloads of a capture until its payload matches the digest
+
+// PayloadDigest ... Returns CDX style digest of payload: base32 encoded SHA-1
+func PayloadDigest(payload []byte) string {
+	sum := sha1.Sum(payload)
+	return base32.StdEncoding.EncodeToString(sum[:])
+}
+
+// NormalizeDigest ... Returns base32 SHA-1 digest without "sha1:" prefix.
+// Empty string is returned if digest is missing or computed with other algorithm.
+func NormalizeDigest(digest string) string {
+	digest = strings.TrimSpace(digest)
+	if algorithm, value, ok := strings.Cut(digest, ":"); ok {
+		if !strings.EqualFold(algorithm, "sha1") {
+			return ""
+		}
+		digest = value
+	}
+	if digest == "-" {
+		return ""
+	}
+	return strings.ToUpper(digest)
+}
+
+// Digest to check payload of the record against, empty if it cannot be checked.
+// Revisit records don't contain payload, their digest belongs to the revisited capture.
+func recordDigest(record *CdxResponse) string {
+	if record == nil || record.MimeType == "warc/revisit" {
+		return ""
+	}
+	return NormalizeDigest(record.Digest)
+}
+
+// DigestError ... Creates Error of KindDigest for payload of record with given digest
+func DigestError(record *CdxResponse, op, digest string) *Error {
+	err := NewError(KindDigest, op, record.Original, fmt.Errorf("payload digest %v, want=%v", digest, NormalizeDigest(record.Digest)))
+	if record.Source != nil {
+		err.Source = record.Source.Name()
+	}
+	return err
+}
+
+// VerifyDigest ... Checks payload, de-chunked but not decoded, against digest of the CDX record.
+// Records without SHA-1 digest and revisits are not checked.
+func VerifyDigest(record *CdxResponse, payload []byte) error {
+	want := recordDigest(record)
+	if want == "" {
+		return nil
+	}
+	if digest := PayloadDigest(payload); digest != want {
+		return DigestError(record, "VerifyDigest", digest)
+	}
+	return nil
+}
+
+// VerifyReplayDigest ... Checks payload of response of replay server, like Wayback id_ mode, against digest of the CDX record.
+// Responses which aren't the archived capture of the record are not checked, see IsReplayOf.
+func VerifyReplayDigest(record *CdxResponse, resp *Response) error {
+	// Body of missing capture is an archive error page
+	if resp.StatusCode != http.StatusOK && resp.Header.Get("Memento-Datetime") == "" {
+		return nil
+	}
+	if !IsReplayOf(record, resp.Header) {
+		return nil
+	}
+	return VerifyDigest(record, resp.Body)
+}
+
+// IsReplayOf ... Checks if replay response with header serves the capture of record.
+// Wayback compatible servers replay the nearest capture of the URL when the requested one cannot be served, e.g.
+// if its WARC is unavailable. Memento-Datetime of the response tells the date of the served capture, its payload
+// doesn't match the record digest. Responses without the date are assumed to be the capture.
+func IsReplayOf(record *CdxResponse, header http.Header) bool {
+	date, err := http.ParseTime(header.Get("Memento-Datetime"))
+	if err != nil {
+		return true
+	}
+	return strings.HasPrefix(date.UTC().Format(timestampLayout), record.Timestamp)
+}
+
+// VerifyHTTPDigest ... Checks payload of raw HTTP response, as stored in WARC response records, against digest of the CDX record
+func VerifyHTTPDigest(record *CdxResponse, message []byte) error {
+	if recordDigest(record) == "" {
+		return nil
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(message)), nil)
+	if err != nil {
+		return NewError(KindWARC, "VerifyDigest", record.Original, fmt.Errorf("Cannot parse HTTP response: %v", err))
+	}
+	defer resp.Body.Close()
+
+	// Truncated body is checked as is, it won't match
+	payload, _ := io.ReadAll(resp.Body)
+	return VerifyDigest(record, payload)
+}
+
+// VerifyBlockDigest ... Checks WARC record block against its WARC-Block-Digest header field, if it's SHA-1
+func VerifyBlockDigest(record *CdxResponse, warcHeader http.Header, block []byte) error {
+	want := NormalizeDigest(warcHeader.Get("WARC-Block-Digest"))
+	if want == "" {
+		return nil
+	}
+	if digest := PayloadDigest(block); digest != want {
+		return NewError(KindDigest, "VerifyDigest", record.Original, fmt.Errorf("block digest %v, want=%v", digest, want))
+	}
+	return nil
+}
+
+// digestReader ... Computes SHA-1 of the payload while it's read, returns Error of KindDigest instead of io.EOF on mismatch
+type digestReader struct {
+	io.ReadCloser
+	record *CdxResponse
+	want   string
+	hash   hash.Hash
+	err    error
+}
+
+// NewDigestReader ... Wraps payload stream, de-chunked but not decoded, to check it against digest of the CDX record.
+// Mismatch is returned from Read when the stream ends. Stream is returned as is if record cannot be checked.
+func NewDigestReader(record *CdxResponse, payload io.ReadCloser) io.ReadCloser {
+	want := recordDigest(record)
+	if want == "" {
+		return payload
+	}
+	return &digestReader{ReadCloser: payload, record: record, want: want, hash: sha1.New()}
+}
+
+func (r *digestReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+
+	if err == io.EOF {
+		if digest := base32.StdEncoding.EncodeToString(r.hash.Sum(nil)); digest != r.want {
+			err = DigestError(r.record, "VerifyDigest", digest)
+		}
+		r.err = err
+	}
+	return n, err
+}
+
+// RetryDigest ... Calls download again while it fails with digest mismatch, up to attempts times.
+// Other errors are returned at once.
+func RetryDigest(ctx context.Context, attempts int, download func() error) error {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		err = download()
+		if err == nil || !errors.Is(err, ErrDigestMismatch) || ctx.Err() != nil {
+			return err
+		}
+		log.Printf("Retrying download: %v", err)
+	}
+	return err
+}
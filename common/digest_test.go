@@ -0,0 +1,29 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestDigestReader(t *testing.T) {
+	payload := []byte("<html></html>")
+	record := &CdxResponse{Original: "http://kamaloff.ru/", Digest: "sha1:" + PayloadDigest(payload)}
+
+	data, err := io.ReadAll(NewDigestReader(record, io.NopCloser(bytes.NewReader(payload))))
+	if err != nil || !bytes.Equal(data, payload) {
+		t.Fatalf("Cannot read matching payload: %q, %v", data, err)
+	}
+
+	_, err = io.ReadAll(NewDigestReader(record, io.NopCloser(bytes.NewReader(payload[:5]))))
+	if !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("Expected digest mismatch error, got: %v", err)
+	}
+
+	// Revisits don't have payload to check
+	revisit := &CdxResponse{MimeType: "warc/revisit", Digest: record.Digest}
+	if err := VerifyDigest(revisit, nil); err != nil {
+		t.Fatalf("Revisit is verified: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrorKind ... Category of a failure, helps to decide whether to retry, skip or abort
+type ErrorKind int
+
+const (
+	KindUnknown          ErrorKind = iota // Uncategorized failure
+	KindRateLimited                       // Server asks to slow down: 429, 503
+	KindNotFound                          // No captures or file: 404
+	KindBlocked                           // Access to URL is blocked by archive: 403, 451
+	KindParse                             // Index response cannot be decoded
+	KindWARC                              // WARC record cannot be decoded
+	KindIndexUnavailable                  // Archive server is down or unreachable: 5xx, network errors
+	KindDigest                            // Downloaded payload doesn't match CDX digest, it's truncated or corrupted
+)
+
+// Sentinel errors matching Error of a corresponding kind with errors.Is
+var (
+	ErrRateLimited      = errors.New("rate limited")
+	ErrNotFound         = errors.New("not found")
+	ErrBlocked          = errors.New("blocked")
+	ErrParse            = errors.New("parse error")
+	ErrWARC             = errors.New("WARC decode error")
+	ErrIndexUnavailable = errors.New("index unavailable")
+	ErrDigestMismatch   = errors.New("digest mismatch")
+)
+
+var Status503Error = errors.New("Server returned 503 status response")
+var Status500Error = errors.New("Server returned 500 status response. (Slow down)")
+
+func (k ErrorKind) sentinel() error {
+	switch k {
+	case KindRateLimited:
+		return ErrRateLimited
+	case KindNotFound:
+		return ErrNotFound
+	case KindBlocked:
+		return ErrBlocked
+	case KindParse:
+		return ErrParse
+	case KindWARC:
+		return ErrWARC
+	case KindIndexUnavailable:
+		return ErrIndexUnavailable
+	case KindDigest:
+		return ErrDigestMismatch
+	}
+	return nil
+}
+
+func (k ErrorKind) String() string {
+	if err := k.sentinel(); err != nil {
+		return err.Error()
+	}
+	return "request failed"
+}
+
+// Temporary ... Reports whether the same request may succeed later
+func (k ErrorKind) Temporary() bool {
+	return k == KindRateLimited || k == KindIndexUnavailable
+}
+
+// Error ... Failure of an archive operation, use errors.As to get the details:
+//
+//	var archiveErr *common.Error
+//	if errors.As(err, &archiveErr) && archiveErr.Kind.Temporary() { ... }
+//
+// or errors.Is to check the kind:
+//
+//	errors.Is(err, common.ErrNotFound)
+type Error struct {
+	Kind   ErrorKind
+	Op     string // Operation that failed, like "GetPages"
+	Source string // Source name, like "Wayback"
+	URL    string // Requested URL
+	Page   int    // Index page number, -1 if not related to a page
+	Status int    // HTTP status code, 0 if there was no response
+	Err    error  // Underlying error
+
+	RetryAfter time.Duration // Delay requested by server with Retry-After header
+}
+
+// NewError ... Creates Error not related to an index page
+func NewError(kind ErrorKind, op, url string, err error) *Error {
+	return &Error{Kind: kind, Op: op, URL: url, Page: -1, Err: err}
+}
+
+// StatusError ... Creates Error of a kind corresponding to HTTP status code
+func StatusError(status int, url string) *Error {
+	kind := KindUnknown
+	switch {
+	case status == 429 || status == 503:
+		kind = KindRateLimited
+	case status == 404:
+		kind = KindNotFound
+	case status == 403 || status == 451:
+		kind = KindBlocked
+	case status >= 500:
+		kind = KindIndexUnavailable
+	}
+
+	err := NewError(kind, "GetRequest", url, nil)
+	err.Status = status
+	return err
+}
+
+// WrapError ... Attaches operation, source, URL and page to err.
+// Kind, status and URL are kept if err is already an Error.
+//
+//	page: index page number, -1 if not related to a page
+func WrapError(err error, op, source, url string, page int) error {
+	if err == nil {
+		return nil
+	}
+
+	var archiveErr *Error
+	if errors.As(err, &archiveErr) {
+		wrapped := *archiveErr
+		wrapped.Op, wrapped.Source, wrapped.Page = op, source, page
+		if wrapped.URL == "" {
+			wrapped.URL = url
+		}
+		return &wrapped
+	}
+
+	return &Error{Kind: KindUnknown, Op: op, Source: source, URL: url, Page: page, Err: err}
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	if e.Op != "" {
+		fmt.Fprintf(&b, "[%v] ", e.Op)
+	}
+	if e.Source != "" {
+		fmt.Fprintf(&b, "%v: ", e.Source)
+	}
+
+	b.WriteString(e.Kind.String())
+	if e.Status != 0 {
+		fmt.Fprintf(&b, " (status %v)", e.Status)
+	}
+	if e.Page >= 0 {
+		fmt.Fprintf(&b, ", page %v", e.Page)
+	}
+	if e.URL != "" {
+		fmt.Fprintf(&b, ", url %v", e.URL)
+	}
+	if e.Err != nil {
+		fmt.Fprintf(&b, ": %v", e.Err)
+	}
+	return b.String()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is ... Matches sentinel error of the kind, Status503Error and Status500Error by status code
+func (e *Error) Is(target error) bool {
+	switch target {
+	case nil:
+		return false
+	case e.Kind.sentinel():
+		return true
+	case Status503Error:
+		return e.Status == 503
+	case Status500Error:
+		return e.Status == 500
+	}
+	return false
+}
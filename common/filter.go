@@ -0,0 +1,148 @@
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Values of CDX fields records can be filtered and collapsed on, by CDX server names
+var cdxFields = map[string]func(*CdxResponse) string{
+	"urlkey":     func(r *CdxResponse) string { return r.Urlkey },
+	"timestamp":  func(r *CdxResponse) string { return r.Timestamp },
+	"original":   func(r *CdxResponse) string { return r.Original },
+	"mimetype":   func(r *CdxResponse) string { return r.MimeType },
+	"statuscode": func(r *CdxResponse) string { return r.StatusCode },
+	"digest":     func(r *CdxResponse) string { return r.Digest },
+	"length":     func(r *CdxResponse) string { return r.Length },
+}
+
+// Names of CdxResponse JSON fields used by Common Crawl
+var cdxAliases = map[string]string{
+	"url":    "original",
+	"mime":   "mimetype",
+	"status": "statuscode",
+}
+
+// RecordFilter ... CDX server filter applied on the client, for sources without a CDX server
+type RecordFilter struct {
+	Field  string
+	Negate bool
+	re     *regexp.Regexp
+}
+
+// ParseFilter ... Parses CDX server filter like "statuscode:200" or "!mimetype:text/.*".
+// Like on CDX server, the regular expression must match the whole field value.
+func ParseFilter(filter string) (*RecordFilter, error) {
+	negate := strings.HasPrefix(filter, "!")
+	field, expr, ok := strings.Cut(strings.TrimPrefix(filter, "!"), ":")
+	if !ok {
+		return nil, fmt.Errorf("Invalid filter '%v', use 'field:regex'", filter)
+	}
+
+	field = strings.ToLower(field)
+	if alias, ok := cdxAliases[field]; ok {
+		field = alias
+	}
+	if _, ok := cdxFields[field]; !ok {
+		return nil, fmt.Errorf("Unknown filter field '%v'", field)
+	}
+
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("Invalid filter '%v': %v", filter, err)
+	}
+	return &RecordFilter{Field: field, Negate: negate, re: re}, nil
+}
+
+// Match ... Reports whether record passes the filter
+func (f *RecordFilter) Match(res *CdxResponse) bool {
+	return f.re.MatchString(cdxFields[f.Field](res)) != f.Negate
+}
+
+// ConfigFilter ... Applies filters, date range, collapses and limit of config on the client, for sources without a CDX server.
+// Records must be passed in index order, like a CDX server returns them.
+type ConfigFilter struct {
+	filters   []*RecordFilter
+	from, to  string
+	collapser *Collapser
+	limit     uint
+	passed    uint
+}
+
+// NewConfigFilter ... Creates filter of records requested by config
+func NewConfigFilter(config RequestConfig) (*ConfigFilter, error) {
+	f := &ConfigFilter{limit: config.Limit}
+	for _, spec := range config.Filters {
+		if spec == "" {
+			continue
+		}
+		filter, err := ParseFilter(spec)
+		if err != nil {
+			return nil, err
+		}
+		f.filters = append(f.filters, filter)
+	}
+
+	collapses, err := ParseCollapses(config.CollapseSpecs())
+	if err != nil {
+		return nil, err
+	}
+	f.collapser = NewCollapser(collapses)
+
+	f.from = padDate(config.FromDate, '0')
+	f.to = padDate(config.ToDate, '9')
+	return f, nil
+}
+
+// Keep ... Reports whether record matches config and the limit is not reached yet
+func (f *ConfigFilter) Keep(res *CdxResponse) bool {
+	if f.Done() {
+		return false
+	}
+	if (f.from != "" && res.Timestamp < f.from) || (f.to != "" && res.Timestamp > f.to) {
+		return false
+	}
+	for _, filter := range f.filters {
+		if !filter.Match(res) {
+			return false
+		}
+	}
+	if !f.collapser.Keep(res) {
+		return false
+	}
+	f.passed++
+	return true
+}
+
+// Filter ... Returns records which are kept, reusing results slice
+func (f *ConfigFilter) Filter(results []*CdxResponse) []*CdxResponse {
+	kept := results[:0]
+	for _, res := range results {
+		if f.Keep(res) {
+			kept = append(kept, res)
+		}
+	}
+	return kept
+}
+
+// Done ... Reports whether config limit is reached
+func (f *ConfigFilter) Done() bool {
+	return f.limit != 0 && f.passed >= f.limit
+}
+
+// Pad date prefix like "2020" to 14 digits timestamp
+func padDate(date string, pad byte) string {
+	if date == "" || len(date) >= len(timestampLayout) {
+		return date
+	}
+	return date + strings.Repeat(string(pad), len(timestampLayout)-len(date))
+}
+
+const timestampLayout = "20060102150405"
+
+// FormatTimestamp ... Formats time as 14 digits CDX timestamp in UTC
+func FormatTimestamp(t time.Time) string {
+	return t.UTC().Format(timestampLayout)
+}
@@ -0,0 +1,265 @@
+package common
+
+import (
+	"context"
+	"io"
+)
+
+// PageFunc ... Returns the next batch of CDX records on every call.
+// Returns io.EOF (possibly together with the last batch) when there are no more pages.
+type PageFunc func(ctx context.Context) ([]*CdxResponse, error)
+
+// Iterator ... Pull-style iterator over CDX records returned by a Source:
+//
+//	it := source.Iterate(ctx, config)
+//	defer it.Close()
+//	for it.Next() {
+//		fmt.Println(it.Record().Original)
+//	}
+//	if err := it.Err(); err != nil { ... }
+type Iterator struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	next   PageFunc
+	batch  []*CdxResponse
+	page   []*CdxResponse
+	record *CdxResponse
+	err    error
+	done   bool
+}
+
+// NewIterator ... Creates iterator which fetches records batch by batch using next.
+// Iteration stops when ctx is done.
+func NewIterator(ctx context.Context, next PageFunc) *Iterator {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Iterator{ctx: ctx, cancel: cancel, next: next}
+}
+
+// Next ... Advances to the next record, returns false when iteration is over or failed
+func (it *Iterator) Next() bool {
+	for len(it.batch) == 0 {
+		if it.done {
+			it.record = nil
+			return false
+		}
+
+		if err := it.ctx.Err(); err != nil {
+			it.finish(err)
+			continue
+		}
+
+		batch, err := it.next(it.ctx)
+		it.batch = batch
+		if err == io.EOF {
+			it.finish(nil)
+		} else if err != nil {
+			it.batch = nil
+			it.finish(err)
+		}
+	}
+
+	it.record, it.batch = it.batch[0], it.batch[1:]
+	return true
+}
+
+// NextPage ... Advances to the next batch of records as returned by the source, or to the rest of the current one
+// if Next was called. Returns false when iteration is over or failed. Record is the last record of the page.
+func (it *Iterator) NextPage() bool {
+	if !it.Next() {
+		it.page = nil
+		return false
+	}
+	it.page = append([]*CdxResponse{it.record}, it.batch...)
+	it.record, it.batch = it.page[len(it.page)-1], nil
+	return true
+}
+
+// Page ... Returns the current page, valid after NextPage returned true
+func (it *Iterator) Page() []*CdxResponse {
+	return it.page
+}
+
+// Record ... Returns the current record, valid after Next returned true
+func (it *Iterator) Record() *CdxResponse {
+	return it.record
+}
+
+// Err ... Returns the error which stopped iteration, nil if all records were consumed or iterator was closed
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close ... Stops iteration and releases resources. Safe to call multiple times.
+func (it *Iterator) Close() {
+	it.cancel()
+	it.done = true
+	it.batch, it.page = nil, nil
+}
+
+func (it *Iterator) finish(err error) {
+	it.done = true
+	if it.err == nil {
+		it.err = err
+	}
+	it.cancel()
+}
+
+// NewPager ... Creates PageFunc going through numbered pages of CDX server index.
+// Stops after the page on which config.Limit results were reached.
+// If config.Checkpoint is set, starts from its page and saves progress once records of a page are consumed,
+// i.e. when the next batch is requested. Checkpoint is completed when all pages are done.
+//
+//	numPages: returns number of pages for a query, not called for SinglePage configs
+//	getPage: returns parsed results of a given page
+func NewPager(config RequestConfig, numPages func(ctx context.Context) (int, error), getPage func(ctx context.Context, page int) ([]*CdxResponse, error)) PageFunc {
+	pages := -1
+	page := 0
+	numResults := 0
+	pending := false // Records of the previous page were returned, but not marked as consumed yet
+
+	cp := config.Checkpoint
+	if cp != nil {
+		page, numResults = cp.NextPage, cp.Results
+	}
+
+	return func(ctx context.Context) ([]*CdxResponse, error) {
+		if pending {
+			pending = false
+			if err := cp.PageDone(page, numResults); err != nil {
+				return nil, err
+			}
+		}
+
+		if pages < 0 {
+			if config.SinglePage {
+				pages = 1
+			} else {
+				var err error
+				if pages, err = numPages(ctx); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if page >= pages || (config.Limit != 0 && uint(numResults) >= config.Limit) {
+			if cp != nil {
+				if err := cp.Complete(); err != nil {
+					return nil, err
+				}
+			}
+			return nil, io.EOF
+		}
+
+		results, err := getPage(ctx, page)
+		if err != nil {
+			return nil, err
+		}
+		page++
+		numResults += len(results)
+
+		// With checkpoint, EOF is returned on the next call, after the last page is saved as consumed
+		if cp != nil {
+			pending = true
+			return results, nil
+		}
+
+		if page >= pages || (config.Limit != 0 && uint(numResults) >= config.Limit) {
+			page = pages
+			return results, io.EOF
+		}
+		return results, nil
+	}
+}
+
+// NewResumePager ... Creates PageFunc going through batches of CDX server results linked by resume keys.
+// Stops when the server returns no resume key or config.Limit results were reached.
+// Progress is saved to config.Checkpoint same way as in NewPager.
+//
+//	getBatch: returns parsed results starting at resumeKey (from the beginning if empty) and the key of the next batch
+func NewResumePager(config RequestConfig, getBatch func(ctx context.Context, resumeKey string) ([]*CdxResponse, string, error)) PageFunc {
+	resumeKey := ""
+	numResults := 0
+	done := false
+	pending := false // Records of the previous batch were returned, but not marked as consumed yet
+
+	cp := config.Checkpoint
+	if cp != nil {
+		resumeKey, numResults = cp.ResumeKey, cp.Results
+	}
+
+	return func(ctx context.Context) ([]*CdxResponse, error) {
+		if pending {
+			pending = false
+			if err := cp.ResumeKeyDone(resumeKey, numResults); err != nil {
+				return nil, err
+			}
+		}
+
+		if done || (config.Limit != 0 && uint(numResults) >= config.Limit) {
+			if cp != nil {
+				if err := cp.Complete(); err != nil {
+					return nil, err
+				}
+			}
+			return nil, io.EOF
+		}
+
+		results, nextKey, err := getBatch(ctx, resumeKey)
+		if err != nil {
+			return nil, err
+		}
+		resumeKey = nextKey
+		numResults += len(results)
+		done = nextKey == ""
+
+		if cp != nil {
+			pending = true
+			return results, nil
+		}
+
+		if done || (config.Limit != 0 && uint(numResults) >= config.Limit) {
+			done = true
+			return results, io.EOF
+		}
+		return results, nil
+	}
+}
+
+// Collect ... Reads all records from iterator
+func Collect(it *Iterator) ([]*CdxResponse, error) {
+	defer it.Close()
+
+	var results []*CdxResponse
+	for it.Next() {
+		results = append(results, it.Record())
+	}
+	return results, it.Err()
+}
+
+// FetchPages ... Sends batches returned by next into results channel and a failure into errors channel.
+// Returns when pages are over, on the first error or when ctx is done.
+func FetchPages(ctx context.Context, next PageFunc, results chan []*CdxResponse, errors chan error) {
+	for ctx.Err() == nil {
+		batch, err := next(ctx)
+
+		if len(batch) > 0 {
+			select {
+			case results <- batch:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if err == io.EOF {
+			return
+		}
+
+		if err != nil {
+			select {
+			case errors <- err:
+			case <-ctx.Done():
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package common
+
+import (
+	"context"
+	"io"
+	"testing"
+)
+
+func TestIteratorPages(t *testing.T) {
+	pages := [][]*CdxResponse{
+		{{Timestamp: "1"}, {Timestamp: "2"}, {Timestamp: "3"}},
+		{{Timestamp: "4"}},
+	}
+	next := func(ctx context.Context) ([]*CdxResponse, error) {
+		if len(pages) == 0 {
+			return nil, io.EOF
+		}
+		page := pages[0]
+		pages = pages[1:]
+		return page, nil
+	}
+
+	it := NewIterator(context.Background(), next)
+	defer it.Close()
+
+	// Page continues after records consumed by Next
+	if !it.Next() || it.Record().Timestamp != "1" {
+		t.Fatalf("Incorrect first record: %v", it.Record())
+	}
+	if !it.NextPage() || len(it.Page()) != 2 || it.Page()[0].Timestamp != "2" || it.Record().Timestamp != "3" {
+		t.Fatalf("Incorrect rest of the first page: %v", it.Page())
+	}
+	if !it.NextPage() || len(it.Page()) != 1 || it.Page()[0].Timestamp != "4" {
+		t.Fatalf("Incorrect second page: %v", it.Page())
+	}
+	if it.NextPage() || it.Page() != nil || it.Err() != nil {
+		t.Fatalf("Pages are not over: %v, %v", it.Page(), it.Err())
+	}
+}
@@ -0,0 +1,186 @@
+package common
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MergeOptions ... Configures deduplication of records from several sources.
+// Records with the same normalized urlkey and timestamp are always duplicates.
+type MergeOptions struct {
+	ByDigest bool          // Records of the same urlkey and digest are duplicates
+	Window   time.Duration // Records of the same urlkey closer in time than Window are duplicates, 0 to disable
+	Sort     bool          // Output records chronologically. All records are kept until input is closed.
+}
+
+// Merger ... Deduplicates records and collects names of the sources which have each capture. Safe to use from multiple workers.
+type Merger struct {
+	opts MergeOptions
+
+	mu       sync.Mutex
+	captures map[string]*CdxResponse    // Kept records by urlkey and timestamp, or digest
+	byURL    map[string][]*mergedRecord // Kept records of urlkey sorted by time, for window deduplication
+}
+
+type mergedRecord struct {
+	time   time.Time
+	record *CdxResponse
+}
+
+// NewMerger ... Creates merger with given deduplication options
+func NewMerger(opts MergeOptions) *Merger {
+	return &Merger{
+		opts:     opts,
+		captures: map[string]*CdxResponse{},
+		byURL:    map[string][]*mergedRecord{},
+	}
+}
+
+// Add ... Reports whether record is not a duplicate of the records added before.
+// Source of a duplicate is added to Sources of the kept record, so Sources must not be read concurrently with Add.
+func (m *Merger) Add(res *CdxResponse) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	urlkey := NormalizeUrlkey(res)
+	keys := []string{urlkey + " " + res.Timestamp}
+	if digest := NormalizeDigest(res.Digest); m.opts.ByDigest && digest != "" {
+		keys = append(keys, urlkey+" sha1:"+digest)
+	}
+
+	for _, key := range keys {
+		if kept, ok := m.captures[key]; ok {
+			addSource(kept, res)
+			return false
+		}
+	}
+
+	captured, err := time.Parse("20060102150405", res.Timestamp)
+	if m.opts.Window > 0 && err == nil {
+		if kept := m.nearest(urlkey, captured); kept != nil {
+			addSource(kept, res)
+			return false
+		}
+		m.insert(urlkey, captured, res)
+	}
+
+	addSource(res, res)
+	for _, key := range keys {
+		m.captures[key] = res
+	}
+	return true
+}
+
+// Kept record of urlkey captured within window from t
+func (m *Merger) nearest(urlkey string, t time.Time) *CdxResponse {
+	kept := m.byURL[urlkey]
+	i := sort.Search(len(kept), func(i int) bool { return !kept[i].time.Before(t) })
+
+	for _, j := range []int{i - 1, i} {
+		if j < 0 || j >= len(kept) {
+			continue
+		}
+		diff := kept[j].time.Sub(t)
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff <= m.opts.Window {
+			return kept[j].record
+		}
+	}
+	return nil
+}
+
+func (m *Merger) insert(urlkey string, t time.Time, res *CdxResponse) {
+	kept := m.byURL[urlkey]
+	i := sort.Search(len(kept), func(i int) bool { return !kept[i].time.Before(t) })
+	kept = append(kept, nil)
+	copy(kept[i+1:], kept[i:])
+	kept[i] = &mergedRecord{time: t, record: res}
+	m.byURL[urlkey] = kept
+}
+
+func addSource(kept, res *CdxResponse) {
+	if res.Source == nil {
+		return
+	}
+	name := res.Source.Name()
+	for _, source := range kept.Sources {
+		if source == name {
+			return
+		}
+	}
+	kept.Sources = append(kept.Sources, name)
+}
+
+// Merge ... Returns channel of records from in without duplicates, closed after in is closed or ctx is done.
+// Unsorted records are passed on at once, their Sources list only sources seen before.
+// Sorted records are sent after in is closed, with all sources in Sources.
+func Merge(ctx context.Context, in <-chan *CdxResponse, opts MergeOptions) <-chan *CdxResponse {
+	out := make(chan *CdxResponse)
+	merger := NewMerger(opts)
+
+	send := func(res *CdxResponse) bool {
+		select {
+		case out <- res:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	go func() {
+		defer close(out)
+
+		var kept []*CdxResponse
+		for res := range in {
+			if !merger.Add(res) {
+				continue
+			}
+
+			if opts.Sort {
+				kept = append(kept, res)
+				continue
+			}
+
+			// Sent record is not changed by merger anymore
+			sent := *res
+			sent.Sources = append([]string{}, res.Sources...)
+			if !send(&sent) {
+				return
+			}
+		}
+
+		SortRecords(kept)
+		for _, res := range kept {
+			if !send(res) {
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// SortRecords ... Sorts records chronologically, then by urlkey and source
+func SortRecords(records []*CdxResponse) {
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.Timestamp != b.Timestamp {
+			return a.Timestamp < b.Timestamp
+		}
+		if ka, kb := NormalizeUrlkey(a), NormalizeUrlkey(b); ka != kb {
+			return ka < kb
+		}
+		return sourceName(a) < sourceName(b)
+	})
+}
+
+func sourceName(res *CdxResponse) string {
+	if res.Source == nil {
+		return ""
+	}
+	return res.Source.Name()
+}
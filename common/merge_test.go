@@ -0,0 +1,79 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Source stub with only a name
+type namedSource struct {
+	Source
+	name string
+}
+
+func (s namedSource) Name() string { return s.name }
+
+var wb, cc = namedSource{name: "Wayback"}, namedSource{name: "CommonCrawl"}
+
+func TestSURT(t *testing.T) {
+	tests := map[string]string{
+		"http://www.Example.com:80/Path?b=2&a=1#top": "com,example)/path?a=1&b=2",
+		"https://blog.example.com":                   "com,example,blog)/",
+		"example.com:8080/index.html":                "com,example:8080)/index.html",
+	}
+	for url, want := range tests {
+		if got := SURT(url); got != want {
+			t.Fatalf("Incorrect SURT of %v: %v, want=%v", url, got, want)
+		}
+	}
+
+	if got := NormalizeUrlkey(&CdxResponse{Urlkey: "http://(com,example,www,)/Path"}); got != "com,example)/path" {
+		t.Fatalf("Incorrect normalized urlkey: %v", got)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	records := []*CdxResponse{
+		{Urlkey: "com,example)/", Timestamp: "20200102000000", Digest: "AAA", Source: wb},
+		{Urlkey: "com,example)/", Timestamp: "20200101000000", Digest: "BBB", Source: wb},
+		{Urlkey: "com,example)/", Timestamp: "20200102000000", Digest: "AAA", Source: cc}, // same capture
+		{Urlkey: "com,example)/", Timestamp: "20200103000000", Digest: "AAA", Source: cc}, // same digest
+		{Original: "https://www.example.com/about", Timestamp: "20200101000000", Source: cc},
+	}
+
+	run := func(opts MergeOptions) []*CdxResponse {
+		in := make(chan *CdxResponse, len(records))
+		for _, res := range records {
+			copied := *res
+			in <- &copied
+		}
+		close(in)
+
+		var out []*CdxResponse
+		for res := range Merge(context.Background(), in, opts) {
+			out = append(out, res)
+		}
+		return out
+	}
+
+	if out := run(MergeOptions{}); len(out) != 4 {
+		t.Fatalf("Incorrect number of records merged by timestamp: %v, want=4", len(out))
+	}
+
+	out := run(MergeOptions{ByDigest: true, Sort: true})
+	if len(out) != 3 {
+		t.Fatalf("Incorrect number of records merged by digest: %v, want=3", len(out))
+	}
+	if out[0].Timestamp != "20200101000000" || out[2].Timestamp != "20200102000000" {
+		t.Fatalf("Records are not sorted: %v, %v", out[0].Timestamp, out[2].Timestamp)
+	}
+	if len(out[2].Sources) != 2 || out[2].Sources[0] != "Wayback" || out[2].Sources[1] != "CommonCrawl" {
+		t.Fatalf("Incorrect sources of merged capture: %v", out[2].Sources)
+	}
+
+	// Captures of "/" within a day of each other
+	if out := run(MergeOptions{Window: 24 * time.Hour}); len(out) != 2 {
+		t.Fatalf("Incorrect number of records merged by window: %v, want=2", len(out))
+	}
+}
@@ -0,0 +1,226 @@
+package common
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minAdaptiveRate   = 1.0 / 60 // Lowest rate the limiter slows down to, one request per minute
+	startAdaptiveRate = 1.0      // Rate of hosts without configured rate after they ask to slow down
+	maxAdaptiveRate   = 50.0     // Hosts without configured rate are unlimited again when restored rate reaches it
+)
+
+// RateLimiter ... Per host token bucket rate limiter, safe to share between workers.
+// Rate of a host is halved every time the server asks to slow down
+// and gradually restored to the configured value on successful requests.
+// Hosts without rate are limited to startAdaptiveRate when they ask to slow down, until the rate is restored.
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // Requests per second for hosts without own rate, 0 means unlimited
+	burst   int
+	rates   map[string]float64
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	maxRate float64   // Configured rate
+	rate    float64   // Current rate
+	tokens  float64   // Available requests, negative when requests are queued
+	last    time.Time // Last refill time
+	pause   time.Time // No requests until this time, set by Retry-After
+}
+
+// NewRateLimiter ... Creates limiter with default rate for all hosts
+//
+//	rps: requests per second, 0 means unlimited
+//	burst: max number of requests made at once
+func NewRateLimiter(rps float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:    rps,
+		burst:   burst,
+		rates:   map[string]float64{},
+		buckets: map[string]*bucket{},
+	}
+}
+
+// SetHostRate ... Sets rate of a host, overrides default rate
+//
+//	host: host name like "web.archive.org", or URL to take host from
+func (l *RateLimiter) SetHostRate(host string, rps float64) {
+	host = hostOf(host)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rates[host] = rps
+	delete(l.buckets, host)
+}
+
+func (l *RateLimiter) bucket(host string, now time.Time) *bucket {
+	b, ok := l.buckets[host]
+	if !ok {
+		rate, ok := l.rates[host]
+		if !ok {
+			rate = l.rate
+		}
+		b = &bucket{maxRate: rate, rate: rate, tokens: float64(l.burst), last: now}
+		l.buckets[host] = b
+	}
+
+	if b.rate > 0 {
+		b.tokens = math.Min(float64(l.burst), b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	return b
+}
+
+// Wait ... Blocks until request to host is allowed or ctx is done.
+// A nil limiter allows all requests.
+func (l *RateLimiter) Wait(ctx context.Context, host string) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	b := l.bucket(host, now)
+
+	var delay time.Duration
+	if b.pause.After(now) {
+		delay = b.pause.Sub(now)
+	}
+	if b.rate > 0 {
+		// Reserve a token, requests queue up when tokens go below zero
+		b.tokens--
+		if b.tokens < 0 {
+			delay += time.Duration(-b.tokens / b.rate * float64(time.Second))
+		}
+	}
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Throttle ... Slows down requests to host after it responded with rate limit error.
+// Rate is halved, or set to startAdaptiveRate for unlimited host, and no requests are allowed during retryAfter.
+func (l *RateLimiter) Throttle(host string, retryAfter time.Duration) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b := l.bucket(host, now)
+	switch {
+	case b.rate == 0:
+		// Queued requests are spread from the end of pause
+		b.rate, b.tokens = startAdaptiveRate, 0
+	case b.maxRate == 0:
+		b.rate = math.Max(b.rate/2, minAdaptiveRate)
+	default:
+		b.rate = math.Max(b.rate/2, math.Min(b.maxRate, minAdaptiveRate))
+	}
+	if pause := now.Add(retryAfter); pause.After(b.pause) {
+		b.pause = pause
+	}
+}
+
+// Success ... Restores rate of host after successful request
+func (l *RateLimiter) Success(host string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.bucket(host, time.Now())
+	switch {
+	case b.rate > 0 && b.maxRate == 0:
+		if b.rate *= 1.1; b.rate >= maxAdaptiveRate {
+			b.rate = 0
+		}
+	case b.rate > 0 && b.rate < b.maxRate:
+		b.rate = math.Min(b.maxRate, b.rate*1.1)
+	}
+}
+
+// Backoff ... Exponential backoff with jitter between request retries
+type Backoff struct {
+	Base time.Duration // Delay before the first retry
+	Max  time.Duration // Max delay between retries
+}
+
+// DefaultBackoff ... Backoff used by Client if no other is set
+var DefaultBackoff = Backoff{Base: 2 * time.Second, Max: time.Minute}
+
+// Delay ... Returns delay before retry number attempt (starting from 0).
+// Server provided retryAfter is honored if it is longer than computed delay.
+func (b Backoff) Delay(attempt int, retryAfter time.Duration) time.Duration {
+	delay := b.Max
+	if attempt < 32 && b.Base<<attempt < b.Max && b.Base<<attempt > 0 {
+		delay = b.Base << attempt
+	}
+
+	// Random delay in [delay/2, delay) spreads retries of concurrent workers
+	if half := int64(delay / 2); half > 0 {
+		delay = time.Duration(half + rand.Int63n(half))
+	}
+
+	if retryAfter > delay {
+		return retryAfter
+	}
+	return delay
+}
+
+// ParseRetryAfter ... Parses Retry-After header value: seconds or HTTP date. Returns 0 if value is invalid.
+func ParseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if d := time.Until(date); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// Returns host of URL, or the value itself if it's not a URL
+func hostOf(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+		return u.Hostname()
+	}
+	return rawURL
+}
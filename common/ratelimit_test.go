@@ -0,0 +1,102 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterWait(t *testing.T) {
+	limiter := NewRateLimiter(0, 1)
+	limiter.SetHostRate("https://web.archive.org/cdx/search/cdx", 20)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := limiter.Wait(context.Background(), "web.archive.org"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// First request uses the burst token, others wait 50ms each
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Fatalf("Requests weren't limited, took %v", elapsed)
+	}
+
+	// Hosts without own rate are unlimited
+	start = time.Now()
+	for i := 0; i < 100; i++ {
+		limiter.Wait(context.Background(), "index.commoncrawl.org")
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("Unlimited host was limited, took %v", elapsed)
+	}
+}
+
+func TestRateLimiterThrottle(t *testing.T) {
+	limiter := NewRateLimiter(10, 1)
+	limiter.Throttle("example.com", 100*time.Millisecond)
+	limiter.Throttle("example.com", 0)
+
+	if rate := limiter.buckets["example.com"].rate; rate != 2.5 {
+		t.Fatalf("Rate wasn't halved twice: %v", rate)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := limiter.Wait(ctx, "example.com"); err != context.DeadlineExceeded {
+		t.Fatalf("Retry-After pause wasn't respected: %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		limiter.Success("example.com")
+	}
+	if rate := limiter.buckets["example.com"].rate; rate != 10 {
+		t.Fatalf("Rate wasn't restored: %v", rate)
+	}
+
+	// Unlimited host is limited after it asks to slow down, until the rate is restored
+	limiter = NewRateLimiter(0, 1)
+	limiter.Throttle("example.org", 0)
+	limiter.Throttle("example.org", 0)
+	if rate := limiter.buckets["example.org"].rate; rate != startAdaptiveRate/2 {
+		t.Fatalf("Rate of unlimited host wasn't limited: %v", rate)
+	}
+
+	for i := 0; i < 100; i++ {
+		limiter.Success("example.org")
+	}
+	if rate := limiter.buckets["example.org"].rate; rate != 0 {
+		t.Fatalf("Rate of unlimited host wasn't restored: %v", rate)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	backoff := Backoff{Base: time.Second, Max: 10 * time.Second}
+
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		delay := backoff.Delay(attempt, 0)
+		if delay < max/2 || delay >= max {
+			t.Fatalf("Delay of attempt %v is out of range: %v", attempt, delay)
+		}
+	}
+
+	if delay := backoff.Delay(0, 30*time.Second); delay != 30*time.Second {
+		t.Fatalf("Retry-After wasn't honored: %v", delay)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d := ParseRetryAfter("120"); d != 2*time.Minute {
+		t.Fatalf("Incorrect delay: %v", d)
+	}
+
+	date := time.Now().Add(time.Hour).UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT")
+	if d := ParseRetryAfter(date); d < 59*time.Minute || d > time.Hour {
+		t.Fatalf("Incorrect delay: %v", d)
+	}
+
+	if d := ParseRetryAfter("soon"); d != 0 {
+		t.Fatalf("Incorrect delay: %v", d)
+	}
+}
@@ -0,0 +1,78 @@
+package common
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// SURT ... Converts URL to Sort-friendly URI Reordering Transform form used by CDX servers as urlkey:
+// "http://www.Example.com:80/Path?b=2&a=1#top" -> "com,example)/path?a=1&b=2".
+// Scheme, "www" prefix, default port, user info and fragment are dropped, query parameters are sorted.
+func SURT(rawURL string) string {
+	raw := strings.TrimSpace(strings.ToLower(rawURL))
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return raw
+	}
+
+	host := strings.TrimSuffix(u.Hostname(), ".")
+	labels := strings.Split(trimWWW(host), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	host = strings.Join(labels, ",")
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host += ":" + port
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	key := host + ")" + path
+	if u.RawQuery != "" {
+		params := strings.Split(u.RawQuery, "&")
+		sort.Strings(params)
+		key += "?" + strings.Join(params, "&")
+	}
+	return key
+}
+
+// NormalizeUrlkey ... Returns comparable form of record urlkey, computed from the original URL if urlkey is missing.
+// Sources differ in case and may keep scheme like "http://(com,example,)/".
+func NormalizeUrlkey(res *CdxResponse) string {
+	key := strings.ToLower(strings.TrimSpace(res.Urlkey))
+	if key == "" {
+		return SURT(res.Original)
+	}
+
+	if i := strings.Index(key, "://("); i >= 0 {
+		key = key[i+4:]
+		key = strings.Replace(key, ",)", ")", 1)
+	}
+	if host, path, ok := strings.Cut(key, ")"); ok {
+		host = strings.TrimSuffix(host, ",www")
+		key = host + ")" + path
+	}
+	return key
+}
+
+// Drop "www", "www2" and similar first label
+func trimWWW(host string) string {
+	label, rest, ok := strings.Cut(host, ".")
+	if !ok || !strings.HasPrefix(label, "www") || !strings.Contains(rest, ".") {
+		return host
+	}
+	for _, c := range label[3:] {
+		if c < '0' || c > '9' {
+			return host
+		}
+	}
+	return rest
+}
@@ -1,10 +1,16 @@
 package commoncrawl
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	jsoniter "github.com/json-iterator/go"
 	common "github.com/karust/gogetcrawl/common"
@@ -20,6 +26,20 @@ type latestIndex struct {
 	Name     string `json:"name"`
 	Timegate string `json:"timegate"`
 	CdxAPI   string `json:"cdx-api"`
+	From     string `json:"from,omitempty"` // Crawl start, like "2023-03-20T08:35:13"
+	To       string `json:"to,omitempty"`   // Crawl end
+}
+
+// Crawl dates in CDX timestamp format, empty if not listed
+func (index latestIndex) dates() (from, to string) {
+	const layout = "2006-01-02T15:04:05"
+	if t, err := time.Parse(layout, index.From); err == nil {
+		from = t.Format("20060102150405")
+	}
+	if t, err := time.Parse(layout, index.To); err == nil {
+		to = t.Format("20060102150405")
+	}
+	return from, to
 }
 
 // ex: http://index.commoncrawl.org/CC-MAIN-2015-11-index?url=*.wikipedia.org/&showNumPages=true
@@ -30,13 +50,52 @@ type numPagesResponse struct {
 }
 
 type CommonCrawl struct {
-	MaxTimeout int           // Request timeout
-	MaxRetries int           // Max number of request retries if timeouted
-	indexes    []latestIndex // CDX Indexes versions cache
+	MaxTimeout   int            // Request timeout
+	MaxRetries   int            // Max number of request retries if timeouted
+	indexes      []latestIndex  // CDX Indexes versions cache
+	client       *common.Client // HTTP client, common.DefaultClient if nil
+	indexServer  string         // Index server URL ending with slash, INDEX_SERVER by default
+	crawlStorage string         // WARC files storage URL ending with slash, CRAWL_STORAGE by default
 }
 
-func New(timeout, retries int) (*CommonCrawl, error) {
-	source := &CommonCrawl{MaxTimeout: timeout, MaxRetries: retries}
+// Option ... Configures CommonCrawl source in New
+type Option func(*CommonCrawl)
+
+// WithClient ... Sets HTTP client, can be shared with other sources
+func WithClient(client *common.Client) Option {
+	return func(cc *CommonCrawl) {
+		cc.client = client
+	}
+}
+
+// WithIndexServer ... Sets index server URL serving collinfo.json and <index>-index CDX APIs
+//
+//	url: like "http://localhost:8080/"
+func WithIndexServer(url string) Option {
+	return func(cc *CommonCrawl) {
+		cc.indexServer = strings.TrimRight(url, "/") + "/"
+	}
+}
+
+// WithCrawlStorage ... Sets URL of WARC files storage, files are requested as <url>/<filename>
+//
+//	url: like "http://localhost:8080/", local copy of crawl-data/ should be served under it
+func WithCrawlStorage(url string) Option {
+	return func(cc *CommonCrawl) {
+		cc.crawlStorage = strings.TrimRight(url, "/") + "/"
+	}
+}
+
+func New(timeout, retries int, opts ...Option) (*CommonCrawl, error) {
+	source := &CommonCrawl{
+		MaxTimeout:   timeout,
+		MaxRetries:   retries,
+		indexServer:  INDEX_SERVER,
+		crawlStorage: CRAWL_STORAGE,
+	}
+	for _, opt := range opts {
+		opt(source)
+	}
 
 	// Cache latest indexes to not overload the server
 	var err error
@@ -54,15 +113,38 @@ func (CommonCrawl) Name() string {
 
 // Get latest CDX indexes from http://index.commoncrawl.org/collinfo.json
 func (cc *CommonCrawl) GetIndexes() ([]latestIndex, error) {
-	response, err := common.Get(INDEX_SERVER+"/collinfo.json", cc.MaxTimeout, cc.MaxRetries)
+	return cc.GetIndexesContext(context.Background())
+}
+
+// GetIndexesContext ... Same as GetIndexes, but request is aborted when ctx is done
+func (cc *CommonCrawl) GetIndexesContext(ctx context.Context) ([]latestIndex, error) {
+	response, err := cc.client.Get(ctx, cc.indexServer+"collinfo.json", cc.MaxTimeout, cc.MaxRetries)
 	if err != nil {
-		return nil, fmt.Errorf("[GetIndexIDs] response read error: %v", err)
+		return nil, common.WrapError(err, "GetIndexes", cc.Name(), cc.indexServer+"collinfo.json", -1)
 	}
 
 	latestIndexes := []latestIndex{}
 	err = jsoniter.Unmarshal(response, &latestIndexes)
 	if err != nil {
-		return latestIndexes, fmt.Errorf("[GetIndexIDs] Cannot get latest index ID: %v", err)
+		return latestIndexes, &common.Error{
+			Kind:   common.KindParse,
+			Op:     "GetIndexes",
+			Source: cc.Name(),
+			URL:    cc.indexServer + "collinfo.json",
+			Page:   -1,
+			Err:    fmt.Errorf("Cannot get latest index ID: %v", err),
+		}
+	}
+
+	if len(latestIndexes) == 0 {
+		return nil, &common.Error{
+			Kind:   common.KindIndexUnavailable,
+			Op:     "GetIndexes",
+			Source: cc.Name(),
+			URL:    cc.indexServer + "collinfo.json",
+			Page:   -1,
+			Err:    fmt.Errorf("No indexes listed"),
+		}
 	}
 
 	return latestIndexes, nil
@@ -72,17 +154,29 @@ func (cc *CommonCrawl) GetIndexes() ([]latestIndex, error) {
 //
 //	index: needs to be set manually here like "CC-MAIN-2023-14"
 func (cc *CommonCrawl) GetNumPagesIndex(url, index string) (int, error) {
-	requestURI := fmt.Sprintf("%v%v-index?url=%v&showNumPages=true", INDEX_SERVER, index, url)
+	return cc.GetNumPagesIndexContext(context.Background(), url, index)
+}
+
+// GetNumPagesIndexContext ... Same as GetNumPagesIndex, but request is aborted when ctx is done
+func (cc *CommonCrawl) GetNumPagesIndexContext(ctx context.Context, url, index string) (int, error) {
+	requestURI := fmt.Sprintf("%v%v-index?url=%v&showNumPages=true", cc.indexServer, index, url)
 
-	response, err := common.Get(requestURI, cc.MaxTimeout, cc.MaxRetries)
+	response, err := cc.client.Get(ctx, requestURI, cc.MaxTimeout, cc.MaxRetries)
 	if err != nil {
-		return 0, fmt.Errorf("[GetNumPagesIndex] Request error: %v", err)
+		return 0, common.WrapError(err, "GetNumPagesIndex", cc.Name(), requestURI, -1)
 	}
 
 	numPagesResp := numPagesResponse{}
 	err = jsoniter.Unmarshal(response, &numPagesResp)
 	if err != nil {
-		return 0, fmt.Errorf("[GetNumPagesIndex] JSON decode error: %v", err)
+		return 0, &common.Error{
+			Kind:   common.KindParse,
+			Op:     "GetNumPagesIndex",
+			Source: cc.Name(),
+			URL:    requestURI,
+			Page:   -1,
+			Err:    fmt.Errorf("JSON decode error: %v", err),
+		}
 	}
 
 	return numPagesResp.Pages, nil
@@ -91,7 +185,12 @@ func (cc *CommonCrawl) GetNumPagesIndex(url, index string) (int, error) {
 // Returns the number of pages located in CommonCrawl for given url
 // Use latest index from http://index.commoncrawl.org/collinfo.json
 func (cc *CommonCrawl) GetNumPages(url string) (int, error) {
-	return cc.GetNumPagesIndex(url, cc.indexes[0].Id)
+	return cc.GetNumPagesContext(context.Background(), url)
+}
+
+// GetNumPagesContext ... Same as GetNumPages, but request is aborted when ctx is done
+func (cc *CommonCrawl) GetNumPagesContext(ctx context.Context, url string) (int, error) {
+	return cc.GetNumPagesIndexContext(ctx, url, cc.indexes[0].Id)
 }
 
 // Parse response from http://index.commoncrawl.org/[Index Version]-index index server
@@ -99,14 +198,14 @@ func (cc *CommonCrawl) ParseResponse(resp []byte) ([]*common.CdxResponse, error)
 	pages := []*common.CdxResponse{}
 
 	if len(resp) == 0 {
-		return nil, fmt.Errorf("Empty response provided")
+		return nil, common.NewError(common.KindParse, "ParseResponse", "", fmt.Errorf("Empty response provided"))
 	}
 
 	// Parse the response that contains JSON objects separated with new line
 	for _, line := range bytes.Split(resp[:len(resp)-1], []byte{'\n'}) {
 		var indexVal common.CdxResponse
 		if err := jsoniter.Unmarshal(line, &indexVal); err != nil {
-			return nil, fmt.Errorf("[ParseResponse] Cannot decode JSON line: %v. Response: %v", err, string(line))
+			return nil, common.NewError(common.KindParse, "ParseResponse", "", fmt.Errorf("Cannot decode JSON line: %v. Response: %v", err, string(line)))
 		}
 		indexVal.Source = cc
 		pages = append(pages, &indexVal)
@@ -115,128 +214,408 @@ func (cc *CommonCrawl) ParseResponse(resp []byte) ([]*common.CdxResponse, error)
 	return pages, nil
 }
 
-// GetPagesIndex ... Makes request to WebArchive index API to gather all url observations
-//
-//	index: needs to be set manually here like "CC-MAIN-2023-14"
-func (cc *CommonCrawl) GetPagesIndex(config common.RequestConfig, index string) ([]*common.CdxResponse, error) {
-	var pages int
-	var err error
+// fetchPage ... Makes request to CommonCrawl index API to get a single page of results
+func (cc *CommonCrawl) fetchPage(ctx context.Context, config common.RequestConfig, index string, page int) ([]*common.CdxResponse, error) {
+	indexURL := fmt.Sprintf("%v%v-index", cc.indexServer, index)
+	reqURL := config.GetUrl(indexURL, page)
 
-	if config.SinglePage {
-		pages = 1
-	} else {
-		pages, err = cc.GetNumPagesIndex(config.URL, index)
-		if err != nil {
-			return nil, err
-		}
+	response, err := cc.client.Get(ctx, reqURL, cc.MaxTimeout, cc.MaxRetries)
+	// Index server responds with 404 if there are no captures
+	if errors.Is(err, common.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, common.WrapError(err, "FetchPage", cc.Name(), reqURL, page)
 	}
 
-	var results []*common.CdxResponse
-	numResults := 0
+	parsedResponse, err := cc.ParseResponse(response)
+	if err != nil {
+		return nil, common.WrapError(err, "FetchPage", cc.Name(), reqURL, page)
+	}
+	return parsedResponse, nil
+}
 
-	for page := 0; page < pages; page++ {
-		indexURL := fmt.Sprintf("%v%v-index", INDEX_SERVER, index)
-		reqURL := config.GetUrl(indexURL, page)
+// pager ... Returns PageFunc over index
+func (cc *CommonCrawl) pager(config common.RequestConfig, index string) common.PageFunc {
+	next := common.NewPager(config,
+		func(ctx context.Context) (int, error) {
+			return cc.GetNumPagesIndexContext(ctx, config.URL, index)
+		},
+		func(ctx context.Context, page int) ([]*common.CdxResponse, error) {
+			return cc.fetchPage(ctx, config, index, page)
+		},
+	)
+
+	return func(ctx context.Context) ([]*common.CdxResponse, error) {
+		results, err := next(ctx)
+		for _, res := range results {
+			res.Crawl = index
+		}
+		return results, err
+	}
+}
 
-		response, err := common.Get(reqURL, cc.MaxTimeout, cc.MaxRetries)
-		if err != nil {
-			return results, fmt.Errorf("[GetPagesIndex] Request error: %v", err)
+// SelectIndexes ... Returns IDs of indexes to search for config, newest first.
+// Uses config.Crawls, config.CrawlsByDate with FromDate/ToDate.
+func (cc *CommonCrawl) SelectIndexes(config common.RequestConfig) []string {
+	from := padTimestamp(config.FromDate, '0')
+	to := padTimestamp(config.ToDate, '9')
+
+	ids := []string{}
+	for _, index := range cc.indexes {
+		if config.CrawlsByDate {
+			// Indexes without listed dates are kept, as they may overlap
+			indexFrom, indexTo := index.dates()
+			if (from != "" && indexTo != "" && indexTo < from) || (to != "" && indexFrom != "" && indexFrom > to) {
+				continue
+			}
 		}
+		ids = append(ids, index.Id)
+	}
 
-		parsedResponse, err := cc.ParseResponse(response)
-		if err != nil {
-			return results, fmt.Errorf("[GetPagesIndex] Cannot parse response: %v", err)
+	crawls := config.Crawls
+	if crawls == 0 && !config.CrawlsByDate {
+		crawls = 1
+	}
+	if crawls > 0 && crawls < len(ids) {
+		ids = ids[:crawls]
+	}
+	return ids
+}
+
+// Pad timestamp prefix like "20230320" to full 14 digits
+func padTimestamp(timestamp string, pad byte) string {
+	if timestamp == "" || len(timestamp) >= 14 {
+		return timestamp
+	}
+	return timestamp + strings.Repeat(string(pad), 14-len(timestamp))
+}
+
+// indexesPager ... Goes through indexes one by one, results are limited by config.Limit across all of them.
+// Index server ignores collapse parameters, so they are applied on the client to results of all indexes.
+// Progress of each index is saved to its part of config.Checkpoint.
+func (cc *CommonCrawl) indexesPager(config common.RequestConfig, indexes []string) common.PageFunc {
+	collapses, err := common.ParseCollapses(config.CollapseSpecs())
+	if err != nil {
+		return func(context.Context) ([]*common.CdxResponse, error) {
+			return nil, common.NewError(common.KindUnknown, "Collapse", "", err)
 		}
-		results = append(results, parsedResponse...)
-		numResults += len(parsedResponse)
+	}
+	collapser := common.NewCollapser(collapses)
+	config.CollapseColumn, config.Collapse = "", nil
+
+	// Server limit would cut results before they are collapsed, indexes are requested without it then
+	limit := config.Limit
+	if len(collapses) > 0 {
+		config.Limit = 0
+	}
 
-		if config.Limit != 0 && uint(numResults) >= config.Limit {
-			break
+	cp := config.Checkpoint
+	i := 0
+	numResults := 0
+	if cp != nil {
+		numResults = cp.PartsResults()
+	}
+
+	seen := map[string]bool{}    // URL keys with digests of captures in newer crawls
+	current := map[string]bool{} // URL keys with digests of captures in the current crawl
+	var next common.PageFunc
+
+	return func(ctx context.Context) ([]*common.CdxResponse, error) {
+		for {
+			if next == nil {
+				if i >= len(indexes) || (limit != 0 && uint(numResults) >= limit) {
+					if cp != nil {
+						if err := cp.Complete(); err != nil {
+							return nil, err
+						}
+					}
+					return nil, io.EOF
+				}
+
+				// Index pager counts results from its checkpoint, so the limit is left for it and the rest of indexes
+				indexConfig := config
+				partResults := 0
+				if cp != nil {
+					part := cp.Part(indexes[i])
+					if part.Done {
+						i++
+						continue
+					}
+					indexConfig.Checkpoint = part
+					partResults = part.Results
+				}
+				if config.Limit != 0 {
+					indexConfig.Limit = config.Limit - uint(numResults) + uint(partResults)
+				}
+				next = cc.pager(indexConfig, indexes[i])
+			}
+
+			results, err := next(ctx)
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			results = collapser.Filter(results)
+
+			// Repeated captures within a crawl are kept, only ones found in newer crawls are skipped
+			if config.DedupDigest {
+				unique := results[:0]
+				for _, res := range results {
+					key := res.Urlkey + " " + res.Digest
+					if !seen[key] {
+						current[key] = true
+						unique = append(unique, res)
+					}
+				}
+				results = unique
+			}
+
+			if err == io.EOF {
+				next = nil
+				i++
+				for key := range current {
+					seen[key] = true
+				}
+				current = map[string]bool{}
+			}
+
+			if limit != 0 && uint(numResults+len(results)) > limit {
+				results = results[:limit-uint(numResults)]
+			}
+			numResults += len(results)
+			if len(results) > 0 {
+				return results, nil
+			}
 		}
 	}
+}
+
+// IterateIndex ... Returns iterator over all url observations in given index.
+//
+//	index: needs to be set manually here like "CC-MAIN-2023-14"
+func (cc *CommonCrawl) IterateIndex(ctx context.Context, config common.RequestConfig, index string) *common.Iterator {
+	return common.NewIterator(ctx, cc.indexesPager(config, []string{index}))
+}
+
+// IterateIndexes ... Returns iterator over url observations in given indexes, one index after another
+func (cc *CommonCrawl) IterateIndexes(ctx context.Context, config common.RequestConfig, indexes []string) *common.Iterator {
+	return common.NewIterator(ctx, cc.indexesPager(config, indexes))
+}
+
+// Iterate ... Returns iterator over all url observations in CommonCrawl indexes selected by config,
+// the latest one by default. Pages are requested lazily while records are consumed.
+func (cc *CommonCrawl) Iterate(ctx context.Context, config common.RequestConfig) *common.Iterator {
+	return cc.IterateIndexes(ctx, config, cc.SelectIndexes(config))
+}
+
+// GetPagesIndex ... Makes request to WebArchive index API to gather all url observations
+//
+//	index: needs to be set manually here like "CC-MAIN-2023-14"
+func (cc *CommonCrawl) GetPagesIndex(config common.RequestConfig, index string) ([]*common.CdxResponse, error) {
+	return cc.GetPagesIndexContext(context.Background(), config, index)
+}
 
-	return results, nil
+// GetPagesIndexContext ... Same as GetPagesIndex, but stops fetching pages when ctx is done
+func (cc *CommonCrawl) GetPagesIndexContext(ctx context.Context, config common.RequestConfig, index string) ([]*common.CdxResponse, error) {
+	return common.Collect(cc.IterateIndex(ctx, config, index))
 }
 
 // Makes request to the Commoncrawl index API to gather all offsets that contain chosen URL.
 //
-//	Uses the latest CommonCrawl index.
+//	Uses indexes selected by config, the latest CommonCrawl index by default.
 func (cc *CommonCrawl) GetPages(config common.RequestConfig) ([]*common.CdxResponse, error) {
-	return cc.GetPagesIndex(config, cc.indexes[0].Id)
+	return cc.GetPagesContext(context.Background(), config)
+}
+
+// GetPagesContext ... Same as GetPages, but stops fetching pages when ctx is done
+func (cc *CommonCrawl) GetPagesContext(ctx context.Context, config common.RequestConfig) ([]*common.CdxResponse, error) {
+	return common.Collect(cc.Iterate(ctx, config))
 }
 
 // FetchPages is a concurrent way to GetPages.
 // Makes request to CommonCrawl index API and returns observations in a channel.
 //
-//	index: needs to be set manually here
+// Deprecated: use Iterate, channels are never closed and completion is not signaled.
 func (cc *CommonCrawl) FetchPages(config common.RequestConfig, results chan []*common.CdxResponse, errors chan error) {
-	var pages int
-	var err error
+	cc.FetchPagesContext(context.Background(), config, results, errors)
+}
 
-	if config.SinglePage {
-		pages = 1
-	} else {
-		pages, err = cc.GetNumPages(config.URL)
-		if err != nil {
-			errors <- err
-		}
+// FetchPagesContext ... Same as FetchPages, but returns as soon as ctx is done.
+// Results and errors are not sent once ctx is done, so the caller may stop reading channels.
+//
+// Deprecated: use Iterate.
+func (cc *CommonCrawl) FetchPagesContext(ctx context.Context, config common.RequestConfig, results chan []*common.CdxResponse, errors chan error) {
+	common.FetchPages(ctx, cc.indexesPager(config, cc.SelectIndexes(config)), results, errors)
+}
+
+// Gets files from CommonCrawl storage using info from CdxResponse server.
+// Payload of the WARC record is returned de-chunked and decoded, use GetCapture to get HTTP headers.
+//
+//	page: info about found web page in CdxResponse
+//	timeout: timeout in seconds
+func (cc *CommonCrawl) GetFile(page *common.CdxResponse) ([]byte, error) {
+	return cc.GetFileContext(context.Background(), page)
+}
+
+// GetFileContext ... Same as GetFile, but download is aborted when ctx is done
+func (cc *CommonCrawl) GetFileContext(ctx context.Context, page *common.CdxResponse) ([]byte, error) {
+	_, content, err := cc.readVerifiedRecord(ctx, page, "GetFile")
+	if err != nil {
+		return nil, err
 	}
 
-	numResults := 0
+	capture, err := common.ParseHTTPResponse(page, content)
+	if err != nil {
+		return nil, &common.Error{Kind: common.KindWARC, Op: "GetFile", Source: cc.Name(), URL: cc.crawlStorage + page.Filename, Page: -1, Err: err}
+	}
+	return capture.Body, nil
+}
 
-	for page := 0; page < pages; page++ {
-		indexURL := fmt.Sprintf("%v%v-index", INDEX_SERVER, cc.indexes[0].Id)
-		reqURL := config.GetUrl(indexURL, page)
+// GetCapture ... Gets capture from CommonCrawl storage with parsed HTTP response and WARC headers
+func (cc *CommonCrawl) GetCapture(page *common.CdxResponse) (*common.Capture, error) {
+	return cc.GetCaptureContext(context.Background(), page)
+}
 
-		response, err := common.Get(reqURL, cc.MaxTimeout, cc.MaxRetries)
-		if err != nil {
-			errors <- fmt.Errorf("[FetchPages] Request error: %v", err)
-		}
+// GetCaptureContext ... Same as GetCapture, but download is aborted when ctx is done
+func (cc *CommonCrawl) GetCaptureContext(ctx context.Context, page *common.CdxResponse) (*common.Capture, error) {
+	warcHeader, content, err := cc.readVerifiedRecord(ctx, page, "GetCapture")
+	if err != nil {
+		return nil, err
+	}
 
-		parsedResponse, err := cc.ParseResponse(response)
-		if err != nil {
-			errors <- fmt.Errorf("[FetchPages] Cannot parse response: %v", err)
-		}
-		numResults += len(parsedResponse)
-		results <- parsedResponse
+	capture, err := common.ParseHTTPResponse(page, content)
+	if err != nil {
+		return nil, &common.Error{Kind: common.KindWARC, Op: "GetCapture", Source: cc.Name(), URL: cc.crawlStorage + page.Filename, Page: -1, Err: err}
+	}
+	capture.WARCHeader = warcHeader
+	return capture, nil
+}
 
-		if config.Limit != 0 && uint(numResults) >= config.Limit {
-			return
-		}
+// OpenFile ... Opens stream of file payload from CommonCrawl storage, de-chunked and decoded.
+// WARC record is decompressed while reading, so the file is not buffered in memory. Stream must be closed.
+func (cc *CommonCrawl) OpenFile(ctx context.Context, page *common.CdxResponse) (io.ReadCloser, error) {
+	payload, err := cc.OpenPayload(ctx, page)
+	if err != nil {
+		return nil, common.WrapError(err, "OpenFile", cc.Name(), "", -1)
+	}
+
+	body, err := payload.Decode()
+	if errors.Is(err, common.ErrDigestMismatch) {
+		return nil, common.WrapError(err, "OpenFile", cc.Name(), cc.crawlStorage+page.Filename, -1)
 	}
+	if err != nil {
+		return nil, &common.Error{Kind: common.KindWARC, Op: "OpenFile", Source: cc.Name(), URL: cc.crawlStorage + page.Filename, Page: -1, Err: err}
+	}
+	return body, nil
 }
 
-// Gets files from CommonCrawl storage using info from CdxResponse server
-//
-//	page: info about found web page in CdxResponse
-//	timeout: timeout in seconds
-func (cc *CommonCrawl) GetFile(page *common.CdxResponse) ([]byte, error) {
+// OpenPayload ... Opens stream of de-chunked file payload from CommonCrawl storage, without decoding it.
+// Reading fails with common.ErrDigestMismatch at the end if payload doesn't match the record digest.
+func (cc *CommonCrawl) OpenPayload(ctx context.Context, page *common.CdxResponse) (*common.Payload, error) {
+	fileURL := cc.crawlStorage + page.Filename
+	resp, err := cc.client.OpenStream(ctx, fileURL, cc.MaxTimeout, cc.MaxRetries, cc.rangeHeader(page))
+	if err != nil {
+		return nil, common.WrapError(err, "OpenPayload", cc.Name(), fileURL, -1)
+	}
+
+	warcErr := func(err error) error {
+		resp.Stream.Close()
+		return &common.Error{Kind: common.KindWARC, Op: "OpenPayload", Source: cc.Name(), URL: fileURL, Page: -1, Err: err}
+	}
+
+	reader, err := warc.NewReaderMode(resp.Stream, warc.SequentialMode)
+	if err != nil {
+		return nil, warcErr(err)
+	}
+
+	record, err := reader.ReadRecord()
+	if err != nil {
+		reader.Close()
+		return nil, warcErr(err)
+	}
+
+	httpResp, err := http.ReadResponse(bufio.NewReader(record.Content), nil)
+	if err != nil {
+		reader.Close()
+		return nil, warcErr(fmt.Errorf("Cannot parse HTTP response: %v", err))
+	}
+
+	body := &recordBody{ReadCloser: common.NewDigestReader(page, httpResp.Body), close: func() {
+		reader.Close()
+		resp.Stream.Close()
+	}}
+	return &common.Payload{ReadCloser: body, Encoding: httpResp.Header.Get("Content-Encoding")}, nil
+}
+
+// recordBody ... Payload stream of WARC record, closes the record reader and download stream
+type recordBody struct {
+	io.ReadCloser
+	close func()
+}
+
+func (b *recordBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.close()
+	return err
+}
+
+// Range of WARC record in a file
+func (cc *CommonCrawl) rangeHeader(page *common.CdxResponse) map[string]string {
 	offset, _ := strconv.Atoi(page.Offset)
 	length, _ := strconv.Atoi(page.Length)
-	offsetEnd := offset + length + 1
+	offsetEnd := offset + length - 1 // Range end is inclusive
 
-	headers := map[string]string{
+	return map[string]string{
 		"Range": fmt.Sprintf("bytes=%v-%v", page.Offset, offsetEnd),
 	}
-	resp, err := common.DoRequest(CRAWL_STORAGE+page.Filename, cc.MaxTimeout, headers)
+}
+
+// readVerifiedRecord ... Same as readRecord, but the record is downloaded again while its block or payload doesn't match digests
+func (cc *CommonCrawl) readVerifiedRecord(ctx context.Context, page *common.CdxResponse, op string) (warcHeader http.Header, content []byte, err error) {
+	err = common.RetryDigest(ctx, common.DIGEST_RETRIES, func() error {
+		if warcHeader, content, err = cc.readRecord(ctx, page, op); err != nil {
+			return err
+		}
+		if err := common.VerifyBlockDigest(page, warcHeader, content); err != nil {
+			return err
+		}
+		return common.VerifyHTTPDigest(page, content)
+	})
+	if err != nil {
+		return nil, nil, common.WrapError(err, op, cc.Name(), cc.crawlStorage+page.Filename, -1)
+	}
+	return warcHeader, content, nil
+}
+
+// readRecord ... Downloads WARC record of a capture, returns its header fields and content
+func (cc *CommonCrawl) readRecord(ctx context.Context, page *common.CdxResponse, op string) (http.Header, []byte, error) {
+	fileURL := cc.crawlStorage + page.Filename
+	resp, err := cc.client.DoRequest(ctx, fileURL, cc.MaxTimeout, cc.rangeHeader(page))
 	if err != nil {
-		return nil, fmt.Errorf("[GetFile] Request error: %v", err)
+		return nil, nil, common.WrapError(err, op, cc.Name(), fileURL, -1)
+	}
+
+	warcErr := func(err error) error {
+		return &common.Error{Kind: common.KindWARC, Op: op, Source: cc.Name(), URL: fileURL, Page: -1, Err: err}
 	}
 
 	reader, err := warc.NewReader(bytes.NewReader(resp))
 	if err != nil {
-		return nil, fmt.Errorf("[GetFile] Cannot decode WARC: %v", err)
+		return nil, nil, warcErr(err)
 	}
 	defer reader.Close()
 
-	for {
-		record, err := reader.ReadRecord()
-		if err != nil {
-			return nil, fmt.Errorf("[GetFile] Cannot decode WARC: %v", err)
-		}
+	record, err := reader.ReadRecord()
+	if err != nil {
+		return nil, nil, warcErr(err)
+	}
 
-		var buf bytes.Buffer
-		io.Copy(&buf, record.Content)
-		return buf.Bytes(), nil
+	warcHeader := http.Header{}
+	for k, v := range record.Header {
+		warcHeader.Set(k, v)
 	}
+
+	var buf bytes.Buffer
+	io.Copy(&buf, record.Content)
+	return warcHeader, buf.Bytes(), nil
 }
@@ -1,14 +1,24 @@
 package commoncrawl
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
 	"testing"
-	"time"
 
 	common "github.com/karust/gogetcrawl/common"
+	"github.com/karust/gogetcrawl/testutil"
 )
 
-// ! Currently impossinble to run tests all at once, due to the index server timeouts
-
 // Use pre-saved response, hard to get live one
 // Example request: http://index.commoncrawl.org/CC-MAIN-2023-14-index?url=tutorialspoint.com/*&output=json&limit=6&filter=statuscode:200&filter=mimetype:application/pdf
 const RESPONSE = `{"urlkey": "com,tutorialspoint)/accounting_basics/accounting_basics_tutorial.pdf", "timestamp": "20230320100841", "url": "http://www.tutorialspoint.com/accounting_basics/accounting_basics_tutorial.pdf", "mime": "application/pdf", "mime-detected": "application/pdf", "status": "200", "digest": "2JQ2AQ3HQZIMXHB5CJGSADUGOHYBIRJJ", "length": "787172", "offset": "102849414", "filename": "crawl-data/CC-MAIN-2023-14/segments/1679296943471.24/warc/CC-MAIN-20230320083513-20230320113513-00267.warc.gz"}
@@ -23,8 +33,78 @@ const RESPONSE = `{"urlkey": "com,tutorialspoint)/accounting_basics/accounting_b
 var cctest common.Source = &CommonCrawl{}
 var cc *CommonCrawl
 
-func init() {
-	cc, _ = New(15, 2)
+var server *testutil.CDXServer
+
+func TestMain(m *testing.M) {
+	server = testutil.NewCDXServer()
+	server.Indexes = []string{"CC-MAIN-2023-14", "CC-MAIN-2022-49"}
+	seedCaptures(server)
+
+	var err error
+	cc, err = New(15, 2, WithIndexServer(server.URL), WithCrawlStorage(server.URL))
+	if err != nil {
+		log.Fatalf("Cannot initialize CommonCrawl: %v", err)
+	}
+
+	code := m.Run()
+	server.Close()
+	os.Exit(code)
+}
+
+func seedCaptures(server *testutil.CDXServer) {
+	for i := 0; i < 20; i++ {
+		server.AddCapture(testutil.HTMLCapture(fmt.Sprintf("https://en.wikipedia.org/wiki/Page_%v", i), "20230320100841", 1000))
+	}
+	server.AddCapture(testutil.HTMLCapture("https://wikipedia.org/", "20230321100841", 3000))
+	server.AddCapture(testutil.HTMLCapture("https://wikipedia.org/", "20230322100841", 3000))
+
+	for _, host := range []string{"tutorialspoint.com", "example.com"} {
+		for i := 0; i < 8; i++ {
+			server.AddCapture(testutil.HTMLCapture(fmt.Sprintf("https://www.%v/page%v.htm", host, i), "20230330112743", 500))
+		}
+		server.AddCapture(testutil.Capture{
+			URL:       fmt.Sprintf("https://www.%v/tutorial.pdf", host),
+			Timestamp: "20230330112743",
+			MimeType:  "application/pdf",
+			Body:      []byte("%PDF-1.4 test"),
+		})
+	}
+
+	// Home page didn't change between crawls
+	home := []byte("<html>Common Crawl</html>")
+	server.AddCapture(testutil.Capture{URL: "https://commoncrawl.org/", Timestamp: "20230325000000", Body: home})
+	server.AddCapture(testutil.HTMLCapture("https://commoncrawl.org/about", "20230325000000", 100))
+	server.AddCapture(testutil.Capture{URL: "https://commoncrawl.org/", Timestamp: "20221201000000", Body: home, Index: "CC-MAIN-2022-49"})
+	server.AddCapture(testutil.Capture{URL: "https://commoncrawl.org/faq", Timestamp: "20221202000000", Body: []byte("FAQ"), Index: "CC-MAIN-2022-49"})
+	server.AddCapture(testutil.Capture{URL: "https://commoncrawl.org/faq", Timestamp: "20221203000000", Body: []byte("FAQ"), Index: "CC-MAIN-2022-49"})
+
+	// Large gzip compressed file sent in chunks
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(bytes.Repeat([]byte("0123456789abcdef"), 1<<16))
+	gz.Close()
+	server.AddCapture(testutil.Capture{
+		URL:       "https://www.example.com/large.bin",
+		Timestamp: "20230330112743",
+		MimeType:  "application/octet-stream",
+		Header:    http.Header{"Content-Encoding": {"gzip"}, "Transfer-Encoding": {"chunked"}},
+		Body:      chunked(compressed.Bytes(), 4096),
+	})
+}
+
+// Encode body with chunked transfer encoding
+func chunked(body []byte, size int) []byte {
+	var buf bytes.Buffer
+	for len(body) > 0 {
+		n := size
+		if n > len(body) {
+			n = len(body)
+		}
+		fmt.Fprintf(&buf, "%x\r\n%s\r\n", n, body[:n])
+		body = body[n:]
+	}
+	buf.WriteString("0\r\n\r\n")
+	return buf.Bytes()
 }
 
 func TestGetIndexes(t *testing.T) {
@@ -38,18 +118,17 @@ func TestGetIndexes(t *testing.T) {
 	}
 }
 
-// Commented due to excessive request to test
-// func TestGetNumPagesIndex(t *testing.T) {
-// 	want := 989
+func TestGetNumPagesIndex(t *testing.T) {
+	want := 1
 
-// 	got, err := GetNumPagesIndex("*.wikipedia.org/", "CC-MAIN-2015-11")
-// 	if err != nil {
-// 		t.Fatalf("%v", err)
-// 	}
-// 	if got != want {
-// 		t.Fatalf("Parsed result doesn't contain wanted value: Want=%v, Got=%v", want, got)
-// 	}
-// }
+	got, err := cc.GetNumPagesIndex("*.wikipedia.org/", "CC-MAIN-2023-14")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if got != want {
+		t.Fatalf("Parsed result doesn't contain wanted value: Want=%v, Got=%v", want, got)
+	}
+}
 
 func TestGetNumPages(t *testing.T) {
 	got, err := cc.GetNumPages("*.wikipedia.org/")
@@ -74,26 +153,20 @@ func TestParseResponse(t *testing.T) {
 	}
 }
 
-// Commented due to excessive request to test
-// func TestGetPagesIndex(t *testing.T) {
-// 	config := common.RequestConfig{
-// 		URL: "wikipedia.org/",
-// 		//Filters:    []string{"statuscode:200", "mimetype:text/html"},
-// 		Limit: 10,
-// 		//Collapse:   true,
-// 		Timeout:    60,
-// 		MaxRetries: 2,
-// 	}
-// 	results, err := GetPagesIndex(config, "CC-MAIN-2015-11")
-// 	if err != nil {
-// 		t.Fatalf("%v", err)
-// 	}
-// 	fmt.Println(results)
-
-// 	if len(results) == 0 {
-// 		t.Fatalf("No pages fetched from Web Archive")
-// 	}
-// }
+func TestGetPagesIndex(t *testing.T) {
+	config := common.RequestConfig{
+		URL:   "wikipedia.org/",
+		Limit: 10,
+	}
+	results, err := cc.GetPagesIndex(config, "CC-MAIN-2023-14")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("Incorrect number of pages returned: %v, want=2", len(results))
+	}
+}
 
 func TestGetPages(t *testing.T) {
 	config := common.RequestConfig{
@@ -129,33 +202,29 @@ func TestFetchPages(t *testing.T) {
 	resultsChan := make(chan []*common.CdxResponse)
 	errorsChan := make(chan error)
 
-	go func() {
-		cc.FetchPages(config1, resultsChan, errorsChan)
-	}()
+	var wg sync.WaitGroup
+	for _, config := range []common.RequestConfig{config1, config2} {
+		wg.Add(1)
+		go func(config common.RequestConfig) {
+			defer wg.Done()
+			cc.FetchPages(config, resultsChan, errorsChan)
+		}(config)
+	}
 
 	go func() {
-		cc.FetchPages(config2, resultsChan, errorsChan)
+		wg.Wait()
+		close(resultsChan)
 	}()
 
 	var results []*common.CdxResponse
-	timeout := false
 
-	for {
+	for done := false; !done; {
 		select {
 		case err := <-errorsChan:
 			t.Fatalf("FetchPages goroutine failed %v", err)
 		case res, ok := <-resultsChan:
-			if ok {
-				results = append(results, res...)
-			}
-		case <-time.After(time.Second * 100):
-			timeout = true
-			break
-		}
-
-		if timeout {
-			t.Log("Timeout passed")
-			break
+			results = append(results, res...)
+			done = !ok
 		}
 	}
 
@@ -166,19 +235,257 @@ func TestFetchPages(t *testing.T) {
 	}
 }
 
+func TestIterate(t *testing.T) {
+	config := common.RequestConfig{
+		URL:        "tutorialspoint.com/*",
+		Filters:    []string{"statuscode:200", "mimetype:text/html"},
+		Limit:      6,
+		SinglePage: true,
+	}
+
+	it := cc.Iterate(context.Background(), config)
+	defer it.Close()
+
+	count := 0
+	for it.Next() {
+		if it.Record().StatusCode != "200" {
+			t.Fatalf("Incorrect response status: %v", it.Record().StatusCode)
+		}
+		count++
+	}
+
+	if err := it.Err(); err != nil {
+		t.Fatalf("Iteration failed: %v", err)
+	}
+
+	if count != 6 {
+		t.Fatalf("Incorrect number of records: %v, want=6", count)
+	}
+}
+
 func TestGetFile(t *testing.T) {
-	pages, err := cc.ParseResponse([]byte(RESPONSE))
+	config := common.RequestConfig{
+		URL:     "tutorialspoint.com/*",
+		Filters: []string{"mimetype:application/pdf"},
+	}
+	pages, err := cc.GetPages(config)
 	if err != nil {
-		t.Fatalf("Cannot parse response: %v", err)
+		t.Fatalf("Cannot get pages: %v", err)
+	}
+
+	if len(pages) != 1 {
+		t.Fatalf("Incorrect number of pages returned: %v, want=1", len(pages))
 	}
 
-	file, err := cc.GetFile(pages[4])
+	file, err := cc.GetFile(pages[0])
 	if err != nil {
 		t.Fatalf("Cannot get file: %v", err)
 	}
 
-	if len(file) == 0 {
-		t.Fatalf("Obtained file length: %v", len(file))
+	// Payload is returned without HTTP headers
+	if string(file) != "%PDF-1.4 test" {
+		t.Fatalf("Incorrect file: %q", file)
+	}
+}
+
+func TestWithIndexServer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/collinfo.json":
+			fmt.Fprint(w, `[{"id": "CC-MAIN-2023-14", "name": "March/April 2023 Index"}]`)
+		case "/CC-MAIN-2023-14-index":
+			fmt.Fprint(w, `{"pages": 2, "pageSize": 5, "blocks": 9}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	local, err := New(5, 1, WithIndexServer(server.URL))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	got, err := local.GetNumPages("example.com")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if got != 2 {
+		t.Fatalf("Parsed result doesn't contain wanted value: Want=2, Got=%v", got)
+	}
+}
+
+func TestSelectIndexes(t *testing.T) {
+	cases := []struct {
+		config common.RequestConfig
+		want   []string
+	}{
+		{common.RequestConfig{}, []string{"CC-MAIN-2023-14"}},
+		{common.RequestConfig{Crawls: -1}, []string{"CC-MAIN-2023-14", "CC-MAIN-2022-49"}},
+		{common.RequestConfig{Crawls: 5}, []string{"CC-MAIN-2023-14", "CC-MAIN-2022-49"}},
+		{common.RequestConfig{CrawlsByDate: true, FromDate: "2022", ToDate: "20221231"}, []string{"CC-MAIN-2022-49"}},
+		{common.RequestConfig{CrawlsByDate: true, FromDate: "20230101"}, []string{"CC-MAIN-2023-14"}},
+		{common.RequestConfig{CrawlsByDate: true}, []string{"CC-MAIN-2023-14", "CC-MAIN-2022-49"}},
+	}
+
+	for _, c := range cases {
+		got := cc.SelectIndexes(c.config)
+		if fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Fatalf("Incorrect indexes for %+v: %v, want=%v", c.config, got, c.want)
+		}
+	}
+}
+
+func TestIterateCrawls(t *testing.T) {
+	config := common.RequestConfig{URL: "commoncrawl.org/*", Crawls: -1}
+
+	results, err := cc.GetPages(config)
+	if err != nil {
+		t.Fatalf("Cannot get pages: %v", err)
+	}
+
+	if len(results) != 5 {
+		t.Fatalf("Incorrect number of results: %v, want=5", len(results))
+	}
+	if results[0].Crawl != "CC-MAIN-2023-14" || results[len(results)-1].Crawl != "CC-MAIN-2022-49" {
+		t.Fatalf("Results are not tagged by crawl: first=%v last=%v", results[0].Crawl, results[len(results)-1].Crawl)
+	}
+
+	config.DedupDigest = true
+	results, err = cc.GetPages(config)
+	if err != nil {
+		t.Fatalf("Cannot get pages: %v", err)
+	}
+
+	// Repeated capture within a crawl is kept
+	if len(results) != 4 {
+		t.Fatalf("Incorrect number of deduplicated results: %v, want=4", len(results))
+	}
+
+	config = common.RequestConfig{URL: "commoncrawl.org/*", Crawls: -1, Limit: 3}
+	if results, _ = cc.GetPages(config); len(results) != 3 {
+		t.Fatalf("Limit is not applied across crawls: %v, want=3", len(results))
+	}
+}
+
+func TestGetCapture(t *testing.T) {
+	config := common.RequestConfig{
+		URL:     "tutorialspoint.com/*",
+		Filters: []string{"mimetype:application/pdf"},
+	}
+	pages, err := cc.GetPages(config)
+	if err != nil || len(pages) != 1 {
+		t.Fatalf("Cannot get pages: %v, %v", len(pages), err)
+	}
+
+	capture, err := cc.GetCapture(pages[0])
+	if err != nil {
+		t.Fatalf("Cannot get capture: %v", err)
+	}
+
+	if capture.StatusCode != 200 || capture.Header.Get("Content-Type") != "application/pdf" {
+		t.Fatalf("Incorrect status=%v or headers=%v", capture.StatusCode, capture.Header)
+	}
+	if capture.WARCHeader.Get("WARC-Target-URI") != pages[0].Original {
+		t.Fatalf("Incorrect WARC headers: %v", capture.WARCHeader)
+	}
+	if string(capture.Body) != "%PDF-1.4 test" {
+		t.Fatalf("Incorrect body: %q", capture.Body)
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	pages, err := cc.GetPages(common.RequestConfig{URL: "www.example.com/large.bin"})
+	if err != nil || len(pages) != 1 {
+		t.Fatalf("Cannot get pages: %v, %v", len(pages), err)
+	}
+
+	stream, err := cc.OpenFile(context.Background(), pages[0])
+	if err != nil {
+		t.Fatalf("Cannot open file: %v", err)
+	}
+	defer stream.Close()
+
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("Cannot read file: %v", err)
+	}
+
+	want := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	if !bytes.Equal(data, want) {
+		t.Fatalf("Incorrect file: length=%v, want=%v", len(data), len(want))
+	}
+}
+
+func TestDigestVerification(t *testing.T) {
+	pages, err := cc.GetPages(common.RequestConfig{URL: "www.example.com/large.bin"})
+	if err != nil || len(pages) != 1 {
+		t.Fatalf("Cannot get pages: %v, %v", len(pages), err)
+	}
+
+	// Range covers exactly the record
+	offset, _ := strconv.Atoi(pages[0].Offset)
+	length, _ := strconv.Atoi(pages[0].Length)
+	if got, want := cc.rangeHeader(pages[0])["Range"], fmt.Sprintf("bytes=%v-%v", offset, offset+length-1); got != want {
+		t.Fatalf("Incorrect range: %v, want=%v", got, want)
+	}
+
+	// Corrupted download is repeated
+	server.CorruptNext(1)
+	if _, err := cc.GetCapture(pages[0]); err != nil {
+		t.Fatalf("Corrupted download is not repeated: %v", err)
+	}
+
+	server.CorruptNext(common.DIGEST_RETRIES)
+	_, err = cc.GetFile(pages[0])
+	if !errors.Is(err, common.ErrDigestMismatch) {
+		t.Fatalf("Expected digest mismatch error, got: %v", err)
+	}
+
+	// Saved file is downloaded again
+	dir := t.TempDir()
+	server.CorruptNext(1)
+	if err := common.SaveResult(context.Background(), pages[0], dir); err != nil {
+		t.Fatalf("Cannot save file: %v", err)
+	}
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("Incorrect number of saved files: %v, want=1", len(files))
+	}
+}
+
+func TestCollapse(t *testing.T) {
+	// Index server ignores collapse, records are collapsed on the client
+	config := common.RequestConfig{URL: "commoncrawl.org/*", Collapse: []string{"timestamp:6"}}
+	results, err := cc.GetPages(config)
+	if err != nil {
+		t.Fatalf("Cannot get pages: %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Incorrect number of collapsed results: %v, want=1", len(results))
+	}
+
+	config.Crawls = -1
+	if results, _ = cc.GetPages(config); len(results) != 2 {
+		t.Fatalf("Incorrect number of collapsed results of all crawls: %v, want=2", len(results))
+	}
+
+	// Records of all crawls are collapsed as one stream
+	config = common.RequestConfig{URL: "commoncrawl.org/", Crawls: -1, Collapse: []string{"urlkey"}}
+	if results, _ = cc.GetPages(config); len(results) != 1 {
+		t.Fatalf("Records of crawls are not collapsed together: %v, want=1", len(results))
+	}
+
+	// Limit is applied to collapsed records, both captures of the home page would be the first 2 records
+	config = common.RequestConfig{URL: "*.wikipedia.org", Limit: 2, Collapse: []string{"urlkey"}}
+	results, _ = cc.GetPages(config)
+	if len(results) != 2 || results[0].Urlkey == results[1].Urlkey {
+		t.Fatalf("Limit is applied before collapsing: %v", len(results))
+	}
+
+	config.Collapse = []string{"timestamp:x"}
+	if _, err = cc.GetPages(config); err == nil {
+		t.Fatalf("Invalid collapse is accepted")
 	}
-	t.Logf("Obtained file length: %v", len(file))
 }
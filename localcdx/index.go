@@ -0,0 +1,325 @@
+package localcdx
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const probeSize = 4096 // Bytes read at once while searching for a line
+
+// index ... Sorted CDX or CDXJ index which can be read from a key
+type index interface {
+	// Search ... Returns cursor at a line before or at the first line not less than key
+	Search(key string) (cursor, error)
+	Path() string
+}
+
+// cursor ... Reads sorted lines of index, returns io.EOF at the end
+type cursor interface {
+	Next() ([]byte, error)
+	Fields() []string // Columns of space separated lines, detected by their number if empty
+	Close() error
+}
+
+// CDX file header letters used by cdx-indexer and Wayback: " CDX N b a m s k r M S V g"
+var headerFields = map[string]string{
+	"N": "urlkey",
+	"a": "original",
+	"b": "timestamp",
+	"m": "mimetype",
+	"s": "statuscode",
+	"k": "digest",
+	"S": "length",
+	"V": "offset",
+	"g": "filename",
+}
+
+// Parse columns of CDX file header, unknown letters are kept to be skipped
+func parseHeader(line []byte) []string {
+	letters := strings.Fields(strings.TrimPrefix(strings.TrimSpace(string(line)), "CDX"))
+	fields := make([]string, len(letters))
+	for i, letter := range letters {
+		if name, ok := headerFields[letter]; ok {
+			fields[i] = name
+		} else {
+			fields[i] = letter
+		}
+	}
+	return fields
+}
+
+// Header and metadata lines like " CDX N b a ..." and "!meta 0 {...}" sort before records
+func isMeta(line []byte) bool {
+	return len(line) == 0 || line[0] == ' ' || line[0] == '!'
+}
+
+// lineAt ... Returns the first line starting at or after off and its offset, nil at the end of file
+func lineAt(r io.ReaderAt, size, off int64) (int64, []byte, error) {
+	// Line starts after the previous new line
+	start := off
+	if off > 0 {
+		start = -1
+		buf := make([]byte, probeSize)
+		for pos := off - 1; pos < size; pos += int64(len(buf)) {
+			n, err := r.ReadAt(buf, pos)
+			if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+				start = pos + int64(i) + 1
+				break
+			}
+			if err != nil && err != io.EOF {
+				return 0, nil, err
+			}
+		}
+		if start < 0 {
+			return size, nil, nil
+		}
+	}
+	if start >= size {
+		return size, nil, nil
+	}
+
+	line, err := bufio.NewReaderSize(io.NewSectionReader(r, start, size-start), probeSize).ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// Long line, read it whole
+		line, err = bufio.NewReader(io.NewSectionReader(r, start, size-start)).ReadBytes('\n')
+	}
+	if err != nil && err != io.EOF {
+		return 0, nil, err
+	}
+	return start, bytes.TrimRight(line, "\r\n"), nil
+}
+
+// lowerBound ... Binary search of sorted lines, returns offset of the last line less than key, or 0.
+// Lines are compared as bytes, like sorted by "LC_ALL=C sort".
+func lowerBound(r io.ReaderAt, size int64, key string) (int64, error) {
+	lo, hi := int64(0), size
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		start, line, err := lineAt(r, size, mid)
+		if err != nil {
+			return 0, err
+		}
+		if line != nil && string(line) < key {
+			lo = start
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// plainIndex ... Uncompressed sorted CDX or CDXJ file
+type plainIndex struct {
+	path string
+}
+
+func (idx *plainIndex) Path() string {
+	return idx.path
+}
+
+func (idx *plainIndex) Search(key string) (cursor, error) {
+	file, err := os.Open(idx.path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	_, header, err := lineAt(file, info.Size(), 0)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	var fields []string
+	if bytes.HasPrefix(header, []byte(" CDX")) {
+		fields = parseHeader(header)
+	}
+
+	start, err := lowerBound(file, info.Size(), key)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(io.NewSectionReader(file, start, info.Size()-start))
+	return &lineCursor{reader: reader, fields: fields, closer: file}, nil
+}
+
+// lineCursor ... Reads lines of uncompressed file
+type lineCursor struct {
+	reader *bufio.Reader
+	fields []string
+	closer io.Closer
+}
+
+func (c *lineCursor) Next() ([]byte, error) {
+	line, err := c.reader.ReadBytes('\n')
+	if len(line) > 0 {
+		return bytes.TrimRight(line, "\r\n"), nil
+	}
+	return nil, err
+}
+
+func (c *lineCursor) Fields() []string {
+	return c.fields
+}
+
+func (c *lineCursor) Close() error {
+	return c.closer.Close()
+}
+
+// zipNumIndex ... ZipNum cluster: sorted lines compressed in gzip blocks of shard files,
+// with secondary index of the first line of each block:
+//
+//	com,example)/ 20200101000000	cdx-00000.gz	0	188224	1
+//
+// Shard paths are read from .loc file next to the index, "shard<TAB>path" per line,
+// otherwise shards are looked up in the index directory.
+type zipNumIndex struct {
+	path   string
+	shards map[string]string // Shard paths by name
+}
+
+func openZipNum(path string) (*zipNumIndex, error) {
+	idx := &zipNumIndex{path: path, shards: map[string]string{}}
+	data, err := os.ReadFile(strings.TrimSuffix(path, filepath.Ext(path)) + ".loc")
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		shard := fields[1]
+		if !filepath.IsAbs(shard) {
+			shard = filepath.Join(filepath.Dir(path), shard)
+		}
+		idx.shards[fields[0]] = shard
+	}
+	return idx, nil
+}
+
+func (idx *zipNumIndex) Path() string {
+	return idx.path
+}
+
+// Path of shard file by its name in secondary index
+func (idx *zipNumIndex) shardPath(name string) string {
+	if path, ok := idx.shards[name]; ok {
+		return path
+	}
+	path := filepath.Join(filepath.Dir(idx.path), name)
+	if _, err := os.Stat(path); err != nil && !strings.HasSuffix(name, ".gz") {
+		return path + ".gz"
+	}
+	return path
+}
+
+func (idx *zipNumIndex) Search(key string) (cursor, error) {
+	file, err := os.Open(idx.path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// The last block starting before key may contain it
+	start, err := lowerBound(file, info.Size(), key)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	blocks := &lineCursor{reader: bufio.NewReader(io.NewSectionReader(file, start, info.Size()-start)), closer: file}
+	return &zipNumCursor{index: idx, blocks: blocks, shards: map[string]*os.File{}}, nil
+}
+
+// zipNumCursor ... Reads lines of blocks listed in secondary index one after another
+type zipNumCursor struct {
+	index  *zipNumIndex
+	blocks *lineCursor         // Lines of secondary index
+	block  *bufio.Reader       // Lines of current block
+	shards map[string]*os.File // Opened shards by name
+}
+
+func (c *zipNumCursor) Next() ([]byte, error) {
+	for {
+		if c.block != nil {
+			line, err := c.block.ReadBytes('\n')
+			if len(line) > 0 {
+				return bytes.TrimRight(line, "\r\n"), nil
+			}
+			if err != io.EOF {
+				return nil, err
+			}
+			c.block = nil
+		}
+
+		entry, err := c.blocks.Next()
+		if err != nil {
+			return nil, err
+		}
+		if err := c.openBlock(entry); err != nil {
+			return nil, fmt.Errorf("Cannot read block %q: %v", entry, err)
+		}
+	}
+}
+
+// Opens gzip block by line of secondary index
+func (c *zipNumCursor) openBlock(entry []byte) error {
+	columns := strings.Split(string(entry), "\t")
+	if len(columns) < 4 {
+		return fmt.Errorf("Invalid secondary index line")
+	}
+	offset, err := strconv.ParseInt(columns[2], 10, 64)
+	if err != nil {
+		return err
+	}
+	length, err := strconv.ParseInt(columns[3], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	shard, ok := c.shards[columns[1]]
+	if !ok {
+		if shard, err = os.Open(c.index.shardPath(columns[1])); err != nil {
+			return err
+		}
+		c.shards[columns[1]] = shard
+	}
+
+	gz, err := gzip.NewReader(io.NewSectionReader(shard, offset, length))
+	if err != nil {
+		return err
+	}
+	gz.Multistream(false)
+	c.block = bufio.NewReader(gz)
+	return nil
+}
+
+func (c *zipNumCursor) Fields() []string {
+	return nil
+}
+
+func (c *zipNumCursor) Close() error {
+	for _, shard := range c.shards {
+		shard.Close()
+	}
+	return c.blocks.Close()
+}
@@ -0,0 +1,499 @@
+// Package localcdx implements common.Source for local sorted CDX and CDXJ index files, like ones written by pywb and cdx-indexer.
+//
+// Plain index files and ZipNum clusters (gzip blocks with .idx secondary index) are binary searched on disk,
+// so they are never loaded into memory. Records of several indexes are merged in index order.
+// URL queries match like on CDX servers: exact URL, "prefix*" and "*.domain". Filters, dates, collapses
+// and limit are applied while reading. Files are read from WARCs in a local directory.
+package localcdx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/karust/gogetcrawl/cdx"
+	common "github.com/karust/gogetcrawl/common"
+	"github.com/slyrz/warc"
+)
+
+const BATCH_SIZE = 1000 // Max number of records read from indexes in one batch of Iterate
+
+type LocalCDX struct {
+	name    string
+	indexes []index
+	warcDir string // Directory of WARC files referenced by records
+}
+
+// Option ... Configures LocalCDX source in New
+type Option func(*LocalCDX)
+
+// WithName ... Sets source name, "LocalCDX" by default
+func WithName(name string) Option {
+	return func(l *LocalCDX) {
+		l.name = name
+	}
+}
+
+// WithWARCDir ... Sets directory of WARC files to read captures from, filenames of records are relative to it
+func WithWARCDir(dir string) Option {
+	return func(l *LocalCDX) {
+		l.warcDir = dir
+	}
+}
+
+// New ... Creates source of index files. Paths are plain .cdx/.cdxj files, ZipNum .idx secondary indexes
+// or directories with such files.
+func New(paths []string, opts ...Option) (*LocalCDX, error) {
+	source := &LocalCDX{name: "LocalCDX"}
+	for _, opt := range opts {
+		opt(source)
+	}
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("[New] %v", err)
+		}
+
+		files := []string{path}
+		if info.IsDir() {
+			files = nil
+			for _, pattern := range []string{"*.cdx", "*.cdxj", "*.idx"} {
+				matches, _ := filepath.Glob(filepath.Join(path, pattern))
+				files = append(files, matches...)
+			}
+			if len(files) == 0 {
+				return nil, fmt.Errorf("[New] No index files in %v", path)
+			}
+		}
+
+		for _, file := range files {
+			idx, err := openIndex(file)
+			if err != nil {
+				return nil, fmt.Errorf("[New] Cannot open index %v: %v", file, err)
+			}
+			source.indexes = append(source.indexes, idx)
+		}
+	}
+
+	if len(source.indexes) == 0 {
+		return nil, fmt.Errorf("[New] No index files provided")
+	}
+	return source, nil
+}
+
+func openIndex(path string) (index, error) {
+	switch {
+	case strings.HasSuffix(path, ".idx"):
+		return openZipNum(path)
+	case strings.HasSuffix(path, ".gz"):
+		return nil, fmt.Errorf("Compressed index cannot be searched, decompress it or use ZipNum index")
+	}
+	return &plainIndex{path: path}, nil
+}
+
+func (l *LocalCDX) Name() string {
+	return l.name
+}
+
+// GetNumPages ... Indexes are read in batches linked by the last read line, so there is always one page
+func (l *LocalCDX) GetNumPages(url string) (int, error) {
+	return 1, nil
+}
+
+// GetNumPagesContext ... Same as GetNumPages
+func (l *LocalCDX) GetNumPagesContext(ctx context.Context, url string) (int, error) {
+	return 1, nil
+}
+
+// ParseResponse ... Parses lines of CDX or CDXJ index
+func (l *LocalCDX) ParseResponse(resp []byte) ([]*common.CdxResponse, error) {
+	results := []*common.CdxResponse{}
+	var fields []string
+	for _, line := range bytes.Split(resp, []byte{'\n'}) {
+		if bytes.HasPrefix(line, []byte(" CDX")) {
+			fields = parseHeader(line)
+		}
+		if isMeta(line) {
+			continue
+		}
+
+		res, err := l.parseLine(line, fields)
+		if err != nil {
+			return nil, common.NewError(common.KindParse, "ParseResponse", "", err)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+func (l *LocalCDX) parseLine(line []byte, fields []string) (*common.CdxResponse, error) {
+	res, err := cdx.ParseLine(line, fields)
+	if err != nil {
+		return nil, err
+	}
+	res.Source = l
+	return res, nil
+}
+
+// query ... Range of urlkeys matching URL of request
+type query struct {
+	start   string                // The first possible urlkey
+	inRange func(key string) bool // Reports whether keys from start up to key may match, false after the range
+	match   func(key string) bool
+}
+
+// newQuery ... Converts URL like on CDX servers to urlkey range: exact URL, "prefix*" or "*.domain"
+func newQuery(url string) query {
+	switch {
+	case strings.HasPrefix(url, "*."):
+		host, _, _ := strings.Cut(common.SURT(strings.TrimSuffix(strings.TrimPrefix(url, "*."), "/*")), ")")
+		inRange := func(key string) bool { return strings.HasPrefix(key, host) }
+		return query{start: host, inRange: inRange, match: func(key string) bool {
+			return strings.HasPrefix(key, host+")") || strings.HasPrefix(key, host+",")
+		}}
+	case strings.HasSuffix(url, "*"):
+		prefix := strings.TrimSuffix(common.SURT(strings.TrimSuffix(url, "*")), "/")
+		inRange := func(key string) bool { return strings.HasPrefix(key, prefix) }
+		return query{start: prefix, inRange: inRange, match: inRange}
+	default:
+		urlkey := common.SURT(url)
+		exact := func(key string) bool { return key == urlkey }
+		return query{start: urlkey, inRange: exact, match: exact}
+	}
+}
+
+// fetchBatch ... Reads up to BATCH_SIZE records of all indexes after resume key, from the query start if key is empty.
+// Returns resume key of the last read line to continue from.
+func (l *LocalCDX) fetchBatch(ctx context.Context, q query, filter *common.ConfigFilter, after string) ([]*common.CdxResponse, string, error) {
+	start, skip := q.start, 0
+	if after != "" {
+		start, skip = parseResumeKey(after)
+	}
+
+	lines, err := l.search(start)
+	if err != nil {
+		return nil, "", err
+	}
+	defer lines.Close()
+
+	// Overlapping indexes have equal lines, they are counted to skip only ones read before
+	last, count := start, skip
+	results := []*common.CdxResponse{}
+	for len(results) < BATCH_SIZE && !filter.Done() {
+		if err := ctx.Err(); err != nil {
+			return nil, "", err
+		}
+
+		line, fields, err := lines.Next()
+		if err == io.EOF {
+			return results, "", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if isMeta(line) || string(line) < start {
+			continue
+		}
+		if skip > 0 && string(line) == start {
+			skip--
+			continue
+		}
+
+		key, _, _ := strings.Cut(string(line), " ")
+		if !q.inRange(key) {
+			return results, "", nil
+		}
+		if string(line) == last {
+			count++
+		} else {
+			last, count = string(line), 1
+		}
+		if !q.match(key) {
+			continue
+		}
+
+		res, err := l.parseLine(line, fields)
+		if err != nil {
+			return nil, "", common.NewError(common.KindParse, "FetchBatch", "", err)
+		}
+		if filter.Keep(res) {
+			results = append(results, res)
+		}
+	}
+
+	if filter.Done() {
+		return results, "", nil
+	}
+	return results, fmt.Sprintf("%d %s", count, last), nil
+}
+
+// parseResumeKey ... Returns line and number of its copies read before. Keys of older checkpoints are the line only.
+func parseResumeKey(key string) (string, int) {
+	count, line, ok := strings.Cut(key, " ")
+	if n, err := strconv.Atoi(count); ok && err == nil && n > 0 {
+		return line, n
+	}
+	return key, 1
+}
+
+// search ... Opens cursors of all indexes at key, merged in sorted order
+func (l *LocalCDX) search(key string) (*mergedCursor, error) {
+	merged := &mergedCursor{}
+	for _, idx := range l.indexes {
+		cur, err := idx.Search(key)
+		if err != nil {
+			merged.Close()
+			return nil, fmt.Errorf("Cannot search %v: %v", idx.Path(), err)
+		}
+		merged.cursors = append(merged.cursors, cur)
+		merged.lines = append(merged.lines, nil)
+	}
+	return merged, nil
+}
+
+// mergedCursor ... Returns lines of several cursors in sorted order
+type mergedCursor struct {
+	cursors []cursor
+	lines   [][]byte // Next line of each cursor, nil if not read yet
+}
+
+// Next ... Returns the least of the next lines and columns of its index
+func (m *mergedCursor) Next() ([]byte, []string, error) {
+	least := -1
+	for i, cur := range m.cursors {
+		if cur == nil {
+			continue
+		}
+		if m.lines[i] == nil {
+			line, err := cur.Next()
+			if err == io.EOF {
+				cur.Close()
+				m.cursors[i] = nil
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			m.lines[i] = line
+		}
+		if least < 0 || bytes.Compare(m.lines[i], m.lines[least]) < 0 {
+			least = i
+		}
+	}
+
+	if least < 0 {
+		return nil, nil, io.EOF
+	}
+	line := m.lines[least]
+	m.lines[least] = nil
+	return line, m.cursors[least].Fields(), nil
+}
+
+func (m *mergedCursor) Close() error {
+	for i, cur := range m.cursors {
+		if cur != nil {
+			cur.Close()
+			m.cursors[i] = nil
+		}
+	}
+	return nil
+}
+
+func (l *LocalCDX) pager(config common.RequestConfig) common.PageFunc {
+	filter, err := common.NewConfigFilter(config)
+	if err != nil {
+		err = common.WrapError(err, "Iterate", l.Name(), config.URL, -1)
+		return func(context.Context) ([]*common.CdxResponse, error) { return nil, err }
+	}
+
+	q := newQuery(config.URL)
+	return common.NewResumePager(config, func(ctx context.Context, after string) ([]*common.CdxResponse, string, error) {
+		results, next, err := l.fetchBatch(ctx, q, filter, after)
+		if err != nil {
+			return nil, "", common.WrapError(err, "FetchBatch", l.Name(), config.URL, -1)
+		}
+		return results, next, nil
+	})
+}
+
+// Iterate ... Returns iterator over index records matching config, indexes are read in batches of BATCH_SIZE records
+func (l *LocalCDX) Iterate(ctx context.Context, config common.RequestConfig) *common.Iterator {
+	return common.NewIterator(ctx, l.pager(config))
+}
+
+// GetPages ... Reads all index records matching config
+func (l *LocalCDX) GetPages(config common.RequestConfig) ([]*common.CdxResponse, error) {
+	return l.GetPagesContext(context.Background(), config)
+}
+
+// GetPagesContext ... Same as GetPages, but reading is aborted when ctx is done
+func (l *LocalCDX) GetPagesContext(ctx context.Context, config common.RequestConfig) ([]*common.CdxResponse, error) {
+	return common.Collect(l.Iterate(ctx, config))
+}
+
+// FetchPages ... Concurrent way to GetPages.
+//
+// Deprecated: use Iterate, channels are never closed and completion is not signaled.
+func (l *LocalCDX) FetchPages(config common.RequestConfig, results chan []*common.CdxResponse, errors chan error) {
+	l.FetchPagesContext(context.Background(), config, results, errors)
+}
+
+// FetchPagesContext ... Same as FetchPages, but returns as soon as ctx is done.
+//
+// Deprecated: use Iterate.
+func (l *LocalCDX) FetchPagesContext(ctx context.Context, config common.RequestConfig, results chan []*common.CdxResponse, errors chan error) {
+	common.FetchPages(ctx, l.pager(config), results, errors)
+}
+
+// warcPath ... Path of WARC file with the record
+func (l *LocalCDX) warcPath(page *common.CdxResponse) (string, error) {
+	if l.warcDir == "" {
+		return "", fmt.Errorf("WARC directory is not set")
+	}
+	if page.Filename == "" || page.Offset == "" || page.Length == "" {
+		return "", fmt.Errorf("Record has no WARC location")
+	}
+	return filepath.Join(l.warcDir, filepath.FromSlash(page.Filename)), nil
+}
+
+// readRecord ... Reads WARC record of a capture from local WARC file, returns its header fields and content
+func (l *LocalCDX) readRecord(page *common.CdxResponse) (http.Header, []byte, error) {
+	path, err := l.warcPath(page)
+	if err != nil {
+		return nil, nil, err
+	}
+	offset, err := strconv.ParseInt(page.Offset, 10, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid offset %q", page.Offset)
+	}
+	length, err := strconv.ParseInt(page.Length, 10, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid length %q", page.Length)
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, common.NewError(common.KindNotFound, "ReadRecord", path, err)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	reader, err := warc.NewReader(io.NewSectionReader(file, offset, length))
+	if err != nil {
+		return nil, nil, common.NewError(common.KindWARC, "ReadRecord", path, err)
+	}
+	defer reader.Close()
+
+	record, err := reader.ReadRecord()
+	if err != nil {
+		return nil, nil, common.NewError(common.KindWARC, "ReadRecord", path, err)
+	}
+
+	warcHeader := http.Header{}
+	for k, v := range record.Header {
+		warcHeader.Set(k, v)
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, record.Content); err != nil {
+		return nil, nil, common.NewError(common.KindWARC, "ReadRecord", path, err)
+	}
+	return warcHeader, buf.Bytes(), nil
+}
+
+// readVerifiedRecord ... Same as readRecord, but the record block and payload are checked against digests
+func (l *LocalCDX) readVerifiedRecord(page *common.CdxResponse, op string) (http.Header, []byte, error) {
+	warcHeader, content, err := l.readRecord(page)
+	if err == nil {
+		err = common.VerifyBlockDigest(page, warcHeader, content)
+	}
+	if err == nil {
+		err = common.VerifyHTTPDigest(page, content)
+	}
+	if err != nil {
+		return nil, nil, common.WrapError(err, op, l.Name(), page.Filename, -1)
+	}
+	return warcHeader, content, nil
+}
+
+// GetFile ... Reads capture payload from local WARC file, de-chunked and decoded
+func (l *LocalCDX) GetFile(page *common.CdxResponse) ([]byte, error) {
+	return l.GetFileContext(context.Background(), page)
+}
+
+// GetFileContext ... Same as GetFile
+func (l *LocalCDX) GetFileContext(ctx context.Context, page *common.CdxResponse) ([]byte, error) {
+	_, content, err := l.readVerifiedRecord(page, "GetFile")
+	if err != nil {
+		return nil, err
+	}
+
+	capture, err := common.ParseHTTPResponse(page, content)
+	if err != nil {
+		return nil, &common.Error{Kind: common.KindWARC, Op: "GetFile", Source: l.Name(), URL: page.Filename, Page: -1, Err: err}
+	}
+	return capture.Body, nil
+}
+
+// GetCapture ... Reads capture from local WARC file with parsed HTTP response and WARC headers
+func (l *LocalCDX) GetCapture(page *common.CdxResponse) (*common.Capture, error) {
+	return l.GetCaptureContext(context.Background(), page)
+}
+
+// GetCaptureContext ... Same as GetCapture
+func (l *LocalCDX) GetCaptureContext(ctx context.Context, page *common.CdxResponse) (*common.Capture, error) {
+	warcHeader, content, err := l.readVerifiedRecord(page, "GetCapture")
+	if err != nil {
+		return nil, err
+	}
+
+	capture, err := common.ParseHTTPResponse(page, content)
+	if err != nil {
+		return nil, &common.Error{Kind: common.KindWARC, Op: "GetCapture", Source: l.Name(), URL: page.Filename, Page: -1, Err: err}
+	}
+	capture.WARCHeader = warcHeader
+	return capture, nil
+}
+
+// OpenFile ... Opens stream of decoded capture payload. Stream must be closed.
+func (l *LocalCDX) OpenFile(ctx context.Context, page *common.CdxResponse) (io.ReadCloser, error) {
+	payload, err := l.OpenPayload(ctx, page)
+	if err != nil {
+		return nil, common.WrapError(err, "OpenFile", l.Name(), page.Filename, -1)
+	}
+
+	body, err := payload.Decode()
+	if err != nil {
+		return nil, common.WrapError(err, "OpenFile", l.Name(), page.Filename, -1)
+	}
+	return body, nil
+}
+
+// OpenPayload ... Opens de-chunked capture payload without decoding it. WARC record is read into memory.
+func (l *LocalCDX) OpenPayload(ctx context.Context, page *common.CdxResponse) (*common.Payload, error) {
+	_, content, err := l.readVerifiedRecord(page, "OpenPayload")
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(content)), nil)
+	if err != nil {
+		return nil, &common.Error{Kind: common.KindWARC, Op: "OpenPayload", Source: l.Name(), URL: page.Filename, Page: -1, Err: fmt.Errorf("Cannot parse HTTP response: %v", err)}
+	}
+	defer resp.Body.Close()
+
+	// Truncated payloads are returned as is
+	body, _ := io.ReadAll(resp.Body)
+	return &common.Payload{ReadCloser: io.NopCloser(bytes.NewReader(body)), Encoding: resp.Header.Get("Content-Encoding")}, nil
+}
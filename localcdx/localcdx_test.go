@@ -0,0 +1,303 @@
+package localcdx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	common "github.com/karust/gogetcrawl/common"
+	"github.com/karust/gogetcrawl/testutil"
+)
+
+// Test interface
+var lctest common.Source = &LocalCDX{}
+
+var dir string       // Indexes and WARC file of test captures
+var records []string // CDX lines of all captures, sorted
+var captures []testutil.Capture
+
+func TestMain(m *testing.M) {
+	var err error
+	if dir, err = os.MkdirTemp("", "localcdx"); err != nil {
+		panic(err)
+	}
+
+	urls := []string{"https://example.com/", "https://example.com/about", "https://example.com/about/team", "https://blog.example.com/post",
+		"https://example.org/", "https://examplefoo.com/"}
+	for _, url := range urls {
+		for _, ts := range []string{"20200101000000", "20200101120000", "20210301000000"} {
+			captures = append(captures, testutil.HTMLCapture(url, ts, 200))
+		}
+	}
+	writeFixtures()
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// Writes captures into WARC file, the first half of their records into plain CDX and ZipNum cluster, the rest into CDXJ
+func writeFixtures() {
+	var warcFile bytes.Buffer
+	var cdxj []string
+	for i, c := range captures {
+		c.StatusCode, c.MimeType = 200, "text/html"
+		record := testutil.WARCRecord(c)
+		offset := warcFile.Len()
+		warcFile.Write(record)
+
+		key, digest := common.SURT(c.URL), testutil.Digest(c.Body)
+		line := fmt.Sprintf("%v %v %v text/html 200 %v - - %v %v test.warc.gz", key, c.Timestamp, c.URL, digest, len(record), offset)
+		records = append(records, line)
+		if i%2 == 1 {
+			cdxj = append(cdxj, fmt.Sprintf(`%v %v {"url": "%v", "mime": "text/html", "status": "200", "digest": "%v", "length": "%v", "offset": "%v", "filename": "test.warc.gz"}`,
+				key, c.Timestamp, c.URL, digest, len(record), offset))
+		}
+	}
+	sort.Strings(records)
+	sort.Strings(cdxj)
+
+	var plain []string
+	for i, c := range captures {
+		if i%2 == 0 {
+			for _, line := range records {
+				if strings.HasPrefix(line, common.SURT(c.URL)+" "+c.Timestamp+" ") {
+					plain = append(plain, line)
+				}
+			}
+		}
+	}
+	sort.Strings(plain)
+
+	os.MkdirAll(filepath.Join(dir, "indexes"), 0755)
+	os.MkdirAll(filepath.Join(dir, "cluster"), 0755)
+	os.WriteFile(filepath.Join(dir, "test.warc.gz"), warcFile.Bytes(), 0644)
+	os.WriteFile(filepath.Join(dir, "indexes", "plain.cdx"), []byte(" CDX N b a m s k r M S V g\n"+strings.Join(plain, "\n")+"\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "indexes", "other.cdxj"), []byte("!meta 0 {\"format\": \"cdxj\"}\n"+strings.Join(cdxj, "\n")+"\n"), 0644)
+	writeZipNum(filepath.Join(dir, "cluster"), records, 4)
+}
+
+// Writes lines into ZipNum cluster with blocks of blockLines lines
+func writeZipNum(dir string, lines []string, blockLines int) {
+	var shard bytes.Buffer
+	var summary []string
+	for i := 0; i < len(lines); i += blockLines {
+		end := i + blockLines
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		offset := shard.Len()
+		gz := gzip.NewWriter(&shard)
+		gz.Write([]byte(strings.Join(lines[i:end], "\n") + "\n"))
+		gz.Close()
+
+		key := strings.Join(strings.Fields(lines[i])[:2], " ")
+		summary = append(summary, fmt.Sprintf("%v\tcdx-00000\t%v\t%v\t%v", key, offset, shard.Len()-offset, i/blockLines+1))
+	}
+	os.WriteFile(filepath.Join(dir, "cdx-00000.gz"), shard.Bytes(), 0644)
+	os.WriteFile(filepath.Join(dir, "cluster.idx"), []byte(strings.Join(summary, "\n")+"\n"), 0644)
+}
+
+func newSource(t *testing.T, paths ...string) *LocalCDX {
+	l, err := New(paths, WithWARCDir(dir))
+	if err != nil {
+		t.Fatalf("Cannot open indexes: %v", err)
+	}
+	return l
+}
+
+func TestLowerBound(t *testing.T) {
+	var lines []string
+	for i := 0; i < 5000; i++ {
+		lines = append(lines, fmt.Sprintf("key%05d %v", i*2, strings.Repeat("x", i%300)))
+	}
+	data := []byte(strings.Join(lines, "\n") + "\n")
+	r := bytes.NewReader(data)
+
+	for _, n := range []int{0, 1, 2, 3, 4999, 5000, 9997, 9998, 9999, 20000} {
+		key := fmt.Sprintf("key%05d", n)
+		start, err := lowerBound(r, int64(len(data)), key)
+		if err != nil {
+			t.Fatalf("Cannot search %v: %v", key, err)
+		}
+
+		// The first line not less than key follows the found one
+		want := sort.SearchStrings(lines, key)
+		got := strings.Count(string(data[:start]), "\n")
+		if got != want-1 && !(want == 0 && got == 0) {
+			t.Fatalf("Incorrect line found for %v: %v, want=%v", key, got, want-1)
+		}
+	}
+}
+
+func TestGetPages(t *testing.T) {
+	sources := map[string]*LocalCDX{
+		"merged":  newSource(t, filepath.Join(dir, "indexes")),
+		"zipnum":  newSource(t, filepath.Join(dir, "cluster", "cluster.idx")),
+		"cdxjcdx": newSource(t, filepath.Join(dir, "indexes", "other.cdxj"), filepath.Join(dir, "indexes", "plain.cdx")),
+	}
+
+	cases := []struct {
+		config common.RequestConfig
+		want   int
+	}{
+		{common.RequestConfig{URL: "example.com"}, 3},
+		{common.RequestConfig{URL: "https://www.example.com/about"}, 3},
+		{common.RequestConfig{URL: "example.com/about*"}, 6},
+		{common.RequestConfig{URL: "example.com/*"}, 9},
+		{common.RequestConfig{URL: "*.example.com"}, 12},
+		{common.RequestConfig{URL: "example.com/missing"}, 0},
+		{common.RequestConfig{URL: "*.example.com", FromDate: "2021"}, 4},
+		{common.RequestConfig{URL: "*.example.com", Limit: 5}, 5},
+		{common.RequestConfig{URL: "*.example.com", Collapse: []string{"urlkey"}}, 4},
+		{common.RequestConfig{URL: "*.example.com", Filters: []string{"original:.*about.*"}}, 6},
+	}
+	for name, source := range sources {
+		for _, c := range cases {
+			results, err := source.GetPages(c.config)
+			if err != nil {
+				t.Fatalf("[%v] Cannot get pages for %+v: %v", name, c.config, err)
+			}
+			if len(results) != c.want {
+				t.Fatalf("[%v] Incorrect number of results for %+v: %v, want=%v", name, c.config, len(results), c.want)
+			}
+
+			for i, res := range results {
+				if i > 0 && res.Urlkey+" "+res.Timestamp < results[i-1].Urlkey+" "+results[i-1].Timestamp {
+					t.Fatalf("[%v] Results are not sorted: %v", name, results)
+				}
+				if res.Digest == "" || res.Filename != "test.warc.gz" || res.Source.Name() != "LocalCDX" {
+					t.Fatalf("[%v] Incorrect record: %+v", name, res)
+				}
+			}
+		}
+	}
+}
+
+func TestBatches(t *testing.T) {
+	// Enough lines for several batches, with equal keys crossing batch bounds
+	var lines []string
+	for i := 0; i < BATCH_SIZE*2+10; i++ {
+		lines = append(lines, fmt.Sprintf("com,example)/page%v 2020%010d http://example.com/page%v text/html 200 AAA - - 10 0 test.warc.gz", i%3, i, i%3))
+	}
+	sort.Strings(lines)
+	path := filepath.Join(t.TempDir(), "big.cdx")
+	os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+
+	l := newSource(t, path)
+	results, err := l.GetPages(common.RequestConfig{URL: "example.com/page1"})
+	if err != nil {
+		t.Fatalf("Cannot get pages: %v", err)
+	}
+	if len(results) != 670 {
+		t.Fatalf("Incorrect number of results: %v, want=670", len(results))
+	}
+
+	cp := &common.Checkpoint{}
+	it := l.Iterate(context.Background(), common.RequestConfig{URL: "example.com/*", Checkpoint: cp})
+	// Batch is saved once the next one is requested
+	for i := 0; i <= BATCH_SIZE && it.Next(); i++ {
+	}
+	it.Close()
+	if cp.ResumeKey == "" {
+		t.Fatalf("Resume key of the first batch is not saved")
+	}
+
+	// Resumed query continues after the last batch
+	results, err = l.GetPages(common.RequestConfig{URL: "example.com/*", Checkpoint: &common.Checkpoint{ResumeKey: cp.ResumeKey, Results: cp.Results}})
+	if err != nil {
+		t.Fatalf("Cannot resume: %v", err)
+	}
+	if len(results) != len(lines)-BATCH_SIZE {
+		t.Fatalf("Incorrect number of resumed results: %v, want=%v", len(results), len(lines)-BATCH_SIZE)
+	}
+}
+
+func TestOverlappingBatches(t *testing.T) {
+	// The same lines in two indexes, the first index has one more line so a batch ends between equal lines
+	var lines []string
+	for i := 0; i < BATCH_SIZE; i++ {
+		lines = append(lines, fmt.Sprintf("com,example)/page 2020%010d http://example.com/page text/html 200 AAA - - 10 0 test.warc.gz", i))
+	}
+	tmp := t.TempDir()
+	first, second := filepath.Join(tmp, "first.cdx"), filepath.Join(tmp, "second.cdx")
+	os.WriteFile(first, []byte("com,example)/a 20200101000000 http://example.com/a text/html 200 AAA - - 10 0 test.warc.gz\n"+strings.Join(lines, "\n")+"\n"), 0644)
+	os.WriteFile(second, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+
+	l := newSource(t, first, second)
+	results, err := l.GetPages(common.RequestConfig{URL: "example.com/*"})
+	if err != nil {
+		t.Fatalf("Cannot get pages: %v", err)
+	}
+	if len(results) != 2*BATCH_SIZE+1 {
+		t.Fatalf("Incorrect number of results: %v, want=%v", len(results), 2*BATCH_SIZE+1)
+	}
+
+	// Query resumed after the first batch reads the second copy of its last line
+	cp := &common.Checkpoint{}
+	it := l.Iterate(context.Background(), common.RequestConfig{URL: "example.com/*", Checkpoint: cp})
+	for i := 0; i <= BATCH_SIZE && it.Next(); i++ {
+	}
+	it.Close()
+
+	results, err = l.GetPages(common.RequestConfig{URL: "example.com/*", Checkpoint: &common.Checkpoint{ResumeKey: cp.ResumeKey, Results: cp.Results}})
+	if err != nil {
+		t.Fatalf("Cannot resume: %v", err)
+	}
+	if len(results) != BATCH_SIZE+1 {
+		t.Fatalf("Incorrect number of resumed results: %v, want=%v", len(results), BATCH_SIZE+1)
+	}
+}
+
+func TestGetFile(t *testing.T) {
+	l := newSource(t, filepath.Join(dir, "cluster", "cluster.idx"))
+	results, err := l.GetPages(common.RequestConfig{URL: "example.org/"})
+	if err != nil || len(results) != 3 {
+		t.Fatalf("Cannot get pages: %v, %v", results, err)
+	}
+
+	file, err := l.GetFile(results[0])
+	if err != nil {
+		t.Fatalf("Cannot get file: %v", err)
+	}
+	if !bytes.Equal(file, testutil.HTMLCapture("https://example.org/", "20200101000000", 200).Body) {
+		t.Fatalf("Incorrect file: %q", file)
+	}
+
+	capture, err := l.GetCapture(results[1])
+	if err != nil {
+		t.Fatalf("Cannot get capture: %v", err)
+	}
+	if !bytes.Equal(capture.Body, testutil.HTMLCapture("https://example.org/", "20200101120000", 200).Body) || capture.WARCHeader.Get("WARC-Type") != "response" {
+		t.Fatalf("Incorrect capture: %+v", capture)
+	}
+
+	stream, err := l.OpenFile(context.Background(), results[2])
+	if err != nil {
+		t.Fatalf("Cannot open file: %v", err)
+	}
+	defer stream.Close()
+	if data, _ := io.ReadAll(stream); !bytes.Equal(data, testutil.HTMLCapture("https://example.org/", "20210301000000", 200).Body) {
+		t.Fatalf("Incorrect file stream: %q", data)
+	}
+
+	wrong := *results[0]
+	wrong.Digest = results[1].Digest
+	if _, err := l.GetFile(&wrong); !errors.Is(err, common.ErrDigestMismatch) {
+		t.Fatalf("Incorrect error of digest mismatch: %v", err)
+	}
+
+	wrong.Filename = "missing.warc.gz"
+	if _, err := l.GetFile(&wrong); !errors.Is(err, common.ErrNotFound) {
+		t.Fatalf("Incorrect error of missing WARC: %v", err)
+	}
+}
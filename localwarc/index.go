@@ -0,0 +1,429 @@
+package localwarc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/heap"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	common "github.com/karust/gogetcrawl/common"
+	"github.com/karust/gogetcrawl/output"
+	"github.com/slyrz/warc"
+)
+
+const MERGE_FAN_IN = 64 // Max number of sorted runs merged at once
+
+// Fields of CDXJ index lines after urlkey and timestamp
+var indexFields = []string{"url", "mime", "status", "digest", "length", "offset", "filename"}
+
+// countingReader ... Counts bytes consumed from file, so offsets of gzip members are known.
+// It's a flate.Reader, so gzip reads exactly the bytes of a member.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// indexFile ... Returns CDX records of captures in WARC file, filename is the record Filename
+func indexFile(path, filename string) ([]*common.CdxResponse, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, 1<<16)
+	magic, err := reader.Peek(2)
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		return indexGzip(reader, filename)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return indexPlain(file, info.Size(), reader, filename)
+}
+
+// indexGzip ... Indexes WARC file with each record compressed into a separate gzip member
+func indexGzip(reader *bufio.Reader, filename string) ([]*common.CdxResponse, error) {
+	counter := &countingReader{r: reader}
+	var results []*common.CdxResponse
+	var gz *gzip.Reader
+
+	for {
+		if _, err := reader.Peek(1); err == io.EOF {
+			return results, nil
+		}
+
+		offset := counter.n
+		var err error
+		if gz == nil {
+			gz, err = gzip.NewReader(counter)
+		} else {
+			err = gz.Reset(counter)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read gzip member at %v: %v", offset, err)
+		}
+		gz.Multistream(false)
+
+		res, err := readMember(gz)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read record at %v: %v", offset, err)
+		}
+		if res != nil {
+			res.Offset = strconv.FormatInt(offset, 10)
+			res.Length = strconv.FormatInt(counter.n-offset, 10)
+			res.Filename = filename
+			results = append(results, res)
+		}
+	}
+}
+
+// readMember ... Describes record in gzip member and reads the member to its end
+func readMember(gz *gzip.Reader) (*common.CdxResponse, error) {
+	reader, err := warc.NewReaderMode(gz, warc.SequentialMode)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	record, err := reader.ReadRecord()
+	if err != nil {
+		return nil, err
+	}
+	res, err := describe(record)
+	if err != nil {
+		return nil, err
+	}
+
+	if next, err := reader.ReadRecord(); next != nil && err == nil {
+		return nil, fmt.Errorf("Several records in a gzip member, records must be compressed separately to be indexed")
+	}
+	if _, err := io.Copy(io.Discard, gz); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// indexPlain ... Indexes uncompressed WARC file, records are located by their headers and parsed again from the file
+func indexPlain(file *os.File, size int64, reader *bufio.Reader, filename string) ([]*common.CdxResponse, error) {
+	var results []*common.CdxResponse
+	offset := int64(0)
+
+	for {
+		// Skip empty lines between records
+		line, err := reader.ReadString('\n')
+		for err == nil && strings.TrimSpace(line) == "" {
+			offset += int64(len(line))
+			line, err = reader.ReadString('\n')
+		}
+		if err == io.EOF && strings.TrimSpace(line) == "" {
+			return results, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read record at %v: %v", offset, err)
+		}
+		if !strings.HasPrefix(line, "WARC/") {
+			return nil, fmt.Errorf("No WARC record at %v", offset)
+		}
+
+		// Header ends with an empty line, then Content-Length bytes of block and two new lines
+		headerLength, contentLength := int64(len(line)), int64(-1)
+		for {
+			line, err = reader.ReadString('\n')
+			if err != nil {
+				return nil, fmt.Errorf("Cannot read record header at %v: %v", offset, err)
+			}
+			headerLength += int64(len(line))
+			if strings.TrimSpace(line) == "" {
+				break
+			}
+			if name, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+				if contentLength, err = strconv.ParseInt(strings.TrimSpace(value), 10, 64); err != nil {
+					return nil, fmt.Errorf("Invalid Content-Length of record at %v", offset)
+				}
+			}
+		}
+		if contentLength < 0 {
+			return nil, fmt.Errorf("No Content-Length of record at %v", offset)
+		}
+
+		if offset+headerLength+contentLength > size {
+			return nil, fmt.Errorf("Truncated record at %v", offset)
+		}
+		if _, err := reader.Discard(int(contentLength)); err != nil {
+			return nil, err
+		}
+
+		// Record length includes its trailing new lines
+		length := headerLength + contentLength
+		for i := 0; i < 2; i++ {
+			if next, err := reader.Peek(1); err != nil || (next[0] != '\r' && next[0] != '\n') {
+				break
+			}
+			line, _ := reader.ReadString('\n')
+			length += int64(len(line))
+		}
+
+		res, err := describeAt(file, offset, length)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read record at %v: %v", offset, err)
+		}
+		if res != nil {
+			res.Offset = strconv.FormatInt(offset, 10)
+			res.Length = strconv.FormatInt(length, 10)
+			res.Filename = filename
+			results = append(results, res)
+		}
+		offset += length
+	}
+}
+
+func describeAt(file *os.File, offset, length int64) (*common.CdxResponse, error) {
+	reader, err := warc.NewReaderMode(io.NewSectionReader(file, offset, length), warc.SequentialMode)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	record, err := reader.ReadRecord()
+	if err != nil {
+		return nil, err
+	}
+	return describe(record)
+}
+
+// describe ... Returns CDX record of capture, nil for records which are not captures like requests and metadata.
+// Revisits have "warc/revisit" MIME type, like in pywb indexes.
+func describe(record *warc.Record) (*common.CdxResponse, error) {
+	recordType := strings.ToLower(record.Header.Get("WARC-Type"))
+	if recordType != "response" && recordType != "revisit" && recordType != "resource" {
+		return nil, nil
+	}
+
+	uri := strings.Trim(record.Header.Get("WARC-Target-URI"), "<>")
+	date, err := time.Parse(time.RFC3339Nano, record.Header.Get("WARC-Date"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid WARC-Date %q", record.Header.Get("WARC-Date"))
+	}
+
+	res := &common.CdxResponse{
+		Urlkey:    common.SURT(uri),
+		Timestamp: common.FormatTimestamp(date),
+		Original:  uri,
+		Digest:    common.NormalizeDigest(record.Header.Get("WARC-Payload-Digest")),
+	}
+
+	if recordType == "resource" {
+		res.StatusCode = "200"
+		res.MimeType = mediaType(record.Header.Get("Content-Type"))
+		if res.Digest == "" {
+			payload, err := io.ReadAll(record.Content)
+			if err != nil {
+				return nil, err
+			}
+			res.Digest = common.PayloadDigest(payload)
+		}
+		return res, nil
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(record.Content), nil)
+	if err != nil {
+		if recordType == "revisit" {
+			// Revisits may have no HTTP headers
+			res.MimeType = "warc/revisit"
+			return res, nil
+		}
+		return nil, fmt.Errorf("Cannot parse HTTP response: %v", err)
+	}
+	defer resp.Body.Close()
+
+	res.StatusCode = strconv.Itoa(resp.StatusCode)
+	res.MimeType = mediaType(resp.Header.Get("Content-Type"))
+	if recordType == "revisit" {
+		res.MimeType = "warc/revisit"
+	} else if res.Digest == "" {
+		// Truncated payload is digested as is
+		payload, _ := io.ReadAll(resp.Body)
+		res.Digest = common.PayloadDigest(payload)
+	}
+	return res, nil
+}
+
+// MIME type without parameters like charset, "unk" if unknown like in CDX indexes
+func mediaType(contentType string) string {
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediatype == "" {
+		return "unk"
+	}
+	return mediatype
+}
+
+// writeRun ... Writes records into sorted CDXJ file
+func writeRun(path string, results []*common.CdxResponse) error {
+	var buf bytes.Buffer
+	writer, err := output.NewWriter(&buf, output.FormatCDXJ, indexFields)
+	if err != nil {
+		return err
+	}
+	for _, res := range results {
+		if err := writer.Write(res); err != nil {
+			return err
+		}
+	}
+
+	lines := strings.SplitAfter(buf.String(), "\n")
+	sort.Strings(lines)
+	return os.WriteFile(path, []byte(strings.Join(lines, "")), 0644)
+}
+
+// mergeRuns ... Merges sorted files into sorted file at path, in several passes if there are more than MERGE_FAN_IN of them.
+// Merged files are removed.
+func mergeRuns(runs []string, path string) error {
+	for pass := 0; len(runs) > MERGE_FAN_IN; pass++ {
+		var merged []string
+		for i := 0; i < len(runs); i += MERGE_FAN_IN {
+			end := i + MERGE_FAN_IN
+			if end > len(runs) {
+				end = len(runs)
+			}
+			out := fmt.Sprintf("%v.pass%v-%v", path, pass, i/MERGE_FAN_IN)
+			if err := mergeFiles(runs[i:end], out); err != nil {
+				return err
+			}
+			merged = append(merged, out)
+		}
+		runs = merged
+	}
+	return mergeFiles(runs, path)
+}
+
+// mergeFiles ... Merges sorted files into a new one, written to a temporary file and renamed when complete
+func mergeFiles(paths []string, out string) error {
+	lines := &lineHeap{}
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		source := &runReader{reader: bufio.NewReader(file)}
+		if ok, err := source.next(); err != nil {
+			return err
+		} else if ok {
+			lines.runs = append(lines.runs, source)
+		}
+	}
+	heap.Init(lines)
+
+	tmp := out + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+
+	for lines.Len() > 0 {
+		source := lines.runs[0]
+		if _, err := writer.WriteString(source.line); err != nil {
+			return err
+		}
+
+		ok, err := source.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(lines, 0)
+		} else {
+			heap.Pop(lines)
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if path != out {
+			os.Remove(path)
+		}
+	}
+	return os.Rename(tmp, out)
+}
+
+// runReader ... Current line of sorted file being merged
+type runReader struct {
+	reader *bufio.Reader
+	line   string
+}
+
+func (r *runReader) next() (bool, error) {
+	line, err := r.reader.ReadString('\n')
+	if err == io.EOF {
+		if line == "" {
+			return false, nil
+		}
+		line += "\n"
+	} else if err != nil {
+		return false, err
+	}
+	r.line = line
+	return true, nil
+}
+
+// lineHeap ... Runs ordered by their current lines
+type lineHeap struct {
+	runs []*runReader
+}
+
+func (h *lineHeap) Len() int           { return len(h.runs) }
+func (h *lineHeap) Less(i, j int) bool { return h.runs[i].line < h.runs[j].line }
+func (h *lineHeap) Swap(i, j int)      { h.runs[i], h.runs[j] = h.runs[j], h.runs[i] }
+func (h *lineHeap) Push(x any)         { h.runs = append(h.runs, x.(*runReader)) }
+func (h *lineHeap) Pop() any {
+	last := h.runs[len(h.runs)-1]
+	h.runs = h.runs[:len(h.runs)-1]
+	return last
+}
+
+// isWARC ... Reports whether file name has WARC extension
+func isWARC(name string) bool {
+	name = strings.ToLower(filepath.Base(name))
+	return strings.HasSuffix(name, ".warc") || strings.HasSuffix(name, ".warc.gz")
+}
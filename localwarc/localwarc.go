@@ -0,0 +1,304 @@
+// Package localwarc implements common.Source for a local directory of WARC files, indexed on the fly.
+//
+// Response, revisit and resource records of .warc and .warc.gz files are indexed into a sorted CDXJ file
+// in the index directory, then searched and downloaded like with localcdx. The index is updated when
+// the source is created: new WARCs are indexed and merged into it, changed or removed ones cause a rebuild.
+// Compressed WARCs must have each record in a separate gzip member, like Common Crawl and Wayback WARCs.
+package localwarc
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/karust/gogetcrawl/localcdx"
+)
+
+const (
+	INDEX_FILE    = "index.cdxj"    // Sorted CDXJ index of all WARCs in index directory
+	MANIFEST_FILE = "manifest.json" // Indexed WARCs in index directory
+)
+
+// LocalWARC ... Source of WARC files in a directory. Queries and downloads are done by embedded LocalCDX
+// reading the generated index.
+type LocalWARC struct {
+	*localcdx.LocalCDX
+	name     string
+	dir      string
+	indexDir string
+	workers  int
+}
+
+// Option ... Configures LocalWARC source in New
+type Option func(*LocalWARC)
+
+// WithName ... Sets source name, "LocalWARC" by default
+func WithName(name string) Option {
+	return func(l *LocalWARC) {
+		l.name = name
+	}
+}
+
+// WithIndexDir ... Sets directory of the index, by default it's in user cache directory, separate for each WARC directory
+func WithIndexDir(dir string) Option {
+	return func(l *LocalWARC) {
+		l.indexDir = dir
+	}
+}
+
+// WithWorkers ... Sets number of WARC files indexed at once, number of CPUs by default
+func WithWorkers(workers int) Option {
+	return func(l *LocalWARC) {
+		if workers > 0 {
+			l.workers = workers
+		}
+	}
+}
+
+// fileState ... Indexed WARC file, it's indexed again if size or modification time changes
+type fileState struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// manifest ... WARC files in the index by their paths relative to WARC directory
+type manifest struct {
+	Dir     string                `json:"dir"`
+	Files   map[string]*fileState `json:"files"`
+	ModTime time.Time             `json:"-"` // Modification time of manifest file
+}
+
+// New ... Creates source of WARC files in dir and its subdirectories, indexing files missing in the index
+func New(dir string, opts ...Option) (*LocalWARC, error) {
+	source := &LocalWARC{name: "LocalWARC", workers: runtime.NumCPU()}
+	for _, opt := range opts {
+		opt(source)
+	}
+
+	var err error
+	if source.dir, err = filepath.Abs(dir); err != nil {
+		return nil, fmt.Errorf("[New] %v", err)
+	}
+	if info, err := os.Stat(source.dir); err != nil {
+		return nil, fmt.Errorf("[New] %v", err)
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("[New] %v is not a directory", dir)
+	}
+
+	if source.indexDir == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return nil, fmt.Errorf("[New] Cannot find cache directory for index, set it explicitly: %v", err)
+		}
+		sum := sha1.Sum([]byte(source.dir))
+		source.indexDir = filepath.Join(cache, "gogetcrawl", "localwarc-"+hex.EncodeToString(sum[:6]))
+	}
+
+	if err := source.Update(); err != nil {
+		return nil, err
+	}
+
+	source.LocalCDX, err = localcdx.New([]string{source.IndexPath()}, localcdx.WithName(source.name), localcdx.WithWARCDir(source.dir))
+	if err != nil {
+		return nil, fmt.Errorf("[New] %v", err)
+	}
+	return source, nil
+}
+
+func (l *LocalWARC) Name() string {
+	return l.name
+}
+
+// IndexPath ... Returns path of CDXJ index of WARC files, it can be used with localcdx or other CDX tools
+func (l *LocalWARC) IndexPath() string {
+	return filepath.Join(l.indexDir, INDEX_FILE)
+}
+
+// Update ... Indexes WARC files added to directory since the last update, or all files if some were changed or removed.
+// Source reads the index from its path, so it can be updated while in use.
+func (l *LocalWARC) Update() error {
+	if err := os.MkdirAll(l.indexDir, 0755); err != nil {
+		return fmt.Errorf("[Update] Cannot create index dir: %v", err)
+	}
+
+	files, err := l.scan()
+	if err != nil {
+		return fmt.Errorf("[Update] Cannot list WARC files: %v", err)
+	}
+
+	old, err := l.loadManifest()
+	if err != nil {
+		return fmt.Errorf("[Update] %v", err)
+	}
+	// Manifest is saved after the index, older one may miss files already merged into it
+	index, err := os.Stat(l.IndexPath())
+	if err != nil || old.ModTime.Before(index.ModTime()) {
+		old.Files = map[string]*fileState{}
+	}
+
+	// Index only added files if nothing else changed
+	var added []string
+	rebuild := len(old.Files) == 0
+	for name, state := range files {
+		prev, ok := old.Files[name]
+		if !ok {
+			added = append(added, name)
+		} else if prev.Size != state.Size || !prev.ModTime.Equal(state.ModTime) {
+			rebuild = true
+		}
+	}
+	for name := range old.Files {
+		if _, ok := files[name]; !ok {
+			rebuild = true
+		}
+	}
+	if rebuild {
+		added = added[:0]
+		for name := range files {
+			added = append(added, name)
+		}
+	} else if len(added) == 0 {
+		return nil
+	}
+	sort.Strings(added)
+
+	runs, err := l.indexFiles(added)
+	if err != nil {
+		for _, run := range runs {
+			os.Remove(run)
+		}
+		return fmt.Errorf("[Update] %v", err)
+	}
+	if !rebuild {
+		runs = append(runs, l.IndexPath())
+	}
+	if err := mergeRuns(runs, l.IndexPath()); err != nil {
+		return fmt.Errorf("[Update] Cannot merge index: %v", err)
+	}
+
+	if err := l.saveManifest(files); err != nil {
+		return fmt.Errorf("[Update] Cannot save manifest: %v", err)
+	}
+	return nil
+}
+
+// scan ... Returns state of WARC files in directory by their paths relative to it
+func (l *LocalWARC) scan() (map[string]*fileState, error) {
+	files := map[string]*fileState{}
+	err := filepath.WalkDir(l.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !isWARC(path) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(l.dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(name)] = &fileState{Size: info.Size(), ModTime: info.ModTime().UTC()}
+		return nil
+	})
+	return files, err
+}
+
+func (l *LocalWARC) loadManifest() (*manifest, error) {
+	m := &manifest{Files: map[string]*fileState{}}
+	data, err := os.ReadFile(filepath.Join(l.indexDir, MANIFEST_FILE))
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read manifest: %v", err)
+	}
+	if err := jsoniter.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("Cannot decode manifest: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(l.indexDir, MANIFEST_FILE)); err == nil {
+		m.ModTime = info.ModTime()
+	}
+
+	// Index of another directory is not reused
+	if m.Dir != l.dir || m.Files == nil {
+		m.Files = map[string]*fileState{}
+	}
+	return m, nil
+}
+
+// saveManifest ... Writes manifest of indexed files into temporary file and renames it, so it's never partially written
+func (l *LocalWARC) saveManifest(files map[string]*fileState) error {
+	data, err := jsoniter.MarshalIndent(manifest{Dir: l.dir, Files: files}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(l.indexDir, MANIFEST_FILE)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// indexFiles ... Indexes WARC files by several workers, each file into a sorted run in index directory.
+// Returns paths of written runs.
+func (l *LocalWARC) indexFiles(names []string) ([]string, error) {
+	jobs := make(chan int)
+	runs := make([]string, len(names))
+	errs := make([]error, len(names))
+
+	var wg sync.WaitGroup
+	for w := 0; w < l.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results, err := indexFile(filepath.Join(l.dir, filepath.FromSlash(names[i])), names[i])
+				if err != nil {
+					errs[i] = fmt.Errorf("Cannot index %v: %v", names[i], err)
+					continue
+				}
+
+				run := filepath.Join(l.indexDir, fmt.Sprintf("run-%06d.cdxj", i))
+				if err := writeRun(run, results); err != nil {
+					errs[i] = fmt.Errorf("Cannot write index of %v: %v", names[i], err)
+					continue
+				}
+				runs[i] = run
+			}
+		}()
+	}
+
+	for i := range names {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	var written []string
+	for _, run := range runs {
+		if run != "" {
+			written = append(written, run)
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
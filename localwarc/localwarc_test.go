@@ -0,0 +1,221 @@
+package localwarc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	common "github.com/karust/gogetcrawl/common"
+	"github.com/karust/gogetcrawl/testutil"
+)
+
+// Test interface
+var lwtest common.Source = &LocalWARC{}
+
+// Writes gzip compressed WARC file of captures
+func writeWARC(t *testing.T, path string, captures ...testutil.Capture) {
+	var data []byte
+	for _, c := range captures {
+		c.StatusCode, c.MimeType = 200, "text/html; charset=utf-8"
+		data = append(data, testutil.WARCRecord(c)...)
+	}
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Cannot write WARC: %v", err)
+	}
+}
+
+// Writes uncompressed WARC file of captures, with a request record which is not indexed
+func writePlainWARC(t *testing.T, path string, captures ...testutil.Capture) {
+	var data bytes.Buffer
+	data.WriteString("WARC/1.0\r\nWARC-Type: request\r\nWARC-Target-URI: https://example.net/\r\nContent-Length: 4\r\n\r\nGET \r\n\r\n")
+	for _, c := range captures {
+		c.StatusCode, c.MimeType = 200, "text/html; charset=utf-8"
+		gz, _ := gzip.NewReader(bytes.NewReader(testutil.WARCRecord(c)))
+		record, _ := io.ReadAll(gz)
+		data.Write(record)
+	}
+	if err := os.WriteFile(path, data.Bytes(), 0644); err != nil {
+		t.Fatalf("Cannot write WARC: %v", err)
+	}
+}
+
+func newSource(t *testing.T, dir, indexDir string) *LocalWARC {
+	l, err := New(dir, WithIndexDir(indexDir), WithWorkers(2))
+	if err != nil {
+		t.Fatalf("Cannot index WARCs: %v", err)
+	}
+	return l
+}
+
+func TestIndex(t *testing.T) {
+	dir, indexDir := t.TempDir(), t.TempDir()
+	writeWARC(t, filepath.Join(dir, "a.warc.gz"),
+		testutil.HTMLCapture("https://example.com/", "20200101000000", 200),
+		testutil.HTMLCapture("https://example.org/", "20200101000000", 200))
+	writeWARC(t, filepath.Join(dir, "sub", "b.warc.gz"),
+		testutil.HTMLCapture("https://example.com/about", "20210101000000", 200))
+	writePlainWARC(t, filepath.Join(dir, "c.warc"),
+		testutil.HTMLCapture("https://example.com/", "20220101000000", 200),
+		testutil.HTMLCapture("https://blog.example.com/", "20220101000000", 200))
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a WARC"), 0644)
+
+	l := newSource(t, dir, indexDir)
+	cases := []struct {
+		config common.RequestConfig
+		want   int
+	}{
+		{common.RequestConfig{URL: "example.com"}, 2},
+		{common.RequestConfig{URL: "example.com/*"}, 3},
+		{common.RequestConfig{URL: "*.example.com"}, 4},
+		{common.RequestConfig{URL: "example.net"}, 0},
+		{common.RequestConfig{URL: "*.example.com", FromDate: "2022"}, 2},
+	}
+	for _, c := range cases {
+		results, err := l.GetPages(c.config)
+		if err != nil {
+			t.Fatalf("Cannot get pages for %+v: %v", c.config, err)
+		}
+		if len(results) != c.want {
+			t.Fatalf("Incorrect number of results for %+v: %v, want=%v", c.config, len(results), c.want)
+		}
+	}
+
+	results, _ := l.GetPages(common.RequestConfig{URL: "example.com/*"})
+	for _, res := range results {
+		if res.StatusCode != "200" || res.MimeType != "text/html" || res.Digest == "" || res.Source.Name() != "LocalWARC" {
+			t.Fatalf("Incorrect record: %+v", res)
+		}
+	}
+	if results[0].Filename != "a.warc.gz" || results[1].Filename != "c.warc" || results[2].Filename != "sub/b.warc.gz" {
+		t.Fatalf("Incorrect filenames: %v, %v, %v", results[0].Filename, results[1].Filename, results[2].Filename)
+	}
+
+	// Files are read from both compressed and plain WARCs
+	for _, res := range results {
+		file, err := l.GetFile(res)
+		if err != nil {
+			t.Fatalf("Cannot get file of %+v: %v", res, err)
+		}
+		if !bytes.Equal(file, testutil.HTMLCapture(res.Original, res.Timestamp, 200).Body) {
+			t.Fatalf("Incorrect file of %v: %q", res.Filename, file)
+		}
+	}
+
+	stream, err := l.OpenFile(context.Background(), results[1])
+	if err != nil {
+		t.Fatalf("Cannot open file: %v", err)
+	}
+	defer stream.Close()
+	if data, _ := io.ReadAll(stream); !bytes.Equal(data, testutil.HTMLCapture(results[1].Original, results[1].Timestamp, 200).Body) {
+		t.Fatalf("Incorrect file stream: %q", data)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	dir, indexDir := t.TempDir(), t.TempDir()
+	writeWARC(t, filepath.Join(dir, "a.warc.gz"), testutil.HTMLCapture("https://example.com/", "20200101000000", 200))
+	l := newSource(t, dir, indexDir)
+
+	count := func(want int) {
+		t.Helper()
+		results, err := l.GetPages(common.RequestConfig{URL: "example.com"})
+		if err != nil {
+			t.Fatalf("Cannot get pages: %v", err)
+		}
+		if len(results) != want {
+			t.Fatalf("Incorrect number of results: %v, want=%v", len(results), want)
+		}
+	}
+	count(1)
+
+	// Added files are merged into the index
+	writeWARC(t, filepath.Join(dir, "b.warc.gz"), testutil.HTMLCapture("https://example.com/", "20210101000000", 200))
+	if err := l.Update(); err != nil {
+		t.Fatalf("Cannot update index: %v", err)
+	}
+	count(2)
+
+	// Manifest older than index misses merged files, the index is rebuilt instead of merging them again
+	m, _ := l.loadManifest()
+	delete(m.Files, "b.warc.gz")
+	l.saveManifest(m.Files)
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(indexDir, MANIFEST_FILE), past, past)
+	if err := l.Update(); err != nil {
+		t.Fatalf("Cannot update index: %v", err)
+	}
+	if data, _ := os.ReadFile(l.IndexPath()); bytes.Count(data, []byte("\n")) != 2 {
+		t.Fatalf("Files are merged again: %q", data)
+	}
+
+	// Removed files are dropped, no runs are left behind
+	os.Remove(filepath.Join(dir, "a.warc.gz"))
+	l = newSource(t, dir, indexDir)
+	count(1)
+	entries, _ := os.ReadDir(indexDir)
+	if len(entries) != 2 {
+		t.Fatalf("Unexpected files in index dir: %v", entries)
+	}
+}
+
+func TestMergeRuns(t *testing.T) {
+	dir := t.TempDir()
+	var runs []string
+	var want []string
+	for i := 0; i < MERGE_FAN_IN*2+5; i++ {
+		var lines []string
+		for j := 0; j < 3; j++ {
+			lines = append(lines, fmt.Sprintf("key%04d %v", j*1000+i, i))
+		}
+		want = append(want, lines...)
+		run := filepath.Join(dir, fmt.Sprintf("run%v", i))
+		os.WriteFile(run, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+		runs = append(runs, run)
+	}
+
+	out := filepath.Join(dir, "index")
+	if err := mergeRuns(runs, out); err != nil {
+		t.Fatalf("Cannot merge runs: %v", err)
+	}
+	data, _ := os.ReadFile(out)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("Incorrect number of merged lines: %v, want=%v", len(lines), len(want))
+	}
+	for i := 1; i < len(lines); i++ {
+		if lines[i] < lines[i-1] {
+			t.Fatalf("Merged lines are not sorted: %q, %q", lines[i-1], lines[i])
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("Merged runs are not removed: %v", len(entries))
+	}
+}
+
+func TestSingleGzipStream(t *testing.T) {
+	dir := t.TempDir()
+	var records bytes.Buffer
+	for _, ts := range []string{"20200101000000", "20200102000000"} {
+		c := testutil.HTMLCapture("https://example.com/", ts, 200)
+		c.StatusCode, c.MimeType = 200, "text/html; charset=utf-8"
+		gz, _ := gzip.NewReader(bytes.NewReader(testutil.WARCRecord(c)))
+		io.Copy(&records, gz)
+	}
+	var data bytes.Buffer
+	gz := gzip.NewWriter(&data)
+	gz.Write(records.Bytes())
+	gz.Close()
+	os.WriteFile(filepath.Join(dir, "whole.warc.gz"), data.Bytes(), 0644)
+
+	if _, err := New(dir, WithIndexDir(t.TempDir())); err == nil || !strings.Contains(err.Error(), "separately") {
+		t.Fatalf("Incorrect error of WARC compressed as a whole: %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package memento
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Link ... Entry of link format (RFC 6690) used by TimeMaps and Link headers:
+//
+//	<http://archive.md/20130101000000/http://example.com/>; rel="first memento"; datetime="Tue, 01 Jan 2013 00:00:00 GMT"
+type Link struct {
+	URL    string
+	Params map[string]string
+}
+
+// HasRel ... Reports whether link has relation type, like "memento" for "first memento" links
+func (l Link) HasRel(rel string) bool {
+	for _, r := range strings.Fields(l.Params["rel"]) {
+		if strings.EqualFold(r, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// Timestamp in memento URL like "https://archive.ph/20130101000000/http://example.com/"
+var urlTimestamp = regexp.MustCompile(`/(\d{14})(?:[a-z]{2}_)?/`)
+
+// Datetime ... Returns datetime of memento link, or time in its URL if there's no datetime parameter
+func (l Link) Datetime() (time.Time, error) {
+	if datetime := l.Params["datetime"]; datetime != "" {
+		t, err := http.ParseTime(datetime)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Invalid memento datetime %q", datetime)
+		}
+		return t, nil
+	}
+
+	if match := urlTimestamp.FindStringSubmatch(l.URL); match != nil {
+		return time.Parse("20060102150405", match[1])
+	}
+	return time.Time{}, fmt.Errorf("No datetime of memento %v", l.URL)
+}
+
+// ParseLinks ... Parses comma separated links, parameter values may be quoted and contain commas
+func ParseLinks(data string) ([]Link, error) {
+	var links []Link
+	rest := strings.TrimSpace(data)
+
+	for rest != "" {
+		if rest[0] != '<' {
+			return nil, fmt.Errorf("Expected '<' at %q", head(rest))
+		}
+		end := strings.IndexByte(rest, '>')
+		if end < 0 {
+			return nil, fmt.Errorf("Unclosed link at %q", head(rest))
+		}
+
+		l := Link{URL: rest[1:end], Params: map[string]string{}}
+		rest = strings.TrimSpace(rest[end+1:])
+
+		for strings.HasPrefix(rest, ";") {
+			rest = strings.TrimSpace(rest[1:])
+			name, value := "", ""
+
+			i := strings.IndexAny(rest, "=;,")
+			if i < 0 {
+				name, rest = rest, ""
+			} else {
+				name, rest = rest[:i], rest[i:]
+			}
+
+			if strings.HasPrefix(rest, "=") {
+				rest = strings.TrimSpace(rest[1:])
+				if strings.HasPrefix(rest, `"`) {
+					closing := strings.IndexByte(rest[1:], '"')
+					if closing < 0 {
+						return nil, fmt.Errorf("Unclosed quote at %q", head(rest))
+					}
+					value, rest = rest[1:closing+1], rest[closing+2:]
+				} else {
+					j := strings.IndexAny(rest, ";,")
+					if j < 0 {
+						j = len(rest)
+					}
+					value, rest = rest[:j], rest[j:]
+				}
+			}
+
+			l.Params[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+			rest = strings.TrimSpace(rest)
+		}
+
+		links = append(links, l)
+		if rest != "" {
+			if rest[0] != ',' {
+				return nil, fmt.Errorf("Expected ',' at %q", head(rest))
+			}
+			rest = strings.TrimSpace(rest[1:])
+		}
+	}
+	return links, nil
+}
+
+// First characters of s for error messages
+func head(s string) string {
+	if len(s) > 30 {
+		return s[:30] + "..."
+	}
+	return s
+}
@@ -0,0 +1,406 @@
+// Package memento implements common.Source for any archive or aggregator supporting Memento protocol (RFC 7089).
+//
+// Captures of a URL are listed with TimeMaps in link format, the capture closest to a given time
+// is found by TimeGate datetime negotiation. Only exact URLs can be queried, filters, dates, collapses
+// and limit are applied on the client, records have no MIME type, status, digest or WARC location.
+package memento
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	common "github.com/karust/gogetcrawl/common"
+)
+
+// Memento Time Travel aggregator, it searches many public archives
+const TIMEMAP_SERVER = "http://timetravel.mementoweb.org/timemap/link"
+const TIMEGATE_SERVER = "http://timetravel.mementoweb.org/timegate"
+const MAX_REDIRECTS = 5 // Max number of redirects followed to a memento
+
+type Memento struct {
+	MaxTimeout     int            // Request timeout
+	MaxRetries     int            // Max number of request retries if timeouted
+	client         *common.Client // HTTP client, common.DefaultClient if nil
+	name           string         // Source name, "Memento" by default
+	timeMapServer  string         // TimeMaps URL, TIMEMAP_SERVER by default
+	timeGateServer string         // TimeGate URL, TIMEGATE_SERVER by default
+}
+
+// Option ... Configures Memento source in New
+type Option func(*Memento)
+
+// WithClient ... Sets HTTP client, can be shared with other sources
+func WithClient(client *common.Client) Option {
+	return func(m *Memento) {
+		m.client = client
+	}
+}
+
+// WithName ... Sets source name, to tell apart several Memento archives
+func WithName(name string) Option {
+	return func(m *Memento) {
+		m.name = name
+	}
+}
+
+// WithTimeMapServer ... Sets TimeMap URL, TimeMaps are requested as <url>/<original>
+//
+//	url: like "https://web.archive.org/web/timemap/link"
+func WithTimeMapServer(url string) Option {
+	return func(m *Memento) {
+		m.timeMapServer = strings.TrimRight(url, "/")
+	}
+}
+
+// WithTimeGateServer ... Sets TimeGate URL, TimeGate is requested as <url>/<original>
+//
+//	url: like "https://web.archive.org/web"
+func WithTimeGateServer(url string) Option {
+	return func(m *Memento) {
+		m.timeGateServer = strings.TrimRight(url, "/")
+	}
+}
+
+func New(timeout, retries int, opts ...Option) (*Memento, error) {
+	source := &Memento{
+		MaxTimeout:     timeout,
+		MaxRetries:     retries,
+		name:           "Memento",
+		timeMapServer:  TIMEMAP_SERVER,
+		timeGateServer: TIMEGATE_SERVER,
+	}
+	for _, opt := range opts {
+		opt(source)
+	}
+	return source, nil
+}
+
+func (m *Memento) Name() string {
+	return m.name
+}
+
+// GetNumPages ... Returns number of pages of paged TimeMap, all pages are requested to count them
+func (m *Memento) GetNumPages(url string) (int, error) {
+	return m.GetNumPagesContext(context.Background(), url)
+}
+
+// GetNumPagesContext ... Same as GetNumPages, but requests are aborted when ctx is done
+func (m *Memento) GetNumPagesContext(ctx context.Context, url string) (int, error) {
+	pages := 0
+	next := m.timeMapURL(url)
+	for next != "" {
+		tm, err := m.getTimeMap(ctx, next)
+		if err != nil {
+			return 0, common.WrapError(err, "GetNumPages", m.Name(), next, pages)
+		}
+		if tm == nil {
+			break
+		}
+		pages++
+		next = tm.Next
+	}
+	return pages, nil
+}
+
+// ParseResponse ... Parses TimeMap in link format, every memento becomes a record of the original URL
+func (m *Memento) ParseResponse(resp []byte) ([]*common.CdxResponse, error) {
+	tm, err := ParseTimeMap(resp)
+	if err != nil {
+		return nil, common.NewError(common.KindParse, "ParseResponse", "", err)
+	}
+	return m.records(tm, ""), nil
+}
+
+// records ... Converts mementos of TimeMap to records, original is used if TimeMap doesn't list it
+func (m *Memento) records(tm *TimeMap, original string) []*common.CdxResponse {
+	if tm.Original != "" {
+		original = tm.Original
+	}
+
+	results := []*common.CdxResponse{}
+	for _, entry := range tm.Mementos {
+		results = append(results, m.record(original, entry))
+	}
+	return results
+}
+
+func (m *Memento) record(original string, entry Entry) *common.CdxResponse {
+	return &common.CdxResponse{
+		Urlkey:    common.SURT(original),
+		Timestamp: common.FormatTimestamp(entry.Datetime),
+		Original:  original,
+		Memento:   entry.URL,
+		Source:    m,
+	}
+}
+
+func (m *Memento) timeMapURL(original string) string {
+	return fmt.Sprintf("%v/%v", m.timeMapServer, original)
+}
+
+// getTimeMap ... Requests TimeMap page, returns nil if there are no mementos
+func (m *Memento) getTimeMap(ctx context.Context, reqURL string) (*TimeMap, error) {
+	response, err := m.client.Get(ctx, reqURL, m.MaxTimeout, m.MaxRetries)
+	if errors.Is(err, common.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tm, err := ParseTimeMap(response)
+	if err != nil {
+		return nil, common.NewError(common.KindParse, "ParseResponse", reqURL, err)
+	}
+	return tm, nil
+}
+
+// fetchBatch ... Requests TimeMap page, the first one if pageURL is empty, returns URL of the next page
+func (m *Memento) fetchBatch(ctx context.Context, config common.RequestConfig, filter *common.ConfigFilter, pageURL string) ([]*common.CdxResponse, string, error) {
+	if pageURL == "" {
+		pageURL = m.timeMapURL(config.URL)
+	}
+
+	tm, err := m.getTimeMap(ctx, pageURL)
+	if err != nil {
+		return nil, "", common.WrapError(err, "FetchBatch", m.Name(), pageURL, -1)
+	}
+	if tm == nil {
+		return nil, "", nil
+	}
+
+	results := filter.Filter(m.records(tm, config.URL))
+	if filter.Done() || config.SinglePage {
+		return results, "", nil
+	}
+	return results, tm.Next, nil
+}
+
+// pager ... Goes through TimeMap pages, URL of the next page is used as resume key
+func (m *Memento) pager(config common.RequestConfig) common.PageFunc {
+	if strings.Contains(config.URL, "*") {
+		err := common.WrapError(fmt.Errorf("Wildcard queries are not supported, use an exact URL"), "Iterate", m.Name(), config.URL, -1)
+		return func(context.Context) ([]*common.CdxResponse, error) { return nil, err }
+	}
+
+	filter, err := common.NewConfigFilter(config)
+	if err != nil {
+		err = common.WrapError(err, "Iterate", m.Name(), config.URL, -1)
+		return func(context.Context) ([]*common.CdxResponse, error) { return nil, err }
+	}
+
+	return common.NewResumePager(config, func(ctx context.Context, pageURL string) ([]*common.CdxResponse, string, error) {
+		return m.fetchBatch(ctx, config, filter, pageURL)
+	})
+}
+
+// Iterate ... Returns iterator over mementos of config URL. Pages of paged TimeMaps are requested lazily.
+func (m *Memento) Iterate(ctx context.Context, config common.RequestConfig) *common.Iterator {
+	return common.NewIterator(ctx, m.pager(config))
+}
+
+// GetPages ... Requests TimeMap to gather all mementos of config URL
+func (m *Memento) GetPages(config common.RequestConfig) ([]*common.CdxResponse, error) {
+	return m.GetPagesContext(context.Background(), config)
+}
+
+// GetPagesContext ... Same as GetPages, but requests are aborted when ctx is done
+func (m *Memento) GetPagesContext(ctx context.Context, config common.RequestConfig) ([]*common.CdxResponse, error) {
+	return common.Collect(m.Iterate(ctx, config))
+}
+
+// FetchPages ... Concurrent way to GetPages.
+//
+// Deprecated: use Iterate, channels are never closed and completion is not signaled.
+func (m *Memento) FetchPages(config common.RequestConfig, results chan []*common.CdxResponse, errors chan error) {
+	m.FetchPagesContext(context.Background(), config, results, errors)
+}
+
+// FetchPagesContext ... Same as FetchPages, but returns as soon as ctx is done.
+//
+// Deprecated: use Iterate.
+func (m *Memento) FetchPagesContext(ctx context.Context, config common.RequestConfig, results chan []*common.CdxResponse, errors chan error) {
+	common.FetchPages(ctx, m.pager(config), results, errors)
+}
+
+// Closest ... Returns memento of url closest to t, negotiated with TimeGate using Accept-Datetime
+func (m *Memento) Closest(ctx context.Context, original string, t time.Time) (*common.CdxResponse, error) {
+	reqURL := fmt.Sprintf("%v/%v", m.timeGateServer, original)
+	headers := map[string]string{"Accept-Datetime": t.UTC().Format(http.TimeFormat)}
+
+	resp, err := m.client.GetResponseWithHeaders(ctx, reqURL, m.MaxTimeout, m.MaxRetries, headers)
+	if err != nil {
+		return nil, common.WrapError(err, "Closest", m.Name(), reqURL, -1)
+	}
+
+	links, _ := ParseLinks(resp.Header.Get("Link"))
+	for _, link := range links {
+		if link.HasRel("original") {
+			original = link.URL
+		}
+	}
+
+	location := resp.Header.Get("Location")
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 && location != "" {
+		mementoURL, err := resolveURL(reqURL, location)
+		if err != nil {
+			return nil, common.WrapError(err, "Closest", m.Name(), reqURL, -1)
+		}
+
+		// TimeGate usually lists the memento with its datetime, otherwise the memento is requested
+		for _, link := range links {
+			if link.URL == mementoURL && link.HasRel("memento") {
+				if datetime, err := link.Datetime(); err == nil {
+					return m.record(original, Entry{URL: mementoURL, Datetime: datetime}), nil
+				}
+			}
+		}
+
+		if resp, mementoURL, err = Follow(ctx, m.client, mementoURL, m.MaxTimeout, m.MaxRetries); err != nil {
+			return nil, common.WrapError(err, "Closest", m.Name(), mementoURL, -1)
+		}
+		reqURL = mementoURL
+	}
+
+	// TimeGate may return the memento itself
+	datetime, err := http.ParseTime(resp.Header.Get("Memento-Datetime"))
+	if resp.StatusCode != http.StatusOK || err != nil {
+		if resp.StatusCode == http.StatusOK {
+			return nil, common.WrapError(fmt.Errorf("No Memento-Datetime in response"), "Closest", m.Name(), reqURL, -1)
+		}
+		return nil, common.WrapError(common.StatusError(resp.StatusCode, reqURL), "Closest", m.Name(), reqURL, -1)
+	}
+	if location := resp.Header.Get("Content-Location"); location != "" {
+		if resolved, err := resolveURL(reqURL, location); err == nil {
+			reqURL = resolved
+		}
+	}
+	return m.record(original, Entry{URL: reqURL, Datetime: datetime}), nil
+}
+
+// mementoURL ... Returns memento URL of record, negotiated with TimeGate if record has none
+func (m *Memento) mementoURL(ctx context.Context, page *common.CdxResponse) (string, error) {
+	if page.Memento != "" {
+		return page.Memento, nil
+	}
+
+	t, err := time.Parse("20060102150405", page.Timestamp)
+	if err != nil {
+		return "", fmt.Errorf("Invalid timestamp %q", page.Timestamp)
+	}
+	closest, err := m.Closest(ctx, page.Original, t)
+	if err != nil {
+		return "", err
+	}
+	return closest.Memento, nil
+}
+
+// getMemento ... Downloads memento of record following redirects
+func (m *Memento) getMemento(ctx context.Context, page *common.CdxResponse) (*common.Response, string, error) {
+	requestURI, err := m.mementoURL(ctx, page)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, requestURI, err := Follow(ctx, m.client, requestURI, m.MaxTimeout, m.MaxRetries)
+	if err != nil {
+		return nil, requestURI, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, requestURI, common.StatusError(resp.StatusCode, requestURI)
+	}
+	return resp, requestURI, nil
+}
+
+// GetFile ... Downloads memento as served by its archive, usually with rewritten links
+func (m *Memento) GetFile(page *common.CdxResponse) ([]byte, error) {
+	return m.GetFileContext(context.Background(), page)
+}
+
+// GetFileContext ... Same as GetFile, but download is aborted when ctx is done
+func (m *Memento) GetFileContext(ctx context.Context, page *common.CdxResponse) ([]byte, error) {
+	resp, requestURI, err := m.getMemento(ctx, page)
+	if err != nil {
+		return nil, common.WrapError(err, "GetFile", m.Name(), requestURI, -1)
+	}
+	return resp.Body, nil
+}
+
+// GetCapture ... Downloads memento with headers of the archive response
+func (m *Memento) GetCapture(page *common.CdxResponse) (*common.Capture, error) {
+	return m.GetCaptureContext(context.Background(), page)
+}
+
+// GetCaptureContext ... Same as GetCapture, but download is aborted when ctx is done
+func (m *Memento) GetCaptureContext(ctx context.Context, page *common.CdxResponse) (*common.Capture, error) {
+	resp, requestURI, err := m.getMemento(ctx, page)
+	if err != nil {
+		return nil, common.WrapError(err, "GetCapture", m.Name(), requestURI, -1)
+	}
+	return common.NewCapture(page, resp.StatusCode, resp.Header, resp.Body), nil
+}
+
+// OpenFile ... Opens memento stream. Stream must be closed.
+func (m *Memento) OpenFile(ctx context.Context, page *common.CdxResponse) (io.ReadCloser, error) {
+	payload, err := m.OpenPayload(ctx, page)
+	if err != nil {
+		return nil, common.WrapError(err, "OpenFile", m.Name(), "", -1)
+	}
+
+	body, err := payload.Decode()
+	if err != nil {
+		return nil, common.WrapError(err, "OpenFile", m.Name(), "", -1)
+	}
+	return body, nil
+}
+
+// OpenPayload ... Opens memento without decoding it. Mementos are buffered in memory while redirects are followed.
+func (m *Memento) OpenPayload(ctx context.Context, page *common.CdxResponse) (*common.Payload, error) {
+	resp, requestURI, err := m.getMemento(ctx, page)
+	if err != nil {
+		return nil, common.WrapError(err, "OpenPayload", m.Name(), requestURI, -1)
+	}
+	return &common.Payload{ReadCloser: io.NopCloser(bytes.NewReader(resp.Body)), Encoding: resp.Header.Get("Content-Encoding")}, nil
+}
+
+// Follow ... Requests URL following up to MAX_REDIRECTS redirects, returns the last response and its URL
+func Follow(ctx context.Context, client *common.Client, requestURI string, timeout, retries int) (*common.Response, string, error) {
+	for redirects := 0; ; redirects++ {
+		resp, err := client.GetResponse(ctx, requestURI, timeout, retries)
+		if err != nil {
+			return nil, requestURI, err
+		}
+
+		location := resp.Header.Get("Location")
+		if resp.StatusCode < 300 || resp.StatusCode >= 400 || location == "" {
+			return resp, requestURI, nil
+		}
+
+		if redirects >= MAX_REDIRECTS {
+			return nil, requestURI, fmt.Errorf("Too many redirects")
+		}
+		if requestURI, err = resolveURL(requestURI, location); err != nil {
+			return nil, requestURI, err
+		}
+	}
+}
+
+// Resolve location relative to base URL
+func resolveURL(base, location string) (string, error) {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := baseURL.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("Invalid redirect location %q", location)
+	}
+	return resolved.String(), nil
+}
@@ -0,0 +1,178 @@
+package memento
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	common "github.com/karust/gogetcrawl/common"
+	"github.com/karust/gogetcrawl/testutil"
+)
+
+// Example request: http://timetravel.mementoweb.org/timemap/link/http://example.com/
+const RESPONSE = `<http://example.com/>; rel="original",
+<http://timetravel.mementoweb.org/timegate/http://example.com/>; rel="timegate",
+<http://timetravel.mementoweb.org/timemap/link/http://example.com/>; rel="self"; type="application/link-format",
+<http://timetravel.mementoweb.org/timemap/link/2/http://example.com/>; rel="next"; type="application/link-format",
+<https://web.archive.org/web/20020120142510/http://example.com/>; rel="first memento"; datetime="Sun, 20 Jan 2002 14:25:10 GMT",
+<https://arquivo.pt/wayback/20091203154420/http://example.com/>; rel="memento"; datetime="Thu, 03 Dec 2009 15:44:20 GMT"; license="a, b",
+<https://archive.ph/20230602101804/http://example.com/>; rel="last memento"
+`
+
+// Test interface
+var mmtest common.Source = &Memento{}
+var mmnegotiator common.Negotiator = &Memento{}
+var mm *Memento
+
+var server *testutil.CDXServer
+
+func TestMain(m *testing.M) {
+	server = testutil.NewCDXServer()
+	server.PageSize = 2
+	for _, c := range testutil.MementoCaptures() {
+		server.AddCapture(c)
+	}
+
+	mm, _ = New(15, 2, WithTimeMapServer(server.TimeMapURL()), WithTimeGateServer(server.TimeGateURL()))
+
+	code := m.Run()
+	server.Close()
+	os.Exit(code)
+}
+
+func TestParseTimeMap(t *testing.T) {
+	tm, err := ParseTimeMap([]byte(RESPONSE))
+	if err != nil {
+		t.Fatalf("Cannot parse TimeMap: %v", err)
+	}
+
+	if tm.Original != "http://example.com/" || tm.Next != "http://timetravel.mementoweb.org/timemap/link/2/http://example.com/" {
+		t.Fatalf("Incorrect TimeMap links: %+v", tm)
+	}
+	if len(tm.Mementos) != 3 {
+		t.Fatalf("Incorrect number of mementos: %v, want=3", len(tm.Mementos))
+	}
+	// Datetime is taken from URL if missing
+	if common.FormatTimestamp(tm.Mementos[2].Datetime) != "20230602101804" {
+		t.Fatalf("Incorrect memento datetime: %v", tm.Mementos[2].Datetime)
+	}
+
+	results, err := mm.ParseResponse([]byte(RESPONSE))
+	if err != nil {
+		t.Fatalf("Cannot parse response: %v", err)
+	}
+	if results[1].Timestamp != "20091203154420" || results[1].Urlkey != "com,example)/" || results[1].Memento != "https://arquivo.pt/wayback/20091203154420/http://example.com/" {
+		t.Fatalf("Incorrect memento: %+v", results[1])
+	}
+
+	if _, err := mm.ParseResponse([]byte(`<http://example.com/>; rel="original`)); !errors.Is(err, common.ErrParse) {
+		t.Fatalf("Incorrect error of broken response: %v", err)
+	}
+}
+
+func TestGetPages(t *testing.T) {
+	pages, err := mm.GetNumPages("https://example.com/")
+	if err != nil {
+		t.Fatalf("Cannot get number of pages: %v", err)
+	}
+	if pages != 2 {
+		t.Fatalf("Incorrect number of pages: %v, want=2", pages)
+	}
+
+	results, err := mm.GetPages(common.RequestConfig{URL: "https://example.com/"})
+	if err != nil {
+		t.Fatalf("Cannot get pages: %v", err)
+	}
+	if len(results) != 3 || results[2].Timestamp != "20210301000000" || results[0].Source.Name() != "Memento" {
+		t.Fatalf("Incorrect results of paged TimeMap: %v, want=3", len(results))
+	}
+
+	cases := []struct {
+		config common.RequestConfig
+		want   int
+	}{
+		{common.RequestConfig{URL: "https://example.com/", FromDate: "2021"}, 1},
+		{common.RequestConfig{URL: "https://example.com/", Limit: 1}, 1},
+		{common.RequestConfig{URL: "https://example.com/", Collapse: []string{"timestamp:8"}}, 2},
+		{common.RequestConfig{URL: "https://example.com/", SinglePage: true}, 2},
+		{common.RequestConfig{URL: "https://example.com/missing"}, 0},
+	}
+	for _, c := range cases {
+		results, err := mm.GetPages(c.config)
+		if err != nil {
+			t.Fatalf("Cannot get pages for %+v: %v", c.config, err)
+		}
+		if len(results) != c.want {
+			t.Fatalf("Incorrect number of results for %+v: %v, want=%v", c.config, len(results), c.want)
+		}
+	}
+
+	if _, err := mm.GetPages(common.RequestConfig{URL: "example.com/*"}); err == nil {
+		t.Fatalf("Wildcard query is accepted")
+	}
+}
+
+func TestClosest(t *testing.T) {
+	cases := []struct {
+		date string
+		want string
+	}{
+		{"2019-06-01", "20200101000000"},
+		{"20200101100000", "20200101120000"},
+		{"2022", "20210301000000"},
+	}
+	for _, c := range cases {
+		date, err := common.ParseTimestamp(c.date)
+		if err != nil {
+			t.Fatalf("Cannot parse date %v: %v", c.date, err)
+		}
+
+		res, err := common.Closest(context.Background(), mm, common.RequestConfig{URL: "https://example.com/"}, date)
+		if err != nil {
+			t.Fatalf("Cannot negotiate memento closest to %v: %v", c.date, err)
+		}
+		if res.Timestamp != c.want || res.Original != "https://example.com/" || res.Memento == "" {
+			t.Fatalf("Incorrect memento closest to %v: %+v, want=%v", c.date, res, c.want)
+		}
+	}
+
+	if _, err := mm.Closest(context.Background(), "https://example.com/missing", time.Now()); !errors.Is(err, common.ErrNotFound) {
+		t.Fatalf("Incorrect error of URL without mementos: %v", err)
+	}
+}
+
+func TestGetFile(t *testing.T) {
+	results, err := mm.GetPages(common.RequestConfig{URL: "https://example.com/about"})
+	if err != nil || len(results) != 1 {
+		t.Fatalf("Cannot get pages: %v, %v", results, err)
+	}
+	want := testutil.HTMLCapture("https://example.com/about", "20200101000000", 300).Body
+
+	file, err := mm.GetFile(results[0])
+	if err != nil {
+		t.Fatalf("Cannot get file: %v", err)
+	}
+	if !bytes.Equal(file, want) {
+		t.Fatalf("Incorrect memento: %q", file)
+	}
+
+	// Records without memento URL are negotiated with TimeGate
+	page := &common.CdxResponse{Original: "https://example.com/about", Timestamp: "20200101000000"}
+	stream, err := mm.OpenFile(context.Background(), page)
+	if err != nil {
+		t.Fatalf("Cannot open file: %v", err)
+	}
+	defer stream.Close()
+	if data, _ := io.ReadAll(stream); !bytes.Equal(data, want) {
+		t.Fatalf("Incorrect memento stream: %q", data)
+	}
+
+	page.Original = "https://example.com/missing"
+	if _, err := mm.GetCapture(page); !errors.Is(err, common.ErrNotFound) {
+		t.Fatalf("Incorrect error of missing memento: %v", err)
+	}
+}
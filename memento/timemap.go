@@ -0,0 +1,50 @@
+package memento
+
+import (
+	"time"
+)
+
+// TimeMap ... List of mementos of an original URL (RFC 7089). Large TimeMaps may be split into pages linked by Next.
+type TimeMap struct {
+	Original string // Original URL
+	TimeGate string
+	Self     string
+	Next     string // URL of the next page of paged TimeMap
+	Mementos []Entry
+}
+
+// Entry ... Memento listed in TimeMap or returned by TimeGate
+type Entry struct {
+	URL      string
+	Datetime time.Time
+}
+
+// ParseTimeMap ... Parses TimeMap in link format
+func ParseTimeMap(data []byte) (*TimeMap, error) {
+	links, err := ParseLinks(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	tm := &TimeMap{}
+	for _, link := range links {
+		switch {
+		case link.HasRel("memento"):
+			datetime, err := link.Datetime()
+			if err != nil {
+				return nil, err
+			}
+			tm.Mementos = append(tm.Mementos, Entry{URL: link.URL, Datetime: datetime})
+		case link.HasRel("original"):
+			tm.Original = link.URL
+		case link.HasRel("timegate"):
+			tm.TimeGate = link.URL
+		case link.HasRel("self"):
+			tm.Self = link.URL
+		case link.HasRel("next"):
+			// Paged TimeMaps link the next page with rel="next" and type="application/link-format"
+			tm.Next = link.URL
+		}
+	}
+	return tm, nil
+}
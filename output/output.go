@@ -0,0 +1,287 @@
+package output
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+	common "github.com/karust/gogetcrawl/common"
+)
+
+// Format ... Output format of CDX records
+type Format string
+
+const (
+	FormatTXT     Format = "txt"     // Space separated fields, only URL by default
+	FormatJSONL   Format = "jsonl"   // JSON object per line
+	FormatCSV     Format = "csv"     // Comma separated values with header row
+	FormatTSV     Format = "tsv"     // Tab separated values with header row
+	FormatCDXJ    Format = "cdxj"    // "urlkey timestamp {json}" lines, like pywb and OutbackCDX indexes
+	FormatParquet Format = "parquet" // Columnar Parquet file with all fields, see ParquetRecord
+)
+
+// Formats ... Supported output formats
+var Formats = []Format{FormatTXT, FormatJSONL, FormatCSV, FormatTSV, FormatCDXJ, FormatParquet}
+
+// Fields ... Names of CDX record fields available for output, in default order
+var Fields = []string{"urlkey", "timestamp", "url", "mime", "mimedetected", "status", "digest", "length", "offset", "filename", "charset", "languages", "crawl", "memento", "source", "sources"}
+
+var fieldValues = map[string]func(*common.CdxResponse) string{
+	"urlkey":       func(r *common.CdxResponse) string { return r.Urlkey },
+	"timestamp":    func(r *common.CdxResponse) string { return r.Timestamp },
+	"url":          func(r *common.CdxResponse) string { return r.Original },
+	"mime":         func(r *common.CdxResponse) string { return r.MimeType },
+	"mimedetected": func(r *common.CdxResponse) string { return r.MimeDetected },
+	"status":       func(r *common.CdxResponse) string { return r.StatusCode },
+	"digest":       func(r *common.CdxResponse) string { return r.Digest },
+	"length":       func(r *common.CdxResponse) string { return r.Length },
+	"offset":       func(r *common.CdxResponse) string { return r.Offset },
+	"filename":     func(r *common.CdxResponse) string { return r.Filename },
+	"charset":      func(r *common.CdxResponse) string { return r.Charset },
+	"languages":    func(r *common.CdxResponse) string { return r.Languages },
+	"crawl":        func(r *common.CdxResponse) string { return r.Crawl },
+	"memento":      func(r *common.CdxResponse) string { return r.Memento },
+	"source": func(r *common.CdxResponse) string {
+		if r.Source == nil {
+			return ""
+		}
+		return r.Source.Name()
+	},
+	"sources": func(r *common.CdxResponse) string { return strings.Join(r.Sources, ",") },
+}
+
+// Other names of fields, like column names of CDX servers
+var fieldAliases = map[string]string{
+	"original":   "url",
+	"mimetype":   "mime",
+	"statuscode": "status",
+}
+
+// Field ... Returns value of CDX record field with given name, see Fields
+func Field(res *common.CdxResponse, name string) string {
+	if value, ok := fieldValues[name]; ok {
+		return value(res)
+	}
+	return ""
+}
+
+// ParseFormat ... Returns format by its name
+func ParseFormat(name string) (Format, error) {
+	for _, format := range Formats {
+		if strings.EqualFold(name, string(format)) {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown output format '%v', use one of: %v", name, Formats)
+}
+
+// ParseFields ... Checks field names and resolves aliases. Default fields of format are returned for empty names.
+func ParseFields(format Format, names []string) ([]string, error) {
+	if len(names) == 0 {
+		return DefaultFields(format), nil
+	}
+
+	fields := make([]string, 0, len(names))
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if alias, ok := fieldAliases[name]; ok {
+			name = alias
+		}
+		if _, ok := fieldValues[name]; !ok {
+			return nil, fmt.Errorf("Unknown field '%v', use any of: %v", name, strings.Join(Fields, ","))
+		}
+		fields = append(fields, name)
+	}
+	return fields, nil
+}
+
+// DefaultFields ... Returns fields written by format when none are selected
+func DefaultFields(format Format) []string {
+	switch format {
+	case FormatTXT:
+		return []string{"url"}
+	case FormatCDXJ:
+		// Key and timestamp start every line
+		return []string{"url", "mime", "status", "digest", "length", "offset", "filename", "crawl", "source"}
+	}
+	return Fields
+}
+
+// Writer ... Writes CDX records in some format. Text formats write every record through at once,
+// so output of interrupted runs matches their checkpoints. Parquet output is complete only after Close.
+type Writer interface {
+	Write(res *common.CdxResponse) error
+	WritePage(page []*common.CdxResponse) error // Parquet writes page as a row group
+	Close() error
+}
+
+// Option ... Configures Writer in NewWriter
+type Option func(*options)
+
+type options struct {
+	noHeader bool
+}
+
+// WithoutHeader ... Disables header row of CSV and TSV, when appending to existing output
+func WithoutHeader() Option {
+	return func(o *options) {
+		o.noHeader = true
+	}
+}
+
+// NewWriter ... Creates writer of records in format, with fields in given order.
+// Default fields of format are used if fields are empty. Closing writer doesn't close w.
+//
+//	fields: names from Fields, for CDXJ they go to the JSON block after urlkey and timestamp. Not used for Parquet.
+func NewWriter(w io.Writer, format Format, fields []string, opts ...Option) (Writer, error) {
+	if format == FormatParquet {
+		if len(fields) > 0 {
+			return nil, fmt.Errorf("Fields cannot be selected for parquet format, it has all of them")
+		}
+		return NewParquetWriter(w)
+	}
+
+	fields, err := ParseFields(format, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	switch format {
+	case FormatTXT:
+		return &lineWriter{w: w, fields: fields, line: txtLine}, nil
+	case FormatJSONL:
+		return &lineWriter{w: w, fields: fields, line: jsonLine}, nil
+	case FormatCDXJ:
+		return &lineWriter{w: w, fields: fields, line: cdxjLine}, nil
+	case FormatCSV, FormatTSV:
+		writer := csv.NewWriter(w)
+		if format == FormatTSV {
+			writer.Comma = '\t'
+		}
+		return &csvWriter{csv: writer, fields: fields, header: !o.noHeader}, nil
+	}
+	return nil, fmt.Errorf("Unknown output format '%v', use one of: %v", format, Formats)
+}
+
+// lineWriter ... Writes record per line composed by line function
+type lineWriter struct {
+	w      io.Writer
+	fields []string
+	line   func(res *common.CdxResponse, fields []string) ([]byte, error)
+}
+
+func (w *lineWriter) Write(res *common.CdxResponse) error {
+	line, err := w.line(res, w.fields)
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(append(line, '\n'))
+	return err
+}
+
+func (w *lineWriter) WritePage(page []*common.CdxResponse) error {
+	return writePage(w, page)
+}
+
+func (w *lineWriter) Close() error {
+	return nil
+}
+
+func txtLine(res *common.CdxResponse, fields []string) ([]byte, error) {
+	values := make([]string, len(fields))
+	for i, field := range fields {
+		values[i] = Field(res, field)
+	}
+	return []byte(strings.Join(values, " ")), nil
+}
+
+func jsonLine(res *common.CdxResponse, fields []string) ([]byte, error) {
+	return jsonObject(res, fields, nil)
+}
+
+// SURT key and timestamp, then JSON block without them
+func cdxjLine(res *common.CdxResponse, fields []string) ([]byte, error) {
+	object, err := jsonObject(res, fields, map[string]bool{"urlkey": true, "timestamp": true})
+	if err != nil {
+		return nil, err
+	}
+	line := []byte(res.Urlkey + " " + res.Timestamp + " ")
+	return append(line, object...), nil
+}
+
+// JSON object with fields in given order, empty values are omitted
+func jsonObject(res *common.CdxResponse, fields []string, skip map[string]bool) ([]byte, error) {
+	stream := jsoniter.ConfigDefault.BorrowStream(nil)
+	defer jsoniter.ConfigDefault.ReturnStream(stream)
+
+	stream.WriteObjectStart()
+	first := true
+	for _, field := range fields {
+		value := Field(res, field)
+		if value == "" || skip[field] {
+			continue
+		}
+		if !first {
+			stream.WriteMore()
+		}
+		first = false
+		stream.WriteObjectField(field)
+		stream.WriteString(value)
+	}
+	stream.WriteObjectEnd()
+
+	if stream.Error != nil {
+		return nil, fmt.Errorf("Cannot encode record: %v", stream.Error)
+	}
+	return append([]byte{}, stream.Buffer()...), nil
+}
+
+// csvWriter ... Writes header row before the first record
+type csvWriter struct {
+	csv    *csv.Writer
+	fields []string
+	header bool
+}
+
+func (w *csvWriter) Write(res *common.CdxResponse) error {
+	if w.header {
+		w.header = false
+		if err := w.csv.Write(w.fields); err != nil {
+			return err
+		}
+	}
+
+	values := make([]string, len(w.fields))
+	for i, field := range w.fields {
+		values[i] = Field(res, field)
+	}
+	w.csv.Write(values)
+	w.csv.Flush()
+	return w.csv.Error()
+}
+
+func (w *csvWriter) WritePage(page []*common.CdxResponse) error {
+	return writePage(w, page)
+}
+
+func (w *csvWriter) Close() error {
+	w.csv.Flush()
+	return w.csv.Error()
+}
+
+// Writes records of page one by one
+func writePage(w Writer, page []*common.CdxResponse) error {
+	for _, res := range page {
+		if err := w.Write(res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package output
+
+import (
+	"bytes"
+	"testing"
+
+	common "github.com/karust/gogetcrawl/common"
+)
+
+var record = &common.CdxResponse{
+	Urlkey:     "ru,kamaloff)/",
+	Timestamp:  "20130522121421",
+	Original:   "http://kamaloff.ru/",
+	MimeType:   "text/html",
+	StatusCode: "200",
+	Digest:     "FXOQP7LM7FWUC7S5MTDHZS2WMKNLCW2E",
+	Length:     "2558",
+}
+
+func TestFormats(t *testing.T) {
+	tests := []struct {
+		format Format
+		fields []string
+		want   string
+	}{
+		{FormatTXT, nil, "http://kamaloff.ru/\n"},
+		{FormatTXT, []string{"timestamp", "original"}, "20130522121421 http://kamaloff.ru/\n"},
+		{FormatJSONL, []string{"url", "status", "crawl"}, `{"url":"http://kamaloff.ru/","status":"200"}` + "\n"},
+		{FormatCSV, []string{"url", "mimetype"}, "url,mime\nhttp://kamaloff.ru/,text/html\nhttp://kamaloff.ru/,text/html\n"},
+		{FormatTSV, []string{"timestamp", "length"}, "timestamp\tlength\n20130522121421\t2558\n20130522121421\t2558\n"},
+		{FormatCDXJ, []string{"url", "digest"}, `ru,kamaloff)/ 20130522121421 {"url":"http://kamaloff.ru/","digest":"FXOQP7LM7FWUC7S5MTDHZS2WMKNLCW2E"}` + "\n"},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, test.format, test.fields)
+		if err != nil {
+			t.Fatalf("Cannot create %v writer: %v", test.format, err)
+		}
+
+		// Header row is written once
+		n := 1
+		if test.format == FormatCSV || test.format == FormatTSV {
+			n = 2
+		}
+		for i := 0; i < n; i++ {
+			if err := w.Write(record); err != nil {
+				t.Fatalf("Cannot write %v: %v", test.format, err)
+			}
+		}
+		w.Close()
+
+		if buf.String() != test.want {
+			t.Fatalf("Incorrect %v output: %q, want=%q", test.format, buf.String(), test.want)
+		}
+	}
+}
+
+func TestParseFields(t *testing.T) {
+	if _, err := ParseFields(FormatCSV, []string{"url", "unknown"}); err == nil {
+		t.Fatalf("Unknown field is accepted")
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Fatalf("Unknown format is accepted")
+	}
+
+	var buf bytes.Buffer
+	w, _ := NewWriter(&buf, FormatCSV, []string{"url"}, WithoutHeader())
+	w.Write(record)
+	if buf.String() != "http://kamaloff.ru/\n" {
+		t.Fatalf("Header is written: %q", buf.String())
+	}
+}
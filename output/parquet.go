@@ -0,0 +1,156 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	common "github.com/karust/gogetcrawl/common"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const ROW_GROUP_ROWS = 100000 // Default number of records in a Parquet row group
+
+// ParquetRecord ... Row of Parquet output. Values which are missing or cannot be parsed are null.
+type ParquetRecord struct {
+	Urlkey       string  `parquet:"name=urlkey, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Timestamp    *int64  `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS, repetitiontype=OPTIONAL"`
+	URL          string  `parquet:"name=url, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Mime         *string `parquet:"name=mime, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY, repetitiontype=OPTIONAL"`
+	MimeDetected *string `parquet:"name=mimedetected, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY, repetitiontype=OPTIONAL"`
+	Status       *int32  `parquet:"name=status, type=INT32, repetitiontype=OPTIONAL"`
+	Digest       *string `parquet:"name=digest, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	Length       *int64  `parquet:"name=length, type=INT64, repetitiontype=OPTIONAL"`
+	Offset       *int64  `parquet:"name=offset, type=INT64, repetitiontype=OPTIONAL"`
+	Filename     *string `parquet:"name=filename, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY, repetitiontype=OPTIONAL"`
+	Charset      *string `parquet:"name=charset, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY, repetitiontype=OPTIONAL"`
+	Languages    *string `parquet:"name=languages, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY, repetitiontype=OPTIONAL"`
+	Crawl        *string `parquet:"name=crawl, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY, repetitiontype=OPTIONAL"`
+	Memento      *string `parquet:"name=memento, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	Source       *string `parquet:"name=source, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY, repetitiontype=OPTIONAL"`
+	Sources      *string `parquet:"name=sources, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY, repetitiontype=OPTIONAL"`
+}
+
+// NewParquetRecord ... Converts CDX record to Parquet row
+func NewParquetRecord(res *common.CdxResponse) *ParquetRecord {
+	row := &ParquetRecord{
+		Urlkey:       res.Urlkey,
+		URL:          res.Original,
+		Mime:         optString(res.MimeType),
+		MimeDetected: optString(res.MimeDetected),
+		Digest:       optString(res.Digest),
+		Filename:     optString(res.Filename),
+		Charset:      optString(res.Charset),
+		Languages:    optString(res.Languages),
+		Crawl:        optString(res.Crawl),
+		Memento:      optString(res.Memento),
+		Source:       optString(Field(res, "source")),
+		Sources:      optString(Field(res, "sources")),
+	}
+
+	if ts, err := time.Parse("20060102150405", res.Timestamp); err == nil {
+		millis := ts.UnixMilli()
+		row.Timestamp = &millis
+	}
+	// Revisits have "-" status
+	if status, err := strconv.ParseInt(res.StatusCode, 10, 32); err == nil {
+		status32 := int32(status)
+		row.Status = &status32
+	}
+	if length, err := strconv.ParseInt(res.Length, 10, 64); err == nil {
+		row.Length = &length
+	}
+	if offset, err := strconv.ParseInt(res.Offset, 10, 64); err == nil {
+		row.Offset = &offset
+	}
+	return row
+}
+
+func optString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+// ParquetWriter ... Writes CDX records into Parquet file with ParquetRecord schema, compressed with Snappy.
+// Rows are buffered in memory until a row group is complete, output is valid only after Close.
+type ParquetWriter struct {
+	pw        *writer.ParquetWriter
+	groupRows int
+	rows      int // Rows in the current row group
+}
+
+// ParquetOption ... Configures ParquetWriter in NewParquetWriter
+type ParquetOption func(*ParquetWriter)
+
+// WithRowGroupRows ... Sets number of records after which Write starts the next row group, ROW_GROUP_ROWS by default
+func WithRowGroupRows(rows int) ParquetOption {
+	return func(w *ParquetWriter) {
+		if rows > 0 {
+			w.groupRows = rows
+		}
+	}
+}
+
+// NewParquetWriter ... Creates Parquet writer to w. Closing writer doesn't close w.
+func NewParquetWriter(w io.Writer, opts ...ParquetOption) (*ParquetWriter, error) {
+	pw, err := writer.NewParquetWriterFromWriter(w, new(ParquetRecord), 1)
+	if err != nil {
+		return nil, fmt.Errorf("[NewParquetWriter] Cannot create writer: %v", err)
+	}
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+
+	writer := &ParquetWriter{pw: pw, groupRows: ROW_GROUP_ROWS}
+	for _, opt := range opts {
+		opt(writer)
+	}
+	return writer, nil
+}
+
+// Write ... Writes record, row group is flushed once it has the configured number of rows
+func (w *ParquetWriter) Write(res *common.CdxResponse) error {
+	if err := w.pw.Write(NewParquetRecord(res)); err != nil {
+		return fmt.Errorf("[Write] Cannot write record: %v", err)
+	}
+
+	w.rows++
+	if w.rows >= w.groupRows {
+		return w.Flush()
+	}
+	return nil
+}
+
+// WritePage ... Writes page of records, like one received from FetchPages, as a separate row group
+func (w *ParquetWriter) WritePage(page []*common.CdxResponse) error {
+	for _, res := range page {
+		if err := w.pw.Write(NewParquetRecord(res)); err != nil {
+			return fmt.Errorf("[WritePage] Cannot write record: %v", err)
+		}
+		w.rows++
+	}
+	return w.Flush()
+}
+
+// Flush ... Writes buffered records as a row group
+func (w *ParquetWriter) Flush() error {
+	if w.rows == 0 {
+		return nil
+	}
+
+	w.rows = 0
+	if err := w.pw.Flush(true); err != nil {
+		return fmt.Errorf("[Flush] Cannot write row group: %v", err)
+	}
+	return nil
+}
+
+// Close ... Writes the rest of records and file footer
+func (w *ParquetWriter) Close() error {
+	if err := w.pw.WriteStop(); err != nil {
+		return fmt.Errorf("[Close] Cannot write footer: %v", err)
+	}
+	return nil
+}
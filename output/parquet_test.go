@@ -0,0 +1,75 @@
+package output
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	common "github.com/karust/gogetcrawl/common"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+)
+
+// In-memory file for Parquet reader, every column is read with its own reader
+type bytesFile struct {
+	*bytes.Reader
+	data []byte
+}
+
+func newBytesFile(data []byte) bytesFile {
+	return bytesFile{Reader: bytes.NewReader(data), data: data}
+}
+
+func (f bytesFile) Write(p []byte) (int, error)                    { return 0, nil }
+func (f bytesFile) Close() error                                   { return nil }
+func (f bytesFile) Open(name string) (source.ParquetFile, error)   { return newBytesFile(f.data), nil }
+func (f bytesFile) Create(name string) (source.ParquetFile, error) { return f, nil }
+
+func TestParquetWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewParquetWriter(&buf, WithRowGroupRows(2))
+	if err != nil {
+		t.Fatalf("Cannot create writer: %v", err)
+	}
+
+	revisit := *record
+	revisit.Timestamp, revisit.StatusCode, revisit.MimeType = "20140522121421", "-", "warc/revisit"
+	if err := w.WritePage([]*common.CdxResponse{record, &revisit}); err != nil {
+		t.Fatalf("Cannot write page: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := w.Write(record); err != nil {
+			t.Fatalf("Cannot write record: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Cannot close writer: %v", err)
+	}
+
+	file := newBytesFile(buf.Bytes())
+	pr, err := reader.NewParquetReader(file, new(ParquetRecord), 1)
+	if err != nil {
+		t.Fatalf("Cannot read Parquet file: %v", err)
+	}
+	defer pr.ReadStop()
+
+	if pr.GetNumRows() != 5 || len(pr.Footer.RowGroups) != 3 {
+		t.Fatalf("Incorrect rows=%v or row groups=%v, want=5, 3", pr.GetNumRows(), len(pr.Footer.RowGroups))
+	}
+
+	rows := make([]ParquetRecord, 2)
+	if err := pr.Read(&rows); err != nil {
+		t.Fatalf("Cannot read rows: %v", err)
+	}
+
+	want := time.Date(2013, 5, 22, 12, 14, 21, 0, time.UTC).UnixMilli()
+	if rows[0].URL != record.Original || rows[0].Timestamp == nil || *rows[0].Timestamp != want {
+		t.Fatalf("Incorrect URL=%v or timestamp of row", rows[0].URL)
+	}
+	if rows[0].Status == nil || *rows[0].Status != 200 || rows[0].Length == nil || *rows[0].Length != 2558 || rows[0].Offset != nil {
+		t.Fatalf("Incorrect numeric columns: %+v", rows[0])
+	}
+	if rows[1].Status != nil || *rows[1].Mime != "warc/revisit" {
+		t.Fatalf("Revisit status is not null: %+v", rows[1])
+	}
+}
@@ -0,0 +1,188 @@
+package testutil
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Path of archive.today imitation on CDXServer, which is also a Memento archive: TimeMap at /archive/timemap/<url>
+// paged by PageSize, TimeGate at /archive/timegate/<url>, snapshots at /archive/<timestamp>/<url> redirecting to /archive/<id>
+const ArchiveTodayPath = "/archive"
+
+// TimeMapURL ... URL to use as Memento TimeMap server, like archive.today or Memento aggregator
+func (s *CDXServer) TimeMapURL() string {
+	return s.URL + ArchiveTodayPath + "/timemap"
+}
+
+// TimeGateURL ... URL to use as Memento TimeGate
+func (s *CDXServer) TimeGateURL() string {
+	return s.URL + ArchiveTodayPath + "/timegate"
+}
+
+// ArchiveTodayStorageURL ... URL to use as archive.today snapshot storage
+func (s *CDXServer) ArchiveTodayStorageURL() string {
+	return s.URL + ArchiveTodayPath
+}
+
+// MementoCaptures ... Captures for tests of Memento sources: three of https://example.com/ and one of its /about page
+func MementoCaptures() []Capture {
+	return []Capture{
+		HTMLCapture("https://example.com/", "20200101000000", 300),
+		HTMLCapture("https://example.com/", "20200101120000", 300),
+		HTMLCapture("https://example.com/", "20210301000000", 300),
+		HTMLCapture("https://example.com/about", "20200101000000", 300),
+	}
+}
+
+var collapsedScheme = regexp.MustCompile(`(https?):/+`)
+
+// Short snapshot ID, like "AbC12" on archive.today
+func snapshotID(c Capture) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(c.Timestamp+" "+c.URL)))[:5]
+}
+
+func (s *CDXServer) handleArchiveToday(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.RequestURI, ArchiveTodayPath+"/")
+	// Client collapses "//" of URLs in path, like "timemap/https:/example.com/"
+	path = collapsedScheme.ReplaceAllString(path, "$1://")
+
+	if original, ok := strings.CutPrefix(path, "timemap/"); ok {
+		page := 1
+		if rest, ok := strings.CutPrefix(original, "page/"); ok {
+			number, rest, _ := strings.Cut(rest, "/")
+			page, _ = strconv.Atoi(number)
+			original = rest
+		}
+		s.handleTimeMap(w, original, page)
+		return
+	}
+	if original, ok := strings.CutPrefix(path, "timegate/"); ok {
+		s.handleTimeGate(w, r, original)
+		return
+	}
+
+	// Snapshots are requested by time and URL, then by ID
+	if timestamp, original, ok := strings.Cut(path, "/"); ok {
+		original = strings.ReplaceAll(original, "//", "/")
+		for _, e := range s.entries {
+			if e.capture.Timestamp == timestamp && strings.ReplaceAll(e.capture.URL, "//", "/") == original {
+				http.Redirect(w, r, ArchiveTodayPath+"/"+snapshotID(e.capture), http.StatusFound)
+				return
+			}
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	for _, e := range s.entries {
+		if snapshotID(e.capture) == path {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if date, err := time.Parse("20060102150405", e.capture.Timestamp); err == nil {
+				w.Header().Set("Memento-Datetime", date.Format(http.TimeFormat))
+			}
+			w.Write(e.capture.payload())
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// Captures of URL in index order
+func (s *CDXServer) mementos(original string) []*entry {
+	key := SURT(original)
+	var mementos []*entry
+	for _, e := range s.entries {
+		if SURT(e.capture.URL) == key {
+			mementos = append(mementos, e)
+		}
+	}
+	return mementos
+}
+
+func (s *CDXServer) mementoLink(e *entry, rel string) string {
+	date, _ := time.Parse("20060102150405", e.capture.Timestamp)
+	return fmt.Sprintf(`<%v/%v/%v>; rel="%v"; datetime="%v"`, s.ArchiveTodayStorageURL(), e.capture.Timestamp, e.capture.URL, rel, date.Format(http.TimeFormat))
+}
+
+// TimeMap in link format, like archive.today serves. TimeMaps longer than PageSize are paged like on pywb.
+func (s *CDXServer) handleTimeMap(w http.ResponseWriter, original string, page int) {
+	mementos := s.mementos(original)
+	numPages := s.numPages(len(mementos))
+	if len(mementos) == 0 || page < 1 || page > numPages {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	links := []string{
+		fmt.Sprintf(`<%v>; rel="original"`, original),
+		fmt.Sprintf(`<%v/%v>; rel="timegate"`, s.TimeGateURL(), original),
+		fmt.Sprintf(`<%v/%v>; rel="self"; type="application/link-format"`, s.TimeMapURL(), original),
+	}
+	if page < numPages {
+		links = append(links, fmt.Sprintf(`<%v/page/%v/%v>; rel="next"; type="application/link-format"`, s.TimeMapURL(), page+1, original))
+	}
+
+	first, last := (page-1)*s.PageSize, page*s.PageSize
+	if last > len(mementos) {
+		last = len(mementos)
+	}
+	for i, e := range mementos[first:last] {
+		i += first
+		rel := "memento"
+		switch {
+		case len(mementos) == 1:
+			rel = "first last memento"
+		case i == 0:
+			rel = "first memento"
+		case i == len(mementos)-1:
+			rel = "last memento"
+		}
+		links = append(links, s.mementoLink(e, rel))
+	}
+
+	w.Header().Set("Content-Type", "application/link-format")
+	fmt.Fprint(w, strings.Join(links, ",\n")+"\n")
+}
+
+// TimeGate redirecting to the memento closest to Accept-Datetime, or to the last one without it
+func (s *CDXServer) handleTimeGate(w http.ResponseWriter, r *http.Request, original string) {
+	mementos := s.mementos(original)
+	if len(mementos) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	closest := mementos[len(mementos)-1]
+	if header := r.Header.Get("Accept-Datetime"); header != "" {
+		accept, err := http.ParseTime(header)
+		if err != nil {
+			http.Error(w, "Invalid Accept-Datetime", http.StatusBadRequest)
+			return
+		}
+		var best time.Duration = -1
+		for _, e := range mementos {
+			date, _ := time.Parse("20060102150405", e.capture.Timestamp)
+			distance := date.Sub(accept)
+			if distance < 0 {
+				distance = -distance
+			}
+			if best < 0 || distance < best {
+				closest, best = e, distance
+			}
+		}
+	}
+
+	w.Header().Set("Vary", "accept-datetime")
+	w.Header().Set("Link", strings.Join([]string{
+		fmt.Sprintf(`<%v>; rel="original"`, original),
+		fmt.Sprintf(`<%v/%v>; rel="timemap"; type="application/link-format"`, s.TimeMapURL(), original),
+		s.mementoLink(closest, "memento"),
+	}, ", "))
+	w.Header().Set("Location", fmt.Sprintf("%v/%v/%v", s.ArchiveTodayStorageURL(), closest.capture.Timestamp, closest.capture.URL))
+	w.WriteHeader(http.StatusFound)
+}
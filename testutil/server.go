@@ -0,0 +1,697 @@
+// Package testutil provides in-process fake web archive servers for offline tests.
+//
+// CDXServer imitates Wayback CDX API (JSON array or space separated output), Common Crawl index API
+// (NDJSON output, collinfo.json), Wayback file storage (id_ mode) and Common Crawl
+// WARC storage with range requests, archive.today TimeMaps, TimeGate and snapshots.
+package testutil
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/karust/gogetcrawl/common"
+)
+
+// Path of Wayback CDX API and file storage on CDXServer
+const (
+	WaybackIndexPath   = "/cdx/search/cdx"
+	WaybackStoragePath = "/web"
+)
+
+// Columns of Wayback JSON output
+var waybackFields = []string{"urlkey", "timestamp", "original", "mimetype", "statuscode", "digest", "length"}
+
+// Capture ... Archived HTTP response served by CDXServer
+type Capture struct {
+	URL        string      // Original URL
+	Timestamp  string      // Capture time, like "20230320100841"
+	StatusCode int         // HTTP status, 200 if not set
+	MimeType   string      // Content type, "text/html" if not set
+	Header     http.Header // Additional HTTP response headers
+	Body       []byte      // Response payload
+	Index      string      // Common Crawl index ID, first of CDXServer.Indexes if not set
+}
+
+func (c Capture) header() http.Header {
+	header := http.Header{}
+	for k, v := range c.Header {
+		header[k] = v
+	}
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", c.MimeType)
+	}
+	if header.Get("Content-Length") == "" && header.Get("Transfer-Encoding") == "" {
+		header.Set("Content-Length", strconv.Itoa(len(c.Body)))
+	}
+	return header
+}
+
+// Payload as digested by archives: body without chunked transfer encoding
+func (c Capture) payload() []byte {
+	if !strings.EqualFold(c.Header.Get("Transfer-Encoding"), "chunked") {
+		return c.Body
+	}
+	payload, _ := io.ReadAll(httputil.NewChunkedReader(bytes.NewReader(c.Body)))
+	return payload
+}
+
+// Copy of capture with a byte of payload changed, like a corrupted download
+func (c Capture) corrupted() Capture {
+	body := append([]byte{}, c.Body...)
+	i := len(body) - 1
+	if strings.EqualFold(c.Header.Get("Transfer-Encoding"), "chunked") {
+		// First byte of the first chunk
+		i = bytes.Index(body, []byte("\r\n")) + 2
+	}
+	if i >= 0 && i < len(body) {
+		body[i] ^= 0xff
+	}
+	c.Body = body
+	return c
+}
+
+// HTMLCapture ... Creates HTML capture with a deterministic body of given size
+func HTMLCapture(url, timestamp string, size int) Capture {
+	body := []byte(fmt.Sprintf("<html><!-- %v %v -->", url, timestamp))
+	for len(body) < size {
+		body = append(body, '.')
+	}
+	return Capture{URL: url, Timestamp: timestamp, Body: body[:size]}
+}
+
+type entry struct {
+	capture Capture
+	record  common.CdxResponse
+}
+
+// CDXServer ... Fake web archive server
+type CDXServer struct {
+	*httptest.Server
+	PageSize int      // Number of records on a single page
+	Indexes  []string // Common Crawl indexes in collinfo.json, newest first
+
+	NoNumPages bool // Wayback index responds with error to showNumPages requests, like for non-prefix queries
+
+	mu       sync.Mutex
+	entries  []*entry
+	warcs    map[string][]byte // WARC files by their name
+	failures []failure         // Responses returned instead of next requests
+	corrupt  int               // Number of next file downloads served with corrupted payload
+	requests int
+}
+
+type failure struct {
+	status     int
+	retryAfter string
+}
+
+// NewCDXServer ... Starts fake server, should be closed with Close
+func NewCDXServer() *CDXServer {
+	s := &CDXServer{
+		PageSize: 50,
+		Indexes:  []string{"CC-MAIN-2023-14"},
+		warcs:    map[string][]byte{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// WaybackIndexURL ... URL to use as Wayback index server
+func (s *CDXServer) WaybackIndexURL() string {
+	return s.URL + WaybackIndexPath
+}
+
+// WaybackStorageURL ... URL to use as Wayback file storage
+func (s *CDXServer) WaybackStorageURL() string {
+	return s.URL + WaybackStoragePath
+}
+
+// AddCapture ... Adds capture to the index and WARC storage, returns CDX record describing it
+func (s *CDXServer) AddCapture(c Capture) common.CdxResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c.StatusCode == 0 {
+		c.StatusCode = http.StatusOK
+	}
+	if c.MimeType == "" {
+		c.MimeType = "text/html"
+	}
+	if c.Index == "" && len(s.Indexes) > 0 {
+		c.Index = s.Indexes[0]
+	}
+
+	filename := fmt.Sprintf("crawl-data/%v/segments/0/warc/testutil-00000.warc.gz", c.Index)
+	record := WARCRecord(c)
+	offset := len(s.warcs[filename])
+	s.warcs[filename] = append(s.warcs[filename], record...)
+
+	e := &entry{
+		capture: c,
+		record: common.CdxResponse{
+			Urlkey:     SURT(c.URL),
+			Timestamp:  c.Timestamp,
+			Original:   c.URL,
+			MimeType:   c.MimeType,
+			StatusCode: strconv.Itoa(c.StatusCode),
+			Digest:     Digest(c.payload()),
+			Length:     strconv.Itoa(len(record)),
+			Offset:     strconv.Itoa(offset),
+			Filename:   filename,
+		},
+	}
+	s.entries = append(s.entries, e)
+
+	// CDX servers return records sorted by SURT and time
+	sort.SliceStable(s.entries, func(i, j int) bool {
+		a, b := s.entries[i].record, s.entries[j].record
+		if a.Urlkey != b.Urlkey {
+			return a.Urlkey < b.Urlkey
+		}
+		return a.Timestamp < b.Timestamp
+	})
+
+	return e.record
+}
+
+// FailNext ... Makes server respond with status to the next n requests
+//
+//	retryAfter: value of Retry-After header, not sent if empty
+func (s *CDXServer) FailNext(n int, status int, retryAfter string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		s.failures = append(s.failures, failure{status: status, retryAfter: retryAfter})
+	}
+}
+
+// CorruptNext ... Makes server change a byte of payload in the next n Wayback file or WARC record downloads
+func (s *CDXServer) CorruptNext(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.corrupt += n
+}
+
+// Requests ... Returns number of requests received by server
+func (s *CDXServer) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *CDXServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	if len(s.failures) > 0 {
+		f := s.failures[0]
+		s.failures = s.failures[1:]
+		if f.retryAfter != "" {
+			w.Header().Set("Retry-After", f.retryAfter)
+		}
+		http.Error(w, http.StatusText(f.status), f.status)
+		return
+	}
+
+	switch {
+	case r.URL.Path == WaybackIndexPath:
+		s.handleWaybackIndex(w, r)
+	case strings.HasPrefix(r.URL.Path, WaybackStoragePath+"/"):
+		s.handleWaybackFile(w, r)
+	case r.URL.Path == "/collinfo.json":
+		s.handleCollinfo(w, r)
+	case strings.HasSuffix(r.URL.Path, "-index"):
+		s.handleCommonCrawlIndex(w, r, strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), "-index"))
+	case strings.HasPrefix(r.URL.Path, "/crawl-data/"):
+		s.handleWARC(w, r)
+	case strings.HasPrefix(r.URL.Path, ArchiveTodayPath+"/"):
+		s.handleArchiveToday(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *CDXServer) numPages(total int) int {
+	return int(math.Ceil(float64(total) / float64(s.PageSize)))
+}
+
+// Select records of index (all if empty) matching query parameters.
+// Reports whether more records were left after limit.
+func (s *CDXServer) query(r *http.Request, index string, paged bool) ([]*entry, bool, error) {
+	params := r.URL.Query()
+	matcher := urlMatcher(params.Get("url"))
+
+	filters := []func(*entry) bool{}
+	for _, f := range params["filter"] {
+		filter, err := parseFilter(f)
+		if err != nil {
+			return nil, false, err
+		}
+		filters = append(filters, filter)
+	}
+
+	from := padTimestamp(params.Get("from"), '0')
+	to := padTimestamp(params.Get("to"), '9')
+
+	var matched []*entry
+	for _, e := range s.entries {
+		if index != "" && e.capture.Index != index {
+			continue
+		}
+		if !matcher(e.capture.URL) {
+			continue
+		}
+		if (from != "" && e.record.Timestamp < from) || (to != "" && e.record.Timestamp > to) {
+			continue
+		}
+		matched = append(matched, e)
+	}
+
+	// Pages are split before filtering, like blocks of ZipNum index
+	if pageParam := params.Get("page"); paged && pageParam != "" {
+		page, _ := strconv.Atoi(pageParam)
+		start, end := page*s.PageSize, (page+1)*s.PageSize
+		if start > len(matched) {
+			start = len(matched)
+		}
+		if end > len(matched) {
+			end = len(matched)
+		}
+		matched = matched[start:end]
+	}
+
+	// Common Crawl index server ignores collapse
+	collapses := []func(*entry) bool{}
+	for _, c := range params["collapse"] {
+		if index != "" {
+			break
+		}
+		collapse, err := parseCollapse(c)
+		if err != nil {
+			return nil, false, err
+		}
+		collapses = append(collapses, collapse)
+	}
+
+	var results []*entry
+	for _, e := range matched {
+		passed := true
+		for _, filter := range filters {
+			passed = passed && filter(e)
+		}
+		for _, collapse := range collapses {
+			passed = passed && collapse(e)
+		}
+		if !passed {
+			continue
+		}
+		results = append(results, e)
+	}
+
+	// Resume key is urlkey and timestamp of the last returned record
+	if key := params.Get("resumeKey"); key != "" {
+		sep := strings.LastIndex(key, " ")
+		if sep < 0 {
+			return nil, false, fmt.Errorf("invalid resumeKey: %q", key)
+		}
+		urlkey, timestamp := key[:sep], key[sep+1:]
+
+		skip := 0
+		for skip < len(results) {
+			rec := results[skip].record
+			if rec.Urlkey > urlkey || (rec.Urlkey == urlkey && rec.Timestamp > timestamp) {
+				break
+			}
+			skip++
+		}
+		results = results[skip:]
+	}
+
+	more := false
+	if limit, _ := strconv.Atoi(params.Get("limit")); limit > 0 && len(results) > limit {
+		results = results[:limit]
+		more = true
+	}
+	return results, more, nil
+}
+
+func (s *CDXServer) handleWaybackIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("showNumPages") == "true" {
+		if s.NoNumPages {
+			http.Error(w, "Sorry, pagination is not supported for this query", http.StatusBadRequest)
+			return
+		}
+		results, _, _ := s.query(r, "", false)
+		fmt.Fprintf(w, "%d\n", s.numPages(len(results)))
+		return
+	}
+
+	results, more, err := s.query(r, "", true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Space separated fields are the default output
+	if r.URL.Query().Get("output") != "json" {
+		w.Header().Set("Content-Type", "text/plain")
+		for _, e := range results {
+			rec := e.record
+			fmt.Fprintln(w, strings.Join([]string{rec.Urlkey, rec.Timestamp, rec.Original, rec.MimeType, rec.StatusCode, rec.Digest, rec.Length}, " "))
+		}
+		return
+	}
+
+	rows := [][]string{waybackFields}
+	for _, e := range results {
+		rec := e.record
+		rows = append(rows, []string{rec.Urlkey, rec.Timestamp, rec.Original, rec.MimeType, rec.StatusCode, rec.Digest, rec.Length})
+	}
+
+	// Like Wayback, resume key follows an empty row
+	if more && r.URL.Query().Get("showResumeKey") == "true" {
+		last := results[len(results)-1].record
+		rows = append(rows, []string{}, []string{url.QueryEscape(last.Urlkey + " " + last.Timestamp)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	data, _ := jsoniter.Marshal(rows)
+	w.Write(data)
+}
+
+func (s *CDXServer) handleWaybackFile(w http.ResponseWriter, r *http.Request) {
+	// Path is like /web/20230320100841id_/http://example.com/
+	path := strings.TrimPrefix(r.RequestURI, WaybackStoragePath+"/")
+	timestamp, original, ok := strings.Cut(path, "id_/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Clients may collapse "//" in the path, like Wayback accept "http:/example.com"
+	original = strings.ReplaceAll(original, "//", "/")
+
+	// Like Wayback, the nearest capture of URL is replayed if there is none at timestamp
+	var found *entry
+	for _, e := range s.entries {
+		if strings.ReplaceAll(e.capture.URL, "//", "/") != original {
+			continue
+		}
+		if found == nil || distance(e.capture.Timestamp, timestamp) < distance(found.capture.Timestamp, timestamp) {
+			found = e
+		}
+	}
+	if found == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Like Wayback, original headers are prefixed, except the content type
+	header := found.capture.header()
+	for k, v := range header {
+		w.Header()["X-Archive-Orig-"+k] = v
+	}
+	w.Header().Set("Content-Type", header.Get("Content-Type"))
+	if date, err := time.Parse("20060102150405", found.capture.Timestamp); err == nil {
+		w.Header().Set("Memento-Datetime", date.Format(http.TimeFormat))
+	}
+	capture := found.capture
+	if s.corrupt > 0 {
+		s.corrupt--
+		capture = capture.corrupted()
+	}
+	w.WriteHeader(capture.StatusCode)
+	w.Write(capture.payload())
+}
+
+// Time between two timestamps
+func distance(a, b string) time.Duration {
+	ta, _ := time.Parse("20060102150405", a)
+	tb, _ := time.Parse("20060102150405", b)
+	if d := ta.Sub(tb); d > 0 {
+		return d
+	}
+	return tb.Sub(ta)
+}
+
+func (s *CDXServer) handleCollinfo(w http.ResponseWriter, r *http.Request) {
+	type collection struct {
+		Id       string `json:"id"`
+		Name     string `json:"name"`
+		Timegate string `json:"timegate"`
+		CdxAPI   string `json:"cdx-api"`
+		From     string `json:"from,omitempty"`
+		To       string `json:"to,omitempty"`
+	}
+
+	collections := []collection{}
+	for _, index := range s.Indexes {
+		c := collection{
+			Id:       index,
+			Name:     index + " Index",
+			Timegate: fmt.Sprintf("%v/%v/", s.URL, index),
+			CdxAPI:   fmt.Sprintf("%v/%v-index", s.URL, index),
+		}
+
+		// Crawl dates are taken from its captures
+		for _, e := range s.entries {
+			if e.capture.Index != index {
+				continue
+			}
+			date, err := time.Parse("20060102150405", e.capture.Timestamp)
+			if err != nil {
+				continue
+			}
+			if d := date.Format("2006-01-02T15:04:05"); c.From == "" || d < c.From {
+				c.From = d
+			}
+			if d := date.Format("2006-01-02T15:04:05"); c.To == "" || d > c.To {
+				c.To = d
+			}
+		}
+		collections = append(collections, c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	data, _ := jsoniter.Marshal(collections)
+	w.Write(data)
+}
+
+func (s *CDXServer) handleCommonCrawlIndex(w http.ResponseWriter, r *http.Request, index string) {
+	known := false
+	for _, i := range s.Indexes {
+		known = known || i == index
+	}
+	if !known {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.URL.Query().Get("showNumPages") == "true" {
+		results, _, _ := s.query(r, index, false)
+		fmt.Fprintf(w, `{"pages": %d, "pageSize": %d, "blocks": %d}`, s.numPages(len(results)), s.PageSize, len(results))
+		return
+	}
+
+	results, _, err := s.query(r, index, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(results) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"message": "No Captures found for: %v"}`+"\n", r.URL.Query().Get("url"))
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, e := range results {
+		rec := e.record
+		line, _ := jsoniter.Marshal(map[string]string{
+			"urlkey":        rec.Urlkey,
+			"timestamp":     rec.Timestamp,
+			"url":           rec.Original,
+			"mime":          rec.MimeType,
+			"mime-detected": rec.MimeType,
+			"status":        rec.StatusCode,
+			"digest":        rec.Digest,
+			"length":        rec.Length,
+			"offset":        rec.Offset,
+			"filename":      rec.Filename,
+		})
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	w.Header().Set("Content-Type", "text/x-ndjson")
+	w.Write(buf.Bytes())
+}
+
+func (s *CDXServer) handleWARC(w http.ResponseWriter, r *http.Request) {
+	data, ok := s.warcs[strings.TrimPrefix(r.URL.Path, "/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	if s.corrupt > 0 {
+		filename := strings.TrimPrefix(r.URL.Path, "/")
+		start, _, _ := strings.Cut(strings.TrimPrefix(r.Header.Get("Range"), "bytes="), "-")
+		for _, e := range s.entries {
+			if e.record.Filename == filename && e.record.Offset == start {
+				s.corrupt--
+				record := WARCRecord(e.capture.corrupted())
+				offset, _ := strconv.Atoi(start)
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", offset, offset+len(record)-1, len(data)))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(record)
+				return
+			}
+		}
+	}
+
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// SURT ... Simplified Sort-friendly URI Reordering Transform used for urlkey:
+// "http://www.example.com/Path?q=1" -> "com,example)/path?q=1"
+func SURT(rawURL string) string {
+	host, path := splitURL(rawURL)
+	labels := strings.Split(host, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	if path == "" {
+		path = "/"
+	}
+	return strings.Join(labels, ",") + ")" + path
+}
+
+// Split URL into lowercase host without "www." and the rest
+func splitURL(rawURL string) (string, string) {
+	u := strings.ToLower(rawURL)
+	if i := strings.Index(u, "://"); i >= 0 {
+		u = u[i+3:]
+	}
+	u = strings.TrimPrefix(u, "www.")
+
+	host, path := u, ""
+	if i := strings.IndexAny(u, "/?"); i >= 0 {
+		host, path = u[:i], u[i:]
+	}
+	if i := strings.Index(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	return host, path
+}
+
+// Returns matcher of CDX url parameter: exact URL, "prefix*" or "*.domain" match
+func urlMatcher(pattern string) func(string) bool {
+	switch {
+	case strings.HasPrefix(pattern, "*."):
+		domain, _ := splitURL(strings.TrimSuffix(strings.TrimPrefix(pattern, "*."), "/*"))
+		return func(u string) bool {
+			host, _ := splitURL(u)
+			return host == domain || strings.HasSuffix(host, "."+domain)
+		}
+	case strings.HasSuffix(pattern, "*"):
+		prefix := SURT(strings.TrimSuffix(pattern, "*"))
+		prefix = strings.TrimSuffix(prefix, "/")
+		return func(u string) bool {
+			return strings.HasPrefix(SURT(u), prefix)
+		}
+	default:
+		key := SURT(pattern)
+		return func(u string) bool {
+			return SURT(u) == key
+		}
+	}
+}
+
+// Parse CDX filter like "statuscode:200" or "!mimetype:text/.*"
+func parseFilter(filter string) (func(*entry) bool, error) {
+	negate := strings.HasPrefix(filter, "!")
+	field, expr, ok := strings.Cut(strings.TrimPrefix(filter, "!"), ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid filter '%v'", filter)
+	}
+
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, err
+	}
+
+	return func(e *entry) bool {
+		return re.MatchString(e.field(field)) != negate
+	}, nil
+}
+
+// Collapse by field, or its prefix like "timestamp:8", comparing with the last record passed by it
+func parseCollapse(collapse string) (func(*entry) bool, error) {
+	field, prefix, hasPrefix := strings.Cut(collapse, ":")
+	n := 0
+	if hasPrefix {
+		var err error
+		if n, err = strconv.Atoi(prefix); err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid collapse '%v'", collapse)
+		}
+	}
+
+	var last *string
+	return func(e *entry) bool {
+		value := e.field(field)
+		if n > 0 && len(value) > n {
+			value = value[:n]
+		}
+		if last != nil && *last == value {
+			return false
+		}
+		last = &value
+		return true
+	}, nil
+}
+
+func (e *entry) field(name string) string {
+	switch name {
+	case "statuscode", "status":
+		return e.record.StatusCode
+	case "mimetype", "mime":
+		return e.record.MimeType
+	case "original", "url":
+		return e.record.Original
+	case "urlkey":
+		return e.record.Urlkey
+	case "timestamp":
+		return e.record.Timestamp
+	case "digest":
+		return e.record.Digest
+	case "length":
+		return e.record.Length
+	}
+	return ""
+}
+
+// Pad partial timestamp like "2020" to 14 digits
+func padTimestamp(timestamp string, pad byte) string {
+	if timestamp == "" || len(timestamp) >= 14 {
+		return timestamp
+	}
+	return timestamp + strings.Repeat(string(pad), 14-len(timestamp))
+}
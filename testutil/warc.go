@@ -0,0 +1,72 @@
+package testutil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Digest ... Returns CDX style digest of a payload: base32 encoded SHA-1
+func Digest(payload []byte) string {
+	sum := sha1.Sum(payload)
+	return base32.StdEncoding.EncodeToString(sum[:])
+}
+
+// HTTPMessage ... Composes raw HTTP response of a capture as it is stored in WARC response record
+func HTTPMessage(c Capture) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/1.1 %d %s\r\n", c.StatusCode, http.StatusText(c.StatusCode))
+
+	header := c.header()
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		for _, v := range header[k] {
+			fmt.Fprintf(&buf, "%s: %s\r\n", k, v)
+		}
+	}
+	buf.WriteString("\r\n")
+	buf.Write(c.Body)
+	return buf.Bytes()
+}
+
+// WARCRecord ... Composes gzip compressed WARC response record of a capture
+func WARCRecord(c Capture) []byte {
+	block := HTTPMessage(c)
+	date, _ := time.Parse("20060102150405", c.Timestamp)
+
+	var record bytes.Buffer
+	record.WriteString("WARC/1.0\r\n")
+	record.WriteString("WARC-Type: response\r\n")
+	fmt.Fprintf(&record, "WARC-Target-URI: %s\r\n", c.URL)
+	fmt.Fprintf(&record, "WARC-Date: %s\r\n", date.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&record, "WARC-Record-ID: <urn:uuid:%s>\r\n", recordID(c))
+	fmt.Fprintf(&record, "WARC-Payload-Digest: sha1:%s\r\n", Digest(c.payload()))
+	fmt.Fprintf(&record, "WARC-Block-Digest: sha1:%s\r\n", Digest(block))
+	record.WriteString("Content-Type: application/http; msgtype=response\r\n")
+	fmt.Fprintf(&record, "Content-Length: %d\r\n", len(block))
+	record.WriteString("\r\n")
+	record.Write(block)
+	record.WriteString("\r\n\r\n")
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(record.Bytes())
+	gz.Close()
+	return compressed.Bytes()
+}
+
+// Deterministic record ID, so fixtures don't change between runs
+func recordID(c Capture) string {
+	sum := sha1.Sum([]byte(c.Timestamp + c.URL))
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
@@ -0,0 +1,360 @@
+package warcwriter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	common "github.com/karust/gogetcrawl/common"
+)
+
+const WARC_VERSION = "WARC/1.1"
+const MAX_FILE_SIZE = 1 << 30 // Default size of a WARC file after which the next one is started, 1 GiB
+
+// Header ... WARC record header fields in order of writing
+type Header [][2]string
+
+// Get ... Returns value of the first field with given name
+func (h Header) Get(name string) string {
+	for _, field := range h {
+		if field[0] == name {
+			return field[1]
+		}
+	}
+	return ""
+}
+
+// Writer ... Writes WARC records compressed one by one with gzip into files rotated by size.
+// Safe to use from multiple workers.
+type Writer struct {
+	dir      string
+	prefix   string
+	maxSize  int64
+	software string
+	decoded  bool
+
+	mu         sync.Mutex
+	file       *os.File
+	filename   string
+	size       int64
+	serial     int
+	warcinfoID string
+}
+
+// Option ... Configures Writer in NewWriter
+type Option func(*Writer)
+
+// WithMaxSize ... Sets size of a WARC file after which the next one is started, MAX_FILE_SIZE by default
+func WithMaxSize(size int64) Option {
+	return func(w *Writer) {
+		if size > 0 {
+			w.maxSize = size
+		}
+	}
+}
+
+// WithSoftware ... Sets software name written into warcinfo records
+func WithSoftware(software string) Option {
+	return func(w *Writer) {
+		w.software = software
+	}
+}
+
+// WithDecoded ... Writes captures with decoded bodies instead of archived payloads, see WriteCapture.
+// Payload digests of such records are computed from decoded bodies and don't match CDX digests.
+func WithDecoded(decoded bool) Option {
+	return func(w *Writer) {
+		w.decoded = decoded
+	}
+}
+
+// NewWriter ... Creates writer of files named like <prefix>-<date>-00000.warc.gz in dir
+func NewWriter(dir, prefix string, opts ...Option) (*Writer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("[NewWriter] Cannot create output dir: %v", err)
+	}
+
+	w := &Writer{
+		dir:      dir,
+		prefix:   prefix,
+		maxSize:  MAX_FILE_SIZE,
+		software: "gogetcrawl",
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w, nil
+}
+
+// Filename ... Returns path of the file being written, empty before the first record
+func (w *Writer) Filename() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.filename
+}
+
+// WriteResponse ... Writes capture of CDX record as WARC response record.
+// Date, target URI and payload digest are taken from the record.
+//
+//	httpMessage: full HTTP response, see HTTPMessage to compose it from a payload
+func (w *Writer) WriteResponse(res *common.CdxResponse, httpMessage []byte) error {
+	date, err := time.Parse("20060102150405", res.Timestamp)
+	if err != nil {
+		return fmt.Errorf("[WriteResponse] Invalid timestamp '%v': %v", res.Timestamp, err)
+	}
+
+	header := Header{
+		{"WARC-Type", "response"},
+		{"WARC-Record-ID", newRecordID()},
+		{"WARC-Date", date.UTC().Format(time.RFC3339)},
+		{"WARC-Target-URI", res.Original},
+	}
+	if common.NormalizeDigest(res.Digest) != "" {
+		header = append(header, [2]string{"WARC-Payload-Digest", "sha1:" + common.NormalizeDigest(res.Digest)})
+	}
+	header = append(header,
+		[2]string{"WARC-Block-Digest", blockDigest(httpMessage)},
+		[2]string{"Content-Type", "application/http;msgtype=response"},
+	)
+
+	return w.WriteRecord(header, httpMessage)
+}
+
+// Message ... Kind of data written with WriteFile
+type Message int
+
+const (
+	MessageHTTP    Message = iota // Full HTTP response as stored in WARC
+	MessagePayload                // Payload only, HTTP message is composed for it with HTTPMessage
+)
+
+// WriteFile ... Writes file downloaded with Source.GetFile as response record.
+// Files are decoded payloads and need MessagePayload, HTTP headers of such records are not archived ones.
+// Use WriteCapture to keep archived headers and payload.
+func (w *Writer) WriteFile(res *common.CdxResponse, data []byte, message Message) error {
+	if message == MessagePayload {
+		data = HTTPMessage(res, data)
+	}
+	return w.WriteResponse(res, data)
+}
+
+// WriteCapture ... Writes capture downloaded with Source.GetCapture as response record, with archived status and headers.
+// Payload is written as archived and keeps the CDX digest, digest is computed only for records without it.
+// Writer created WithDecoded writes decoded body, see DecodedCaptureMessage.
+func (w *Writer) WriteCapture(capture *common.Capture) error {
+	res := *capture.Record
+	if w.decoded {
+		res.Digest = common.PayloadDigest(capture.Body)
+		return w.WriteResponse(&res, DecodedCaptureMessage(capture))
+	}
+
+	if common.NormalizeDigest(res.Digest) == "" {
+		res.Digest = common.PayloadDigest(capturePayload(capture))
+	}
+	return w.WriteResponse(&res, CaptureMessage(capture))
+}
+
+// WriteRecord ... Writes record with given header fields and block.
+// Content-Length and WARC-Warcinfo-ID fields are added by the writer.
+func (w *Writer) WriteRecord(header Header, block []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+
+	record := compressRecord(append(header, [2]string{"WARC-Warcinfo-ID", w.warcinfoID}), block)
+	if w.size > 0 && w.size+int64(len(record)) > w.maxSize {
+		if err := w.close(); err != nil {
+			return err
+		}
+		if err := w.open(); err != nil {
+			return err
+		}
+		record = compressRecord(append(header, [2]string{"WARC-Warcinfo-ID", w.warcinfoID}), block)
+	}
+
+	n, err := w.file.Write(record)
+	w.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("[WriteRecord] Cannot write to '%v': %v", w.filename, err)
+	}
+	return nil
+}
+
+// Close ... Closes the current file
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.close()
+}
+
+// Start next file with warcinfo record. Names taken by other writers in the same second are skipped.
+func (w *Writer) open() error {
+	date := time.Now().UTC().Format("20060102150405")
+	var name, path string
+	var file *os.File
+	for {
+		name = fmt.Sprintf("%v-%v-%05d.warc.gz", w.prefix, date, w.serial)
+		path = filepath.Join(w.dir, name)
+
+		var err error
+		file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+		if errors.Is(err, os.ErrExist) {
+			w.serial++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("[WriteRecord] Cannot create WARC file: %v", err)
+		}
+		break
+	}
+	w.file, w.filename, w.size = file, path, 0
+	w.serial++
+
+	var fields bytes.Buffer
+	fmt.Fprintf(&fields, "software: %v\r\n", w.software)
+	fmt.Fprintf(&fields, "format: WARC File Format 1.1\r\n")
+	fmt.Fprintf(&fields, "conformsTo: https://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/\r\n")
+
+	w.warcinfoID = newRecordID()
+	record := compressRecord(Header{
+		{"WARC-Type", "warcinfo"},
+		{"WARC-Record-ID", w.warcinfoID},
+		{"WARC-Date", time.Now().UTC().Format(time.RFC3339)},
+		{"WARC-Filename", name},
+		{"Content-Type", "application/warc-fields"},
+	}, fields.Bytes())
+
+	n, err := w.file.Write(record)
+	w.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("[WriteRecord] Cannot write to '%v': %v", w.filename, err)
+	}
+	return nil
+}
+
+func (w *Writer) close() error {
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.file.Close()
+	w.file = nil
+	if err != nil {
+		return fmt.Errorf("[Close] Cannot close '%v': %v", w.filename, err)
+	}
+	return nil
+}
+
+// HTTPMessage ... Composes HTTP response of CDX record from payload, for archives which return only the payload.
+// Status code and Content-Type are taken from the record.
+func HTTPMessage(res *common.CdxResponse, payload []byte) []byte {
+	status, err := strconv.Atoi(res.StatusCode)
+	if err != nil || status == 0 {
+		status = http.StatusOK
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	if res.MimeType != "" && res.MimeType != "unk" && res.MimeType != "warc/revisit" {
+		fmt.Fprintf(&buf, "Content-Type: %v\r\n", res.MimeType)
+	}
+	fmt.Fprintf(&buf, "Content-Length: %d\r\n", len(payload))
+	buf.WriteString("\r\n")
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+// CaptureMessage ... Composes HTTP response of capture with archived status, headers and payload.
+// Payload is de-chunked, so Transfer-Encoding is dropped and Content-Length is set. Content-Encoding is kept.
+func CaptureMessage(capture *common.Capture) []byte {
+	header := captureHeader(capture)
+	if capture.Payload != nil && capture.Encoding != "" {
+		header.Set("Content-Encoding", capture.Encoding)
+	}
+	return captureMessage(capture.StatusCode, header, capturePayload(capture))
+}
+
+// DecodedCaptureMessage ... Composes HTTP response of capture with archived status and headers and decoded body.
+// Transfer-Encoding is dropped and Content-Length is set, as body is de-chunked and decoded.
+func DecodedCaptureMessage(capture *common.Capture) []byte {
+	return captureMessage(capture.StatusCode, captureHeader(capture), capture.Body)
+}
+
+// Captures created without archived payload are written with their body
+func capturePayload(capture *common.Capture) []byte {
+	if capture.Payload == nil {
+		return capture.Body
+	}
+	return capture.Payload
+}
+
+func captureHeader(capture *common.Capture) http.Header {
+	header := capture.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Del("Transfer-Encoding")
+	return header
+}
+
+func captureMessage(status int, header http.Header, body []byte) []byte {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	header.Write(&buf)
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// Gzip member with a single record
+func compressRecord(header Header, block []byte) []byte {
+	var record bytes.Buffer
+	gz := gzip.NewWriter(&record)
+
+	fmt.Fprintf(gz, "%v\r\n", WARC_VERSION)
+	for _, field := range header {
+		fmt.Fprintf(gz, "%v: %v\r\n", field[0], field[1])
+	}
+	fmt.Fprintf(gz, "Content-Length: %d\r\n\r\n", len(block))
+	gz.Write(block)
+	gz.Write([]byte("\r\n\r\n"))
+	gz.Close()
+
+	return record.Bytes()
+}
+
+func blockDigest(block []byte) string {
+	sum := sha1.Sum(block)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+// Random UUID as record ID
+func newRecordID() string {
+	var u [16]byte
+	rand.Read(u[:])
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
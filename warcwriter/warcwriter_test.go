@@ -0,0 +1,211 @@
+package warcwriter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	common "github.com/karust/gogetcrawl/common"
+	"github.com/slyrz/warc"
+)
+
+func readRecords(t *testing.T, path string) []*warc.Record {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Cannot open WARC file: %v", err)
+	}
+	defer file.Close()
+
+	reader, err := warc.NewReader(file)
+	if err != nil {
+		t.Fatalf("Cannot read WARC file: %v", err)
+	}
+	defer reader.Close()
+
+	var records []*warc.Record
+	for {
+		record, err := reader.ReadRecord()
+		if err == io.EOF {
+			return records
+		}
+		if err != nil {
+			t.Fatalf("Cannot read WARC record: %v", err)
+		}
+
+		var content bytes.Buffer
+		io.Copy(&content, record.Content)
+		record.Content = &content
+		records = append(records, record)
+	}
+}
+
+func TestWriteResponse(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(dir, "test")
+	if err != nil {
+		t.Fatalf("Cannot create writer: %v", err)
+	}
+
+	res := &common.CdxResponse{
+		Original:   "http://kamaloff.ru/",
+		Timestamp:  "20130522121421",
+		MimeType:   "text/html",
+		StatusCode: "200",
+		Digest:     "FXOQP7LM7FWUC7S5MTDHZS2WMKNLCW2E",
+	}
+	if err := w.WriteResponse(res, HTTPMessage(res, []byte("<html></html>"))); err != nil {
+		t.Fatalf("Cannot write response: %v", err)
+	}
+	w.Close()
+
+	records := readRecords(t, w.Filename())
+	if len(records) != 2 {
+		t.Fatalf("Incorrect number of records: %v, want=2", len(records))
+	}
+
+	if records[0].Header.Get("WARC-Type") != "warcinfo" {
+		t.Fatalf("First record is not warcinfo: %v", records[0].Header.Get("WARC-Type"))
+	}
+
+	response := records[1]
+	want := map[string]string{
+		"WARC-Type":           "response",
+		"WARC-Target-URI":     "http://kamaloff.ru/",
+		"WARC-Date":           "2013-05-22T12:14:21Z",
+		"WARC-Payload-Digest": "sha1:FXOQP7LM7FWUC7S5MTDHZS2WMKNLCW2E",
+		"WARC-Warcinfo-ID":    records[0].Header.Get("WARC-Record-ID"),
+	}
+	for name, value := range want {
+		if got := response.Header.Get(name); got != value {
+			t.Fatalf("Incorrect %v: %v, want=%v", name, got, value)
+		}
+	}
+
+	content := response.Content.(*bytes.Buffer).String()
+	if !strings.HasPrefix(content, "HTTP/1.1 200 OK\r\n") || !strings.HasSuffix(content, "\r\n\r\n<html></html>") {
+		t.Fatalf("Incorrect HTTP message: %q", content)
+	}
+
+	// Every record is a separate gzip member starting with WARC/1.1
+	data, _ := os.ReadFile(w.Filename())
+	gz, _ := gzip.NewReader(bytes.NewReader(data))
+	gz.Multistream(false)
+	first, _ := io.ReadAll(gz)
+	if !bytes.HasPrefix(first, []byte("WARC/1.1\r\n")) {
+		t.Fatalf("Incorrect WARC version line: %q", first[:10])
+	}
+}
+
+func TestRotation(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(dir, "test", WithMaxSize(1000))
+	if err != nil {
+		t.Fatalf("Cannot create writer: %v", err)
+	}
+
+	res := &common.CdxResponse{Original: "http://kamaloff.ru/", Timestamp: "20130522121421"}
+	for i := 0; i < 5; i++ {
+		if err := w.WriteResponse(res, HTTPMessage(res, bytes.Repeat([]byte{byte(i)}, 600))); err != nil {
+			t.Fatalf("Cannot write response: %v", err)
+		}
+	}
+	w.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "test-*.warc.gz"))
+	if len(files) < 2 {
+		t.Fatalf("Files are not rotated: %v", files)
+	}
+
+	responses := 0
+	for _, file := range files {
+		records := readRecords(t, file)
+		if records[0].Header.Get("WARC-Type") != "warcinfo" {
+			t.Fatalf("File %v doesn't start with warcinfo", file)
+		}
+		responses += len(records) - 1
+	}
+
+	if responses != 5 {
+		t.Fatalf("Incorrect number of responses: %v, want=5", responses)
+	}
+}
+
+func TestWriteCapture(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(dir, "test")
+	if err != nil {
+		t.Fatalf("Cannot create writer: %v", err)
+	}
+
+	// Digests of CDXJ and local sources have a prefix
+	res := &common.CdxResponse{Original: "http://kamaloff.ru/", Timestamp: "20130522121421", Digest: "sha1:FXOQP7LM7FWUC7S5MTDHZS2WMKNLCW2E"}
+	if err := w.WriteFile(res, []byte("<html></html>"), MessagePayload); err != nil {
+		t.Fatalf("Cannot write file: %v", err)
+	}
+
+	var payload bytes.Buffer
+	gz := gzip.NewWriter(&payload)
+	gz.Write([]byte("Not found"))
+	gz.Close()
+
+	header := http.Header{"Server": {"nginx"}, "Transfer-Encoding": {"chunked"}, "Content-Type": {"text/html"}, "Content-Encoding": {"gzip"}}
+	capture := common.NewCapture(res, 404, header, payload.Bytes())
+	if err := w.WriteCapture(capture); err != nil {
+		t.Fatalf("Cannot write capture: %v", err)
+	}
+
+	decoded, _ := NewWriter(dir, "decoded", WithDecoded(true))
+	if err := decoded.WriteCapture(capture); err != nil {
+		t.Fatalf("Cannot write decoded capture: %v", err)
+	}
+	w.Close()
+	decoded.Close()
+
+	records := readRecords(t, w.Filename())
+	if got := records[1].Header.Get("WARC-Payload-Digest"); got != "sha1:FXOQP7LM7FWUC7S5MTDHZS2WMKNLCW2E" {
+		t.Fatalf("Incorrect payload digest: %v", got)
+	}
+
+	// Archived payload is written as is with CDX digest
+	content := records[2].Content.(*bytes.Buffer).String()
+	want := fmt.Sprintf("HTTP/1.1 404 Not Found\r\nContent-Encoding: gzip\r\nContent-Length: %d\r\nContent-Type: text/html\r\nServer: nginx\r\n\r\n%s", payload.Len(), payload.Bytes())
+	if content != want {
+		t.Fatalf("Incorrect HTTP message of capture: %q", content)
+	}
+	if got := records[2].Header.Get("WARC-Payload-Digest"); got != "sha1:FXOQP7LM7FWUC7S5MTDHZS2WMKNLCW2E" {
+		t.Fatalf("Incorrect payload digest of capture: %v", got)
+	}
+
+	records = readRecords(t, decoded.Filename())
+	content = records[1].Content.(*bytes.Buffer).String()
+	want = "HTTP/1.1 404 Not Found\r\nContent-Length: 9\r\nContent-Type: text/html\r\nServer: nginx\r\n\r\nNot found"
+	if content != want {
+		t.Fatalf("Incorrect HTTP message of decoded capture: %q", content)
+	}
+	if got := records[1].Header.Get("WARC-Payload-Digest"); got != "sha1:"+common.PayloadDigest([]byte("Not found")) {
+		t.Fatalf("Incorrect payload digest of decoded capture: %v", got)
+	}
+}
+
+func TestFileNames(t *testing.T) {
+	dir := t.TempDir()
+	first, _ := NewWriter(dir, "test")
+	second, _ := NewWriter(dir, "test")
+
+	res := &common.CdxResponse{Original: "http://kamaloff.ru/", Timestamp: "20130522121421"}
+	for _, w := range []*Writer{first, second} {
+		if err := w.WriteFile(res, []byte("<html></html>"), MessagePayload); err != nil {
+			t.Fatalf("Cannot write file: %v", err)
+		}
+		w.Close()
+	}
+	if first.Filename() == second.Filename() {
+		t.Fatalf("Writers share file: %v", first.Filename())
+	}
+}
@@ -1,8 +1,12 @@
 package wayback
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"net/http"
 	"strconv"
+	"strings"
 
 	jsoniter "github.com/json-iterator/go"
 	common "github.com/karust/gogetcrawl/common"
@@ -10,14 +14,76 @@ import (
 
 const INDEX_SERVER = "https://web.archive.org/cdx/search/cdx"
 const CRAWL_STORAGE = "https://web.archive.org/web"
+const BATCH_SIZE = 5000 // Number of results requested at once in resume key pagination
 
 type Wayback struct {
-	MaxTimeout int // Request timeout
-	MaxRetries int // Max number of request retries if timeouted
+	MaxTimeout   int            // Request timeout
+	MaxRetries   int            // Max number of request retries if timeouted
+	client       *common.Client // HTTP client, common.DefaultClient if nil
+	indexServer  string         // CDX server URL, INDEX_SERVER by default
+	crawlStorage string         // Archived files URL, CRAWL_STORAGE by default
+	batchSize    int            // Results per request in resume key pagination, BATCH_SIZE by default
+	verifyDigest bool           // Check downloads against CDX digests
 }
 
-func New(timeout, retries int) (*Wayback, error) {
-	source := &Wayback{MaxTimeout: timeout, MaxRetries: retries}
+// Option ... Configures Wayback source in New
+type Option func(*Wayback)
+
+// WithClient ... Sets HTTP client, can be shared with other sources
+func WithClient(client *common.Client) Option {
+	return func(wb *Wayback) {
+		wb.client = client
+	}
+}
+
+// WithIndexServer ... Sets CDX server URL, to use local or mirror servers like pywb or OutbackCDX
+//
+//	url: like "http://localhost:8080/cdx/search/cdx"
+func WithIndexServer(url string) Option {
+	return func(wb *Wayback) {
+		wb.indexServer = strings.TrimRight(url, "/")
+	}
+}
+
+// WithCrawlStorage ... Sets URL of archived files storage, files are requested as <url>/<timestamp>id_/<original>
+//
+//	url: like "http://localhost:8080/web"
+func WithCrawlStorage(url string) Option {
+	return func(wb *Wayback) {
+		wb.crawlStorage = strings.TrimRight(url, "/")
+	}
+}
+
+// WithBatchSize ... Sets number of results requested at once in resume key pagination
+func WithBatchSize(size int) Option {
+	return func(wb *Wayback) {
+		if size > 0 {
+			wb.batchSize = size
+		}
+	}
+}
+
+// WithVerifyDigest ... Sets check of downloaded payloads against CDX digests, enabled by default. Mismatching downloads
+// are repeated up to common.DIGEST_RETRIES times and fail with common.ErrDigestMismatch. Revisits and captures replayed
+// instead of the requested one are not checked, see common.IsReplayOf.
+func WithVerifyDigest(verify bool) Option {
+	return func(wb *Wayback) {
+		wb.verifyDigest = verify
+	}
+}
+
+func New(timeout, retries int, opts ...Option) (*Wayback, error) {
+	source := &Wayback{
+		MaxTimeout:   timeout,
+		MaxRetries:   retries,
+		indexServer:  INDEX_SERVER,
+		crawlStorage: CRAWL_STORAGE,
+		batchSize:    BATCH_SIZE,
+		verifyDigest: true,
+	}
+	for _, opt := range opts {
+		opt(source)
+	}
 	return source, nil
 }
 
@@ -27,18 +93,28 @@ func (Wayback) Name() string {
 
 // Return the number of pages located in WebArchive for given url
 func (wb *Wayback) GetNumPages(url string) (int, error) {
+	return wb.GetNumPagesContext(context.Background(), url)
+}
 
-	requestURI := fmt.Sprintf("%v?url=%v&showNumPages=true", INDEX_SERVER, url)
-	response, err := common.Get(requestURI, wb.MaxTimeout, wb.MaxRetries)
+// GetNumPagesContext ... Same as GetNumPages, but request is aborted when ctx is done
+func (wb *Wayback) GetNumPagesContext(ctx context.Context, url string) (int, error) {
+	requestURI := fmt.Sprintf("%v?url=%v&showNumPages=true", wb.indexServer, url)
+	response, err := wb.client.Get(ctx, requestURI, wb.MaxTimeout, wb.MaxRetries)
 	if err != nil {
-		return 0, fmt.Errorf("[GetNumPages] Request error: %v", err)
+		return 0, common.WrapError(err, "GetNumPages", wb.Name(), requestURI, -1)
 	}
 
 	// Remove return and convert to integer
-	strRes := string(response[:len(response)-1])
-	res, err := strconv.Atoi(strRes)
+	res, err := strconv.Atoi(strings.TrimSpace(string(response)))
 	if err != nil {
-		return 0, fmt.Errorf("[GetNumPages] Cannot convert response value: %v", response)
+		return 0, &common.Error{
+			Kind:   common.KindParse,
+			Op:     "GetNumPages",
+			Source: wb.Name(),
+			URL:    requestURI,
+			Page:   -1,
+			Err:    fmt.Errorf("Cannot convert response value: %q", response),
+		}
 	}
 
 	return res, nil
@@ -46,11 +122,17 @@ func (wb *Wayback) GetNumPages(url string) (int, error) {
 
 // Parse response from https://web.archive.org/cdx/search/cdx CDX server
 func (wb *Wayback) ParseResponse(resp []byte) ([]*common.CdxResponse, error) {
+	results, _, err := wb.parseResponse(resp)
+	return results, err
+}
+
+// parseResponse ... Parses CDX server response and resume key which follows an empty row if showResumeKey was set
+func (wb *Wayback) parseResponse(resp []byte) ([]*common.CdxResponse, string, error) {
 	var results [][]string
 
 	err := jsoniter.Unmarshal(resp, &results)
 	if err != nil {
-		return nil, fmt.Errorf("[ParseResponse] Failed to decode Wayback results '%v'", err)
+		return nil, "", common.NewError(common.KindParse, "ParseResponse", "", fmt.Errorf("Failed to decode Wayback results '%v'", err))
 	}
 
 	parsedResults := []*common.CdxResponse{}
@@ -60,6 +142,17 @@ func (wb *Wayback) ParseResponse(resp []byte) ([]*common.CdxResponse, error) {
 			continue
 		}
 
+		if len(entry) == 0 {
+			if i+1 < len(results) && len(results[i+1]) > 0 {
+				return parsedResults, results[i+1][0], nil
+			}
+			return parsedResults, "", nil
+		}
+
+		if len(entry) < 7 {
+			return nil, "", common.NewError(common.KindParse, "ParseResponse", "", fmt.Errorf("Unexpected number of columns in Wayback result: %v", entry))
+		}
+
 		parsed := common.CdxResponse{
 			Urlkey:     entry[0],
 			Timestamp:  entry[1],
@@ -74,94 +167,206 @@ func (wb *Wayback) ParseResponse(resp []byte) ([]*common.CdxResponse, error) {
 		parsedResults = append(parsedResults, &parsed)
 	}
 
-	return parsedResults, nil
+	return parsedResults, "", nil
 }
 
-// GetPages ... Makes request to WebArchive CDX API to gather all url observations
-func (wb *Wayback) GetPages(config common.RequestConfig) ([]*common.CdxResponse, error) {
-	var pages int
-	var err error
-
-	if config.SinglePage {
-		pages = 1
-	} else {
-		pages, err = wb.GetNumPages(config.URL)
-		if err != nil {
-			return nil, err
-		}
+// fetchPage ... Makes request to WebArchive CDX API to get a single page of results
+func (wb *Wayback) fetchPage(ctx context.Context, config common.RequestConfig, page int) ([]*common.CdxResponse, error) {
+	reqURL := config.GetUrl(wb.indexServer, page)
+
+	response, err := wb.client.Get(ctx, reqURL, wb.MaxTimeout, wb.MaxRetries)
+	if err != nil {
+		return nil, common.WrapError(err, "FetchPage", wb.Name(), reqURL, page)
 	}
 
-	var results []*common.CdxResponse
-	numResults := 0
+	parsedResponse, err := wb.ParseResponse(response)
+	if err != nil {
+		return nil, common.WrapError(err, "FetchPage", wb.Name(), reqURL, page)
+	}
+	return parsedResponse, nil
+}
 
-	for page := 0; page < pages; page++ {
-		reqURL := config.GetUrl(INDEX_SERVER, page)
+// fetchBatch ... Makes request to WebArchive CDX API to get results starting at resumeKey, returns the key of the next batch
+func (wb *Wayback) fetchBatch(ctx context.Context, config common.RequestConfig, resumeKey string) ([]*common.CdxResponse, string, error) {
+	batch := config
+	batch.SinglePage = true
+	if config.Limit == 0 || config.Limit > uint(wb.batchSize) {
+		batch.Limit = uint(wb.batchSize)
+	}
 
-		response, err := common.Get(reqURL, wb.MaxTimeout, wb.MaxRetries)
-		if err != nil {
-			return results, fmt.Errorf("[GetPages] Request error: %v", err)
-		}
+	reqURL := batch.GetUrl(wb.indexServer, 0) + "&showResumeKey=true"
+	if resumeKey != "" {
+		// Key is returned already escaped
+		reqURL = fmt.Sprintf("%v&resumeKey=%v", reqURL, resumeKey)
+	}
 
-		parsedResponse, err := wb.ParseResponse(response)
-		if err != nil {
-			return results, fmt.Errorf("[GetPages] Cannot parse response: %v", err)
-		}
-		results = append(results, parsedResponse...)
-		numResults += len(parsedResponse)
+	response, err := wb.client.Get(ctx, reqURL, wb.MaxTimeout, wb.MaxRetries)
+	if err != nil {
+		return nil, "", common.WrapError(err, "FetchBatch", wb.Name(), reqURL, -1)
+	}
+
+	parsedResponse, nextKey, err := wb.parseResponse(response)
+	if err != nil {
+		return nil, "", common.WrapError(err, "FetchBatch", wb.Name(), reqURL, -1)
+	}
+	return parsedResponse, nextKey, nil
+}
+
+// pager ... Returns PageFunc for pagination mode of config.
+// Auto mode counts pages first and falls back to resume keys if the server cannot count them.
+func (wb *Wayback) pager(config common.RequestConfig) common.PageFunc {
+	resumePager := func() common.PageFunc {
+		return common.NewResumePager(config, func(ctx context.Context, resumeKey string) ([]*common.CdxResponse, string, error) {
+			return wb.fetchBatch(ctx, config, resumeKey)
+		})
+	}
+	pagesPager := func(numPages func(ctx context.Context) (int, error)) common.PageFunc {
+		return common.NewPager(config, numPages, func(ctx context.Context, page int) ([]*common.CdxResponse, error) {
+			return wb.fetchPage(ctx, config, page)
+		})
+	}
+	countPages := func(ctx context.Context) (int, error) {
+		return wb.GetNumPagesContext(ctx, config.URL)
+	}
 
-		if config.Limit != 0 && uint(numResults) >= config.Limit {
-			break
+	switch {
+	case config.Pagination == common.PaginationResumeKey:
+		return resumePager()
+	case config.Pagination == common.PaginationPages || config.SinglePage:
+		return pagesPager(countPages)
+	case config.Checkpoint != nil && config.Checkpoint.ResumeKey != "":
+		// Continue with the mode of interrupted run
+		return resumePager()
+	}
+
+	var next common.PageFunc
+	return func(ctx context.Context) ([]*common.CdxResponse, error) {
+		if next == nil {
+			numPages, err := countPages(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, err
+				}
+				next = resumePager()
+			} else {
+				next = pagesPager(func(context.Context) (int, error) { return numPages, nil })
+			}
 		}
+		return next(ctx)
 	}
+}
+
+// Iterate ... Returns iterator over all url observations in WebArchive CDX API.
+// Pages are requested lazily while records are consumed.
+func (wb *Wayback) Iterate(ctx context.Context, config common.RequestConfig) *common.Iterator {
+	return common.NewIterator(ctx, wb.pager(config))
+}
 
-	return results, nil
+// GetPages ... Makes request to WebArchive CDX API to gather all url observations
+func (wb *Wayback) GetPages(config common.RequestConfig) ([]*common.CdxResponse, error) {
+	return wb.GetPagesContext(context.Background(), config)
+}
+
+// GetPagesContext ... Same as GetPages, but stops fetching pages when ctx is done
+func (wb *Wayback) GetPagesContext(ctx context.Context, config common.RequestConfig) ([]*common.CdxResponse, error) {
+	return common.Collect(wb.Iterate(ctx, config))
 }
 
 // FetchPages ... Concurrent way to GetPages.
 // Makes request to WebArchive CDX API and return observations in a channel.
+//
+// Deprecated: use Iterate, channels are never closed and completion is not signaled.
 func (wb *Wayback) FetchPages(config common.RequestConfig, results chan []*common.CdxResponse, errors chan error) {
-	var pages int
-	var err error
-
-	if config.SinglePage {
-		pages = 1
-	} else {
-		pages, err = wb.GetNumPages(config.URL)
-		if err != nil {
-			errors <- err
-		}
-	}
+	wb.FetchPagesContext(context.Background(), config, results, errors)
+}
 
-	numResults := 0
+// FetchPagesContext ... Same as FetchPages, but returns as soon as ctx is done.
+// Results and errors are not sent once ctx is done, so the caller may stop reading channels.
+//
+// Deprecated: use Iterate.
+func (wb *Wayback) FetchPagesContext(ctx context.Context, config common.RequestConfig, results chan []*common.CdxResponse, errors chan error) {
+	common.FetchPages(ctx, wb.pager(config), results, errors)
+}
 
-	for page := 0; page < pages; page++ {
-		reqURL := config.GetUrl(INDEX_SERVER, page)
+// Download file from WebArchive using a link from CDX response
+func (wb *Wayback) GetFile(page *common.CdxResponse) ([]byte, error) {
+	return wb.GetFileContext(context.Background(), page)
+}
 
-		response, err := common.Get(reqURL, wb.MaxTimeout, wb.MaxRetries)
-		if err != nil {
-			errors <- fmt.Errorf("[FetchPages] Request error: %v", err)
-		}
+// GetFileContext ... Same as GetFile, but download is aborted when ctx is done
+func (wb *Wayback) GetFileContext(ctx context.Context, page *common.CdxResponse) ([]byte, error) {
+	requestURI := fmt.Sprintf("%v/%vid_/%v", wb.crawlStorage, page.Timestamp, page.Original)
 
-		parsedResponse, err := wb.ParseResponse(response)
-		if err != nil {
-			errors <- fmt.Errorf("[FetchPages] Cannot parse response: %v", err)
+	var resp *common.Response
+	err := common.RetryDigest(ctx, common.DIGEST_RETRIES, func() (err error) {
+		if resp, err = wb.client.GetResponse(ctx, requestURI, wb.MaxTimeout, wb.MaxRetries); err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return common.StatusError(resp.StatusCode, requestURI)
+		}
+		if !wb.verifyDigest {
+			return nil
 		}
-		numResults += len(parsedResponse)
+		return common.VerifyReplayDigest(page, resp)
+	})
+	if err != nil {
+		return nil, common.WrapError(err, "GetFile", wb.Name(), requestURI, -1)
+	}
+	return resp.Body, nil
+}
 
-		results <- parsedResponse
+// GetCapture ... Downloads capture from WebArchive with original status code and headers
+func (wb *Wayback) GetCapture(page *common.CdxResponse) (*common.Capture, error) {
+	return wb.GetCaptureContext(context.Background(), page)
+}
 
-		if config.Limit != 0 && uint(numResults) >= config.Limit {
-			return
+// GetCaptureContext ... Same as GetCapture, but download is aborted when ctx is done
+func (wb *Wayback) GetCaptureContext(ctx context.Context, page *common.CdxResponse) (*common.Capture, error) {
+	requestURI := fmt.Sprintf("%v/%vid_/%v", wb.crawlStorage, page.Timestamp, page.Original)
+	var resp *common.Response
+	err := common.RetryDigest(ctx, common.DIGEST_RETRIES, func() (err error) {
+		if resp, err = wb.client.GetResponse(ctx, requestURI, wb.MaxTimeout, wb.MaxRetries); err != nil || !wb.verifyDigest {
+			return err
 		}
+		return common.VerifyReplayDigest(page, resp)
+	})
+	if err != nil {
+		return nil, common.WrapError(err, "GetCapture", wb.Name(), requestURI, -1)
+	}
+
+	capture, err := common.NewReplayCapture(page, resp, requestURI)
+	if err != nil {
+		return nil, common.WrapError(err, "GetCapture", wb.Name(), requestURI, -1)
 	}
+	return capture, nil
 }
 
-// Download file from WebArchive using a link from CDX response
-func (wb *Wayback) GetFile(page *common.CdxResponse) ([]byte, error) {
-	requestURI := fmt.Sprintf("%v/%vid_/%v", CRAWL_STORAGE, page.Timestamp, page.Original)
-	response, err := common.Get(requestURI, wb.MaxTimeout, wb.MaxRetries)
+// OpenFile ... Opens file stream from WebArchive, the file is not buffered in memory. Stream must be closed.
+func (wb *Wayback) OpenFile(ctx context.Context, page *common.CdxResponse) (io.ReadCloser, error) {
+	payload, err := wb.OpenPayload(ctx, page)
+	if err != nil {
+		return nil, common.WrapError(err, "OpenFile", wb.Name(), "", -1)
+	}
+
+	body, err := payload.Decode()
 	if err != nil {
-		return nil, fmt.Errorf("[GetFile] Request error: %v", err)
+		return nil, common.WrapError(err, "OpenFile", wb.Name(), "", -1)
+	}
+	return body, nil
+}
+
+// OpenPayload ... Opens stream of file payload as archived, without decoding it.
+// Reading fails with common.ErrDigestMismatch at the end if payload doesn't match the record digest.
+func (wb *Wayback) OpenPayload(ctx context.Context, page *common.CdxResponse) (*common.Payload, error) {
+	requestURI := fmt.Sprintf("%v/%vid_/%v", wb.crawlStorage, page.Timestamp, page.Original)
+	resp, err := wb.client.OpenStream(ctx, requestURI, wb.MaxTimeout, wb.MaxRetries, nil)
+	if err != nil {
+		return nil, common.WrapError(err, "OpenPayload", wb.Name(), requestURI, -1)
+	}
+	stream := resp.Stream
+	if wb.verifyDigest && common.IsReplayOf(page, resp.Header) {
+		stream = common.NewDigestReader(page, stream)
 	}
-	return response, nil
+	return &common.Payload{ReadCloser: stream, Encoding: resp.Header.Get("Content-Encoding")}, nil
 }
@@ -1,10 +1,19 @@
 package wayback
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
 	"testing"
 	"time"
 
 	common "github.com/karust/gogetcrawl/common"
+	"github.com/karust/gogetcrawl/testutil"
 )
 
 // Example request: https://web.archive.org/cdx/search/cdx?url=kamaloff.ru/*&output=json&limit=100&collapse=urlkey
@@ -17,8 +26,32 @@ const RESPONSE = `[["urlkey","timestamp","original","mimetype","statuscode","dig
 // Test interface
 var wb common.Source = &Wayback{}
 
-func init() {
-	wb, _ = New(15, 2)
+var server *testutil.CDXServer
+
+func TestMain(m *testing.M) {
+	server = testutil.NewCDXServer()
+	seedCaptures(server)
+
+	wb, _ = New(15, 2, WithIndexServer(server.WaybackIndexURL()), WithCrawlStorage(server.WaybackStorageURL()))
+
+	code := m.Run()
+	server.Close()
+	os.Exit(code)
+}
+
+func seedCaptures(server *testutil.CDXServer) {
+	server.AddCapture(testutil.HTMLCapture("http://kamaloff.ru/", "20130522121421", 11011))
+	server.AddCapture(testutil.Capture{URL: "http://kamaloff.ru/robots.txt", Timestamp: "20130801111119", StatusCode: 404, Body: []byte("Not found")})
+	for i := 0; i < 12; i++ {
+		server.AddCapture(testutil.HTMLCapture(fmt.Sprintf("https://blog.kamaloff.ru/post/%v", i), "20180104100356", 2000))
+	}
+
+	for _, host := range []string{"tutorialspoint.com", "example.com"} {
+		for i := 0; i < 8; i++ {
+			server.AddCapture(testutil.HTMLCapture(fmt.Sprintf("https://www.%v/page%v.htm", host, i), "20200101000000", 500))
+		}
+		server.AddCapture(testutil.Capture{URL: fmt.Sprintf("https://www.%v/logo.png", host), Timestamp: "20200101000000", MimeType: "image/png", Body: []byte("PNG")})
+	}
 }
 
 func TestParseResponse(t *testing.T) {
@@ -87,18 +120,23 @@ func TestFetchPages(t *testing.T) {
 	resultsChan := make(chan []*common.CdxResponse)
 	errorsChan := make(chan error)
 
-	go func() {
-		wb.FetchPages(config1, resultsChan, errorsChan)
-	}()
+	var wg sync.WaitGroup
+	for _, config := range []common.RequestConfig{config1, config2} {
+		wg.Add(1)
+		go func(config common.RequestConfig) {
+			defer wg.Done()
+			wb.FetchPages(config, resultsChan, errorsChan)
+		}(config)
+	}
 
 	go func() {
-		wb.FetchPages(config2, resultsChan, errorsChan)
+		wg.Wait()
+		close(resultsChan)
 	}()
 
 	var results []*common.CdxResponse
-	timeout := false
 
-	for {
+	for done := false; !done; {
 		select {
 		case err := <-errorsChan:
 			t.Fatalf("FetchPages goroutine failed %v", err)
@@ -106,17 +144,8 @@ func TestFetchPages(t *testing.T) {
 			if len(res) > 0 && res[0].StatusCode != "200" {
 				t.Fatalf("Incorrect response")
 			}
-			if ok {
-				results = append(results, res...)
-			}
-		case <-time.After(time.Second * 10):
-			timeout = true
-			break
-		}
-
-		if timeout {
-			t.Log("Timeout passed")
-			break
+			results = append(results, res...)
+			done = !ok
 		}
 	}
 
@@ -127,6 +156,141 @@ func TestFetchPages(t *testing.T) {
 	}
 }
 
+func TestIterate(t *testing.T) {
+	config := common.RequestConfig{
+		URL:        "tutorialspoint.com/*",
+		Filters:    []string{"statuscode:200", "mimetype:text/html"},
+		Limit:      6,
+		SinglePage: true,
+	}
+
+	it := wb.Iterate(context.Background(), config)
+	defer it.Close()
+
+	count := 0
+	for it.Next() {
+		if it.Record().StatusCode != "200" {
+			t.Fatalf("Incorrect response status: %v", it.Record().StatusCode)
+		}
+		count++
+	}
+
+	if err := it.Err(); err != nil {
+		t.Fatalf("Iteration failed: %v", err)
+	}
+
+	if count != 6 {
+		t.Fatalf("Incorrect number of records: %v, want=6", count)
+	}
+}
+
+func TestIterateResume(t *testing.T) {
+	server.PageSize = 5
+	defer func() { server.PageSize = 50 }()
+
+	store, err := common.NewCheckpointStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Cannot create checkpoint store: %v", err)
+	}
+
+	config := common.RequestConfig{URL: "blog.kamaloff.ru/*"}
+	all, err := wb.GetPages(config)
+	if err != nil {
+		t.Fatalf("Cannot get pages: %v", err)
+	}
+
+	// Stop in the middle of the second page
+	config.Checkpoint, _ = store.Load(wb.Name(), config)
+	it := wb.Iterate(context.Background(), config)
+	for i := 0; i < 7 && it.Next(); i++ {
+	}
+	it.Close()
+
+	cp, err := store.Load(wb.Name(), config)
+	if err != nil {
+		t.Fatalf("Cannot load checkpoint: %v", err)
+	}
+	if cp.NextPage != 1 || cp.Results != 5 {
+		t.Fatalf("Incorrect checkpoint: page=%v results=%v, want page=1 results=5", cp.NextPage, cp.Results)
+	}
+
+	config.Checkpoint = cp
+	rest, err := common.Collect(wb.Iterate(context.Background(), config))
+	if err != nil {
+		t.Fatalf("Resumed iteration failed: %v", err)
+	}
+
+	if len(rest) != len(all)-5 {
+		t.Fatalf("Incorrect number of resumed records: %v, want=%v", len(rest), len(all)-5)
+	}
+	if rest[0].Original != all[5].Original {
+		t.Fatalf("Resumed from wrong record: %v, want=%v", rest[0].Original, all[5].Original)
+	}
+
+	// Completed query starts from scratch
+	if cp, _ = store.Load(wb.Name(), config); cp.NextPage != 0 {
+		t.Fatalf("Checkpoint is not removed after completion: page=%v", cp.NextPage)
+	}
+}
+
+func TestResumeKeyPagination(t *testing.T) {
+	local, _ := New(15, 2, WithIndexServer(server.WaybackIndexURL()), WithBatchSize(5))
+
+	config := common.RequestConfig{URL: "blog.kamaloff.ru/*"}
+	all, err := local.GetPages(config)
+	if err != nil {
+		t.Fatalf("Cannot get pages: %v", err)
+	}
+
+	config.Pagination = common.PaginationResumeKey
+	batches, err := local.GetPages(config)
+	if err != nil {
+		t.Fatalf("Cannot get pages with resume key: %v", err)
+	}
+
+	if len(batches) != len(all) {
+		t.Fatalf("Incorrect number of results: %v, want=%v", len(batches), len(all))
+	}
+	for i := range all {
+		if batches[i].Original != all[i].Original {
+			t.Fatalf("Incorrect result %v: %v, want=%v", i, batches[i].Original, all[i].Original)
+		}
+	}
+
+	results, key, err := local.parseResponse([]byte(`[["urlkey","timestamp","original","mimetype","statuscode","digest","length"],
+["ru,kamaloff)/", "20130522121421", "http://kamaloff.ru/", "text/html", "200", "FXOQP7LM7FWUC7S5MTDHZS2WMKNLCW2E", "2558"],
+[],
+["ru%2Ckamaloff%29%2F+20130522121421"]]`))
+	if err != nil {
+		t.Fatalf("Cannot parse response with resume key: %v", err)
+	}
+	if len(results) != 1 || key != "ru%2Ckamaloff%29%2F+20130522121421" {
+		t.Fatalf("Incorrect results=%v or resume key=%q", len(results), key)
+	}
+}
+
+func TestPaginationFallback(t *testing.T) {
+	server.NoNumPages = true
+	defer func() { server.NoNumPages = false }()
+
+	local, _ := New(15, 2, WithIndexServer(server.WaybackIndexURL()), WithBatchSize(5))
+
+	config := common.RequestConfig{URL: "blog.kamaloff.ru/*", Pagination: common.PaginationPages}
+	if _, err := local.GetPages(config); err == nil {
+		t.Fatalf("Expected page counting to fail")
+	}
+
+	config.Pagination = common.PaginationAuto
+	results, err := local.GetPages(config)
+	if err != nil {
+		t.Fatalf("Auto pagination failed: %v", err)
+	}
+
+	if len(results) != 12 {
+		t.Fatalf("Incorrect number of results: %v, want=12", len(results))
+	}
+}
+
 func TestGetFile(t *testing.T) {
 	config := common.RequestConfig{
 		URL:     "kamaloff.ru/*",
@@ -148,3 +312,193 @@ func TestGetFile(t *testing.T) {
 		t.Fatalf("Got incorrect length file")
 	}
 }
+
+func TestGetCapture(t *testing.T) {
+	capture, err := wb.GetCapture(&common.CdxResponse{Timestamp: "20130801111119", Original: "http://kamaloff.ru/robots.txt"})
+	if err != nil {
+		t.Fatalf("Cannot get capture: %v", err)
+	}
+
+	// Archived 404 page is a capture, not an error
+	if capture.StatusCode != 404 || string(capture.Body) != "Not found" {
+		t.Fatalf("Incorrect status=%v or body=%q", capture.StatusCode, capture.Body)
+	}
+	if capture.Header.Get("Content-Length") != "9" || capture.Header.Get("X-Archive-Orig-Content-Length") != "" {
+		t.Fatalf("Original headers are not restored: %v", capture.Header)
+	}
+
+	_, err = wb.GetCapture(&common.CdxResponse{Timestamp: "20000101000000", Original: "http://missing.example/"})
+	if !errors.Is(err, common.ErrNotFound) {
+		t.Fatalf("Expected not found error, got: %v", err)
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	stream, err := wb.OpenFile(context.Background(), &common.CdxResponse{Timestamp: "20130522121421", Original: "http://kamaloff.ru/"})
+	if err != nil {
+		t.Fatalf("Cannot open file: %v", err)
+	}
+	defer stream.Close()
+
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("Cannot read file: %v", err)
+	}
+
+	if len(data) != 11011 {
+		t.Fatalf("Incorrect file length: %v, want=11011", len(data))
+	}
+}
+
+func TestGetPagesContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	config := common.RequestConfig{URL: "kamaloff.ru/*"}
+	_, err := wb.GetPagesContext(ctx, config)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled error, got: %v", err)
+	}
+}
+
+func TestWithIndexServer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cdx/search/cdx" || r.URL.Query().Get("showNumPages") != "true" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, "3\n")
+	}))
+	defer server.Close()
+
+	local, _ := New(5, 1, WithIndexServer(server.URL+"/cdx/search/cdx/"))
+	got, err := local.GetNumPages("example.com")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if got != 3 {
+		t.Fatalf("Parsed result doesn't contain wanted value: Want=3, Got=%v", got)
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	_, err := wb.GetFile(&common.CdxResponse{Timestamp: "20000101000000", Original: "http://missing.example/"})
+	if !errors.Is(err, common.ErrNotFound) {
+		t.Fatalf("Expected not found error, got: %v", err)
+	}
+
+	var archiveErr *common.Error
+	if !errors.As(err, &archiveErr) {
+		t.Fatalf("Expected *common.Error, got: %T", err)
+	}
+
+	if archiveErr.Source != "Wayback" || archiveErr.Status != 404 || archiveErr.Op != "GetFile" {
+		t.Fatalf("Incorrect error details: %+v", archiveErr)
+	}
+
+	blocked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Blocked Site Error", http.StatusForbidden)
+	}))
+	defer blocked.Close()
+
+	local, _ := New(5, 3, WithIndexServer(blocked.URL))
+	_, err = local.GetPages(common.RequestConfig{URL: "example.com/*"})
+	if !errors.Is(err, common.ErrBlocked) {
+		t.Fatalf("Expected blocked error, got: %v", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	client, _ := common.NewClient(common.WithBackoff(common.Backoff{Base: time.Millisecond, Max: 10 * time.Millisecond}))
+	local, _ := New(5, 3, WithClient(client), WithIndexServer(server.WaybackIndexURL()))
+
+	server.FailNext(2, http.StatusTooManyRequests, "1")
+	start := time.Now()
+
+	pages, err := local.GetNumPages("kamaloff.ru")
+	if err != nil {
+		t.Fatalf("Request wasn't retried: %v", err)
+	}
+
+	if pages != 1 {
+		t.Fatalf("Parsed result doesn't contain wanted value: Want=1, Got=%v", pages)
+	}
+
+	if elapsed := time.Since(start); elapsed < 2*time.Second {
+		t.Fatalf("Retry-After wasn't honored, retried in %v", elapsed)
+	}
+
+	server.FailNext(3, http.StatusTooManyRequests, "")
+	_, err = local.GetNumPages("kamaloff.ru")
+	if !errors.Is(err, common.ErrRateLimited) {
+		t.Fatalf("Expected rate limited error, got: %v", err)
+	}
+}
+
+func TestDigestVerification(t *testing.T) {
+	results, err := wb.GetPages(common.RequestConfig{URL: "kamaloff.ru/", Filters: []string{"statuscode:200"}})
+	if err != nil || len(results) != 1 {
+		t.Fatalf("Cannot get pages: %v, %v", len(results), err)
+	}
+
+	// Corrupted download is repeated
+	server.CorruptNext(1)
+	if _, err := wb.GetFile(results[0]); err != nil {
+		t.Fatalf("Corrupted download is not repeated: %v", err)
+	}
+
+	server.CorruptNext(common.DIGEST_RETRIES)
+	_, err = wb.GetFile(results[0])
+	if !errors.Is(err, common.ErrDigestMismatch) {
+		t.Fatalf("Expected digest mismatch error, got: %v", err)
+	}
+
+	// Streams report mismatch at the end
+	server.CorruptNext(1)
+	stream, err := wb.OpenFile(context.Background(), results[0])
+	if err != nil {
+		t.Fatalf("Cannot open file: %v", err)
+	}
+	_, err = io.ReadAll(stream)
+	stream.Close()
+	if !errors.Is(err, common.ErrDigestMismatch) {
+		t.Fatalf("Expected digest mismatch error from stream, got: %v", err)
+	}
+
+	// Nearest capture replayed instead of the requested one has another digest
+	replaced := *results[0]
+	replaced.Timestamp, replaced.Digest = "20130522000000", common.PayloadDigest([]byte("other payload"))
+	if _, err := wb.GetFile(&replaced); err != nil {
+		t.Fatalf("Replayed nearest capture is checked: %v", err)
+	}
+	if _, err := wb.GetCapture(&replaced); err != nil {
+		t.Fatalf("Replayed nearest capture is checked: %v", err)
+	}
+	if _, err := wb.GetFile(&common.CdxResponse{Timestamp: results[0].Timestamp, Original: results[0].Original, Digest: replaced.Digest}); !errors.Is(err, common.ErrDigestMismatch) {
+		t.Fatalf("Expected digest mismatch error of requested capture, got: %v", err)
+	}
+
+	// Check can be turned off
+	unchecked, _ := New(15, 2, WithIndexServer(server.WaybackIndexURL()), WithCrawlStorage(server.WaybackStorageURL()), WithVerifyDigest(false))
+	server.CorruptNext(1)
+	if _, err := unchecked.GetFile(results[0]); err != nil {
+		t.Fatalf("Download is checked without verification: %v", err)
+	}
+}
+
+func TestCollapse(t *testing.T) {
+	config := common.RequestConfig{URL: "blog.kamaloff.ru/post/*", Collapse: []string{"timestamp:8"}}
+	results, err := wb.GetPages(config)
+	if err != nil {
+		t.Fatalf("Cannot get pages: %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Incorrect number of results collapsed by day: %v, want=1", len(results))
+	}
+
+	config.Collapse = []string{"urlkey"}
+	if results, _ = wb.GetPages(config); len(results) != 12 {
+		t.Fatalf("Incorrect number of results collapsed by urlkey: %v, want=12", len(results))
+	}
+}